@@ -4,7 +4,19 @@ import (
     "fmt"
     "net/http"
     "github.com/gorilla/mux"
+    "go-server/internal/audit"
+    "go-server/internal/auth"
+    "go-server/internal/config"
+    "go-server/internal/data"
     "go-server/internal/handlers"
+    "go-server/internal/mail"
+    "go-server/internal/models"
+    "go-server/internal/oidc"
+    "go-server/internal/policy"
+    "go-server/internal/snapshot"
+    "go-server/internal/objectstore"
+    "go-server/internal/replication"
+    "go-server/internal/sweeper"
     "path/filepath"
     "os"
     "strconv"
@@ -16,26 +28,210 @@ import (
 
 func main() {
     fmt.Println("Starting server...")
+
+    cfg, err := config.Load()
+    if err != nil {
+        fmt.Printf("Invalid configuration: %v\n", err)
+        os.Exit(1)
+    }
+
+    // Keep shaderstack restore and fsck away from the files while serving
+    lock, err := data.LockDataDir(cfg.DataDir)
+    if err != nil {
+        fmt.Printf("Could not lock %s: %v\n", cfg.DataDir, err)
+        os.Exit(1)
+    }
+    defer lock.Unlock()
+
+    store, err := newStore(cfg)
+    if err != nil {
+        fmt.Printf("Could not open %s storage: %v\n", cfg.Storage, err)
+        os.Exit(1)
+    }
+    defer store.Close()
+    handlers.SetStore(store)
+
+    // Hash any plaintext passwords left over from older users.json files
+    if migrated, err := store.MigrateLegacyPasswords(); err != nil {
+        fmt.Printf("Warning: password migration failed: %v\n", err)
+    } else if migrated > 0 {
+        fmt.Printf("Migrated %d legacy passwords to hashes\n", migrated)
+    }
+
+    // Make sure the configured admins can manage everyone else's roles
+    for _, username := range cfg.AdminUsernames {
+        user := store.GetUserByUsername(username)
+        if user == nil || user.Role == models.RoleAdmin {
+            continue
+        }
+        if err := store.SetRole(user.ID, models.RoleAdmin); err != nil {
+            fmt.Printf("Warning: could not make %s an admin: %v\n", username, err)
+        } else {
+            fmt.Printf("Granted admin role to %s\n", username)
+        }
+    }
+
+    sessionStore, err := newSessionStore(cfg, store)
+    if err != nil {
+        fmt.Printf("Could not open session store: %v\n", err)
+        os.Exit(1)
+    }
+    handlers.SetSessionStore(sessionStore)
+    stopSweeper := auth.StartSessionSweeper(sessionStore, cfg.SessionSweepInterval)
+    defer stopSweeper()
+
+    attemptStore, err := newAttemptStore(cfg)
+    if err != nil {
+        fmt.Printf("Could not open attempt store: %v\n", err)
+        os.Exit(1)
+    }
+    handlers.SetAttemptStore(attemptStore)
+
+    auditLog, err := newAuditLog(cfg)
+    if err != nil {
+        fmt.Printf("Could not open audit log: %v\n", err)
+        os.Exit(1)
+    }
+    handlers.SetAuditLog(auditLog)
+    stopAttemptSweeper := sweeper.Start("attempt", cfg.SessionSweepInterval, func() (int, error) {
+        return attemptStore.DeleteStale(time.Now().Add(-24 * time.Hour))
+    })
+    defer stopAttemptSweeper()
+    stopPendingLoginSweeper := handlers.StartPendingLoginSweeper(cfg.SessionSweepInterval)
+    defer stopPendingLoginSweeper()
+    stopTrashSweeper := sweeper.Start("trash", cfg.TrashPurgeInterval, func() (int, error) {
+        return store.PurgeDeletedShaders(time.Now().Add(-cfg.TrashRetention))
+    })
+    defer stopTrashSweeper()
+
+    snapshots := snapshot.NewManager(cfg.SnapshotDir, cfg.SnapshotKeep, store)
+    handlers.SetSnapshotManager(snapshots)
+    if cfg.ReplicaEndpoint != "" {
+        replicator, err := newReplicator(cfg)
+        if err != nil {
+            fmt.Printf("Could not set up replication: %v\n", err)
+            os.Exit(1)
+        }
+        snapshots.SetReplica(replicator)
+        if repo, ok := store.(*data.Repository); ok {
+            repo.SetShaderLogListener(replicator.Record)
+        }
+        // The shader log uploaded from now on needs a snapshot to apply to
+        if _, err := snapshots.Create(); err != nil {
+            fmt.Printf("Warning: Initial snapshot failed: %v\n", err)
+        }
+        stopReplication := replicator.Schedule(cfg.ReplicaFlushInterval)
+        defer stopReplication()
+        fmt.Printf("Replicating snapshots to bucket %s at %s\n", cfg.ReplicaBucket, cfg.ReplicaEndpoint)
+    }
+    if cfg.SnapshotInterval > 0 {
+        stopSnapshots := snapshots.Schedule(cfg.SnapshotInterval)
+        defer stopSnapshots()
+    }
+
+    if cfg.OIDCIssuer != "" {
+        handlers.SetOIDCProvider(oidc.NewProvider(oidc.Config{
+            Issuer:       cfg.OIDCIssuer,
+            ClientID:     cfg.OIDCClientID,
+            ClientSecret: cfg.OIDCClientSecret,
+            RedirectURL:  cfg.OIDCRedirectURL,
+            Scopes:       cfg.OIDCScopes,
+        }, nil))
+        fmt.Printf("Single sign-on enabled for %s\n", cfg.OIDCIssuer)
+    }
     
+    handlers.SetTrustedOrigins(cfg.TrustedOrigins)
+    handlers.SetMailer(newMailer(cfg), cfg.PublicURL)
+    handlers.SetRequireVerifiedEmail(cfg.RequireVerifiedEmail)
+    handlers.SetRegistrationPolicy(policy.RegistrationPolicy{
+        MinUsernameLength:  cfg.UsernameMinLength,
+        MaxUsernameLength:  cfg.UsernameMaxLength,
+        ReservedNames:      cfg.ReservedUsernames,
+        MinPasswordLength:  cfg.PasswordMinLength,
+        MinPasswordClasses: cfg.PasswordMinClasses,
+        InviteOnly:         cfg.InviteOnly,
+    })
+    if cfg.InviteOnly {
+        fmt.Println("Registration is invite only")
+    }
+
     r := mux.NewRouter()
+    r.Use(handlers.StripIdentityHeaders)
+    r.Use(handlers.CSRFMiddleware)
     fmt.Println("Router created...")
 
     // Removed InitTemplates (SSR templates deprecated)
 
     // Authentication routes
     r.HandleFunc("/api/login", handlers.Login).Methods("POST")
+    r.HandleFunc("/api/login/2fa", handlers.LoginTwoFactor).Methods("POST")
     r.HandleFunc("/api/register", handlers.Register).Methods("POST")
     r.HandleFunc("/api/auth", handlers.GetAuthInfo).Methods("GET")
     r.HandleFunc("/api/logout", handlers.Logout).Methods("POST")
+    r.HandleFunc("/api/oidc/login", handlers.OIDCLogin).Methods("GET")
+    r.HandleFunc("/api/oidc/callback", handlers.OIDCCallback).Methods("GET")
+    r.HandleFunc("/api/oidc/link", handlers.AuthMiddleware(handlers.OIDCLink)).Methods("POST")
+    r.HandleFunc("/api/account/password", handlers.AuthMiddleware(handlers.ChangePassword)).Methods("PUT")
+    r.HandleFunc("/api/account/username", handlers.AuthMiddleware(handlers.ChangeUsername)).Methods("PUT")
+    r.HandleFunc("/api/account", handlers.AuthMiddleware(handlers.DeleteAccount)).Methods("DELETE")
+    r.HandleFunc("/api/account/email", handlers.AuthMiddleware(handlers.UpdateEmail)).Methods("PUT")
+    r.HandleFunc("/api/account/email/verification", handlers.AuthMiddleware(handlers.ResendVerification)).Methods("POST")
+    r.HandleFunc("/api/account/2fa/setup", handlers.AuthMiddleware(handlers.StartTwoFactorSetup)).Methods("POST")
+    r.HandleFunc("/api/account/2fa/enable", handlers.AuthMiddleware(handlers.EnableTwoFactor)).Methods("POST")
+    r.HandleFunc("/api/account/2fa", handlers.AuthMiddleware(handlers.DisableTwoFactor)).Methods("DELETE")
+    r.HandleFunc("/api/account/2fa/recovery-codes", handlers.AuthMiddleware(handlers.RegenerateRecoveryCodes)).Methods("POST")
+    r.HandleFunc("/api/email/verify", handlers.VerifyEmail).Methods("POST")
+    r.HandleFunc("/api/password/forgot", handlers.ForgotPassword).Methods("POST")
+    r.HandleFunc("/api/password/reset", handlers.ResetPassword).Methods("POST")
+    r.HandleFunc("/api/sessions", handlers.AuthMiddleware(handlers.ListSessions)).Methods("GET")
+    r.HandleFunc("/api/sessions/others", handlers.AuthMiddleware(handlers.RevokeOtherSessions)).Methods("DELETE")
+    r.HandleFunc("/api/sessions/{id:[0-9a-f]+}", handlers.AuthMiddleware(handlers.RevokeSession)).Methods("DELETE")
+
+    // Personal API tokens can only be managed from a logged in session
+    r.HandleFunc("/api/tokens", handlers.AuthMiddleware(handlers.ListTokens)).Methods("GET")
+    r.HandleFunc("/api/tokens", handlers.AuthMiddleware(handlers.CreateToken)).Methods("POST")
+    r.HandleFunc("/api/tokens/{id:[0-9]+}", handlers.AuthMiddleware(handlers.DeleteToken)).Methods("DELETE")
+
+    // Invite codes for invite-only registration, and moderation, which each
+    // handler checks the current user's role for
+    r.HandleFunc("/api/invites", handlers.AuthMiddleware(handlers.ListInvites)).Methods("GET")
+    r.HandleFunc("/api/invites", handlers.AuthMiddleware(handlers.CreateInvite)).Methods("POST")
+    r.HandleFunc("/api/invites/{id:[0-9]+}", handlers.AuthMiddleware(handlers.DeleteInvite)).Methods("DELETE")
+    r.HandleFunc("/api/users/{id:[0-9]+}/role", handlers.AuthMiddleware(handlers.SetUserRole)).Methods("PUT")
+    r.HandleFunc("/api/users/{id:[0-9]+}/ban", handlers.AuthMiddleware(handlers.SetUserBanned)).Methods("PUT")
+    r.HandleFunc("/api/tags/{id:[0-9]+}", handlers.AuthMiddleware(handlers.RenameTag)).Methods("PUT")
+    r.HandleFunc("/api/tags/{id:[0-9]+}", handlers.AuthMiddleware(handlers.DeleteTag)).Methods("DELETE")
+    r.HandleFunc("/api/audit", handlers.AuthMiddleware(handlers.ListAuditLog)).Methods("GET")
+    r.HandleFunc("/api/snapshots", handlers.AuthMiddleware(handlers.ListSnapshots)).Methods("GET")
+    r.HandleFunc("/api/snapshots", handlers.AuthMiddleware(handlers.CreateSnapshot)).Methods("POST")
     fmt.Println("Auth routes added...")
 
     // API routes for shaders - Fixed to match frontend expectations
-    r.HandleFunc("/api/shaders", handlers.GetShaders).Methods("GET")
-    r.HandleFunc("/api/shaders", handlers.AuthMiddleware(handlers.CreateShaderAPI)).Methods("POST")
-    r.HandleFunc("/api/shaders/{id:[0-9]+}", handlers.GetShader).Methods("GET")
-    r.HandleFunc("/api/shaders/{id:[0-9]+}", handlers.AuthMiddleware(handlers.UpdateShader)).Methods("PUT")
-    r.HandleFunc("/api/shaders/{id:[0-9]+}", handlers.AuthMiddleware(handlers.DeleteShader)).Methods("DELETE")
-    r.HandleFunc("/api/shaders/{id:[0-9]+}/properties", handlers.AuthMiddleware(handlers.UpdateShaderProperties)).Methods("PUT")
+    r.HandleFunc("/api/shaders", handlers.OptionalAuthMiddleware(handlers.GetShaders, auth.ScopeShadersRead)).Methods("GET")
+    r.HandleFunc("/api/shaders", handlers.AuthMiddleware(handlers.CreateShaderAPI, auth.ScopeShadersWrite)).Methods("POST")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}", handlers.OptionalAuthMiddleware(handlers.GetShader, auth.ScopeShadersRead)).Methods("GET")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}", handlers.AuthMiddleware(handlers.UpdateShader, auth.ScopeShadersWrite)).Methods("PUT")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}", handlers.AuthMiddleware(handlers.DeleteShader, auth.ScopeShadersWrite)).Methods("DELETE")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}/revisions", handlers.OptionalAuthMiddleware(handlers.GetRevisions, auth.ScopeShadersRead)).Methods("GET")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}/revisions/diff", handlers.OptionalAuthMiddleware(handlers.DiffRevisions, auth.ScopeShadersRead)).Methods("GET")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}/revisions/{number:[0-9]+}", handlers.OptionalAuthMiddleware(handlers.GetRevision, auth.ScopeShadersRead)).Methods("GET")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}/revisions/{number:[0-9]+}/revert", handlers.AuthMiddleware(handlers.RevertShader, auth.ScopeShadersWrite)).Methods("POST")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}/restore", handlers.AuthMiddleware(handlers.RestoreShader, auth.ScopeShadersWrite)).Methods("POST")
+    r.HandleFunc("/api/trash", handlers.AuthMiddleware(handlers.GetTrash, auth.ScopeShadersRead)).Methods("GET")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}/properties", handlers.AuthMiddleware(handlers.UpdateShaderProperties, auth.ScopeShadersWrite, auth.ScopeTagsWrite)).Methods("PUT")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}/collaborators", handlers.OptionalAuthMiddleware(handlers.ListCollaborators, auth.ScopeShadersRead)).Methods("GET")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}/collaborators", handlers.AuthMiddleware(handlers.SetCollaborator, auth.ScopeShadersWrite)).Methods("PUT")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}/collaborators/{user_id:[0-9]+}", handlers.AuthMiddleware(handlers.RemoveCollaborator, auth.ScopeShadersWrite)).Methods("DELETE")
+    r.HandleFunc("/api/shaders/{id:[0-9]+}/team", handlers.AuthMiddleware(handlers.SetShaderTeam, auth.ScopeShadersWrite)).Methods("PUT")
+
+    // Teams that own shaders on behalf of their members
+    r.HandleFunc("/api/teams", handlers.OptionalAuthMiddleware(handlers.ListTeams, auth.ScopeShadersRead)).Methods("GET")
+    r.HandleFunc("/api/teams", handlers.AuthMiddleware(handlers.CreateTeam)).Methods("POST")
+    r.HandleFunc("/api/teams/{id:[0-9]+}", handlers.OptionalAuthMiddleware(handlers.GetTeam, auth.ScopeShadersRead)).Methods("GET")
+    r.HandleFunc("/api/teams/{id:[0-9]+}", handlers.AuthMiddleware(handlers.RenameTeam)).Methods("PUT")
+    r.HandleFunc("/api/teams/{id:[0-9]+}", handlers.AuthMiddleware(handlers.DeleteTeam)).Methods("DELETE")
+    r.HandleFunc("/api/teams/{id:[0-9]+}/members", handlers.AuthMiddleware(handlers.SetTeamMember)).Methods("PUT")
+    r.HandleFunc("/api/teams/{id:[0-9]+}/members/{user_id:[0-9]+}", handlers.AuthMiddleware(handlers.RemoveTeamMember)).Methods("DELETE")
     fmt.Println("API routes added...")
 
     // API routes for tags
@@ -61,6 +257,71 @@ func main() {
     }
 }
 
+func newStore(cfg config.Config) (data.Store, error) {
+    if cfg.Storage == "sqlite" {
+        return data.NewSQLiteStore(cfg.SQLitePath)
+    }
+    return data.NewRepository(cfg.DataDir, cfg.JSONBackups, cfg.ShaderLogCompactSize)
+}
+
+func newReplicator(cfg config.Config) (*replication.Replicator, error) {
+    client, err := objectstore.New(objectstore.Config{
+        Endpoint:  cfg.ReplicaEndpoint,
+        Region:    cfg.ReplicaRegion,
+        Bucket:    cfg.ReplicaBucket,
+        AccessKey: cfg.ReplicaAccessKey,
+        SecretKey: cfg.ReplicaSecretKey,
+    }, nil)
+    if err != nil {
+        return nil, err
+    }
+    return replication.New(client, cfg.ReplicaPrefix, cfg.ReplicaKeep, cfg.ReplicaMaxQueue), nil
+}
+
+func newSessionStore(cfg config.Config, store data.Store) (auth.SessionStore, error) {
+    sessionConfig := auth.DefaultSessionConfig()
+    sessionConfig.AbsoluteTimeout = cfg.SessionAbsoluteTimeout
+    sessionConfig.IdleTimeout = cfg.SessionIdleTimeout
+
+    switch cfg.SessionStore {
+    case "memory":
+        return auth.NewMemorySessionStore(sessionConfig), nil
+    case "file":
+        return auth.NewFileSessionStore(cfg.SessionFile, sessionConfig)
+    }
+    return store.Sessions(sessionConfig)
+}
+
+func newAttemptStore(cfg config.Config) (auth.AttemptStore, error) {
+    if cfg.AttemptStore == "file" {
+        return auth.NewFileAttemptStore(cfg.AttemptFile)
+    }
+    return auth.NewMemoryAttemptStore(), nil
+}
+
+func newAuditLog(cfg config.Config) (audit.Log, error) {
+    if cfg.AuditLogFile == "" {
+        return audit.NewMemoryLog(), nil
+    }
+    return audit.NewFileLog(cfg.AuditLogFile, int64(cfg.AuditLogMaxBytes), cfg.AuditLogMaxFiles)
+}
+
+func newMailer(cfg config.Config) mail.Mailer {
+    switch cfg.Mailer {
+    case "smtp":
+        return &mail.SMTPMailer{
+            Host:     cfg.SMTPHost,
+            Port:     cfg.SMTPPort,
+            Username: cfg.SMTPUsername,
+            Password: cfg.SMTPPassword,
+            From:     cfg.MailFrom,
+        }
+    case "spool":
+        return &mail.SpoolMailer{Dir: cfg.MailSpoolDir, From: cfg.MailFrom}
+    }
+    return nil
+}
+
 func cacheFileServer(root string) http.Handler {
     fs := http.FileServer(http.Dir(root))
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go-server/internal/config"
+	"go-server/internal/data"
+	"go-server/internal/objectstore"
+	"go-server/internal/replication"
+	"go-server/internal/snapshot"
+)
+
+// shaderstack runs maintenance commands against the data the server uses,
+// configured from the same environment. The commands work on the files
+// directly, and refuse to run while the server holds the data directory.
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "fsck":
+		os.Exit(fsck(os.Args[2:]))
+	case "restore":
+		os.Exit(restore(os.Args[2:]))
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: shaderstack fsck [-fix] [-orphans-to username] [-json]")
+	fmt.Fprintln(os.Stderr, "       shaderstack restore [-dry-run] archive")
+	fmt.Fprintln(os.Stderr, "       shaderstack restore -from-bucket [-dry-run] [snapshot]")
+	os.Exit(2)
+}
+
+// fsck checks the JSON data for inconsistencies, and repairs them with -fix.
+// It exits with 1 if anything is left unrepaired.
+func fsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "repair the inconsistencies found")
+	orphansTo := flags.String("orphans-to", "", "give shaders whose owner no longer exists to this user")
+	asJSON := flags.Bool("json", false, "print the full report as JSON")
+	flags.Parse(args)
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		return 2
+	}
+	if cfg.Storage != "json" {
+		fmt.Printf("fsck only checks json storage, STORAGE is %s\n", cfg.Storage)
+		return 2
+	}
+	// Opening an empty directory would fill it with default data
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, "users.json")); err != nil {
+		fmt.Printf("No data found in %s: %v\n", cfg.DataDir, err)
+		return 2
+	}
+
+	lock := lockDataDir(cfg)
+	if lock == nil {
+		return 2
+	}
+	defer lock.Unlock()
+
+	repo, err := data.NewRepository(cfg.DataDir, cfg.JSONBackups, cfg.ShaderLogCompactSize)
+	if err != nil {
+		fmt.Printf("Could not open json storage: %v\n", err)
+		return 2
+	}
+	defer repo.Close()
+
+	options := data.CheckOptions{Fix: *fix}
+	if *orphansTo != "" {
+		user := repo.GetUserByUsername(*orphansTo)
+		if user == nil {
+			fmt.Printf("User %s not found\n", *orphansTo)
+			return 2
+		}
+		options.OrphansTo = user.ID
+	}
+
+	report, err := repo.Check(options)
+	if err != nil {
+		fmt.Printf("Check failed: %v\n", err)
+		return 2
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		for _, issue := range report.Issues {
+			status := ""
+			if issue.Fixed {
+				status = " (fixed)"
+			}
+			fmt.Printf("shader %d: %s: %s%s\n", issue.ShaderID, issue.Kind, issue.Detail, status)
+		}
+		printSummary(report)
+	}
+
+	if report.Fixed < len(report.Issues) {
+		return 1
+	}
+	return 0
+}
+
+// printSummary prints one line of key=value pairs, for scripts to parse
+func printSummary(report *data.CheckReport) {
+	kinds := make([]string, 0, len(report.Counts))
+	for kind := range report.Counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	fmt.Printf("summary: shaders=%d issues=%d fixed=%d", report.Shaders, len(report.Issues), report.Fixed)
+	for _, kind := range kinds {
+		fmt.Printf(" %s=%d", kind, report.Counts[kind])
+	}
+	fmt.Println()
+}
+
+// restore replaces users, shaders, tags, teams and revisions with those in a
+// snapshot archive, after checking the whole archive can be read. With
+// -from-bucket the archive is the newest, or the named, snapshot in the
+// replica bucket, and the shader log replicated from it until the next
+// snapshot is restored too. Only JSON storage can be restored.
+func restore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only check the archive")
+	fromBucket := flags.Bool("from-bucket", false, "restore from the replica bucket")
+	flags.Parse(args)
+	if flags.NArg() > 1 || flags.NArg() == 0 && !*fromBucket {
+		usage()
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		return 2
+	}
+	if cfg.Storage != "json" {
+		fmt.Printf("restore only supports STORAGE=json: it writes the JSON data files in %s, which a server with STORAGE=%s does not read\n", cfg.DataDir, cfg.Storage)
+		return 2
+	}
+
+	var archive, log []byte
+	if *fromBucket {
+		var name string
+		if name, archive, log, err = downloadReplica(cfg, flags.Arg(0)); err != nil {
+			fmt.Printf("Could not download from bucket: %v\n", err)
+			return 2
+		}
+		fmt.Printf("Downloaded %s and %d bytes of shader log\n", name, len(log))
+	} else if archive, err = ioutil.ReadFile(flags.Arg(0)); err != nil {
+		fmt.Printf("Could not open archive: %v\n", err)
+		return 2
+	}
+
+	manifest, files, err := snapshot.Read(bytes.NewReader(archive))
+	if err == nil {
+		err = data.ValidateSnapshot(files)
+	}
+	if err == nil {
+		err = data.ValidateShaderLog(log)
+	}
+	if err != nil {
+		fmt.Printf("Invalid archive: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Snapshot taken %s is valid\n", manifest.CreatedAt.Format(time.RFC3339))
+	if *dryRun {
+		return 0
+	}
+
+	lock := lockDataDir(cfg)
+	if lock == nil {
+		return 2
+	}
+	defer lock.Unlock()
+
+	if err := data.RestoreSnapshot(cfg.DataDir, files, log, cfg.JSONBackups); err != nil {
+		fmt.Printf("Restore failed, run it again to finish: %v\n", err)
+		return 2
+	}
+	fmt.Printf("Restored users, shaders, tags, teams and revisions in %s\n", cfg.DataDir)
+	if len(log) > 0 {
+		fmt.Println("Users, tags and teams are as they were when the snapshot was taken, only shader changes were replayed")
+		fmt.Println("Run shaderstack fsck, shaders changed since the snapshot may use tags it does not have")
+	}
+	return 0
+}
+
+// lockDataDir takes the lock the server holds on the data directory, so that
+// a command cannot change the files under a running server. It prints why
+// and returns nil if the lock cannot be taken.
+func lockDataDir(cfg config.Config) *data.DirLock {
+	lock, err := data.LockDataDir(cfg.DataDir)
+	if err == data.ErrDataDirLocked {
+		fmt.Printf("%s is in use, stop the server first\n", cfg.DataDir)
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("Could not lock %s: %v\n", cfg.DataDir, err)
+		return nil
+	}
+	return lock
+}
+
+// downloadReplica fetches a snapshot and the shader log of its generation
+// from the bucket the server is configured to replicate to
+func downloadReplica(cfg config.Config, name string) (string, []byte, []byte, error) {
+	if cfg.ReplicaEndpoint == "" {
+		return "", nil, nil, fmt.Errorf("REPLICA_ENDPOINT is not set")
+	}
+	client, err := objectstore.New(objectstore.Config{
+		Endpoint:  cfg.ReplicaEndpoint,
+		Region:    cfg.ReplicaRegion,
+		Bucket:    cfg.ReplicaBucket,
+		AccessKey: cfg.ReplicaAccessKey,
+		SecretKey: cfg.ReplicaSecretKey,
+	}, nil)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return replication.New(client, cfg.ReplicaPrefix, cfg.ReplicaKeep, cfg.ReplicaMaxQueue).Restore(name)
+}
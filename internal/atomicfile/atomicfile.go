@@ -0,0 +1,196 @@
+package atomicfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile replaces path with data. The data is written to a temporary file
+// in the same directory, synced, and renamed over path, and the directory is
+// synced so the rename itself survives a crash. If generations is more than
+// zero the previous contents are kept as path.bak.1, shifting older backups
+// up to path.bak.<generations>.
+func WriteFile(path string, data []byte, perm os.FileMode, generations int) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	// Removing fails harmlessly once the file has been renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := rotate(path, generations); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// ErrUnsupported may be wrapped by the error decode returns for data that is
+// intact but cannot be used, such as a format written by a newer version.
+// Load then fails at once, rather than replace it with an older backup.
+var ErrUnsupported = errors.New("unsupported data")
+
+// Load reads path and passes its contents to decode. If path is missing or
+// decode fails, the backups are tried from newest to oldest, and the first
+// one that decodes is copied back to path. Load returns the backup that was
+// restored, or "" if path itself was fine. It returns an error wrapping
+// os.ErrNotExist if there is neither a file nor any backup, and refuses to
+// guess if none of them decode.
+func Load(path string, generations int, decode func(data []byte) error) (string, error) {
+	var firstErr error
+	found := false
+
+	for i := 0; i <= generations; i++ {
+		candidate := path
+		if i > 0 {
+			candidate = BackupPath(path, i)
+		}
+
+		data, err := ioutil.ReadFile(candidate)
+		if os.IsNotExist(err) {
+			continue
+		}
+		found = true
+		if err == nil {
+			err = decode(data)
+		}
+		if errors.Is(err, ErrUnsupported) {
+			return "", fmt.Errorf("%s: %w", candidate, err)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to read %s: %w", candidate, err)
+			}
+			fmt.Printf("Warning: %s is unreadable: %v\n", candidate, err)
+			continue
+		}
+
+		if i == 0 {
+			return "", nil
+		}
+		// Put the good copy back without rotating the damaged file into the
+		// backups
+		info, err := os.Stat(candidate)
+		if err != nil {
+			return "", err
+		}
+		if err := WriteFile(path, data, info.Mode().Perm(), 0); err != nil {
+			return "", fmt.Errorf("failed to restore %s from %s: %w", path, candidate, err)
+		}
+		return candidate, nil
+	}
+
+	if !found {
+		return "", fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+	return "", fmt.Errorf("no readable copy of %s or its backups: %w", path, firstErr)
+}
+
+// Chmod changes the mode of path and of its backups up to generations.
+// Files that do not exist are skipped.
+func Chmod(path string, generations int, perm os.FileMode) error {
+	for i := 0; i <= generations; i++ {
+		candidate := path
+		if i > 0 {
+			candidate = BackupPath(path, i)
+		}
+		if err := os.Chmod(candidate, perm); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackupPath returns the name of a backup generation of path, 1 being the
+// newest
+func BackupPath(path string, generation int) string {
+	return fmt.Sprintf("%s.bak.%d", path, generation)
+}
+
+// rotate shifts the backups of path up one generation, dropping the oldest,
+// and makes the current file the newest backup
+func rotate(path string, generations int) error {
+	if generations <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := os.Remove(BackupPath(path, generations)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := generations - 1; i >= 1; i-- {
+		if err := os.Rename(BackupPath(path, i), BackupPath(path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// A hard link keeps path in place until the new file is renamed over it,
+	// so there is no moment at which it is missing
+	if err := os.Link(path, BackupPath(path, 1)); err == nil {
+		return nil
+	}
+	return copyFile(path, BackupPath(path, 1))
+}
+
+// copyFile is the fallback for filesystems without hard links
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir flushes a directory's entries, so that renames in it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionLogin          = "auth.login"
+	ActionLoginFailed    = "auth.login_failed"
+	ActionLogout         = "auth.logout"
+	ActionRegister       = "auth.register"
+	ActionPasswordChange = "account.password"
+	ActionAccountDelete  = "account.delete"
+	ActionTwoFactorOn    = "account.2fa_enable"
+	ActionTwoFactorOff   = "account.2fa_disable"
+	ActionIdentityLink   = "account.identity_link"
+	ActionRoleChange     = "user.role"
+	ActionBanChange      = "user.ban"
+	ActionShaderCreate   = "shader.create"
+	ActionShaderUpdate   = "shader.update"
+	ActionShaderDelete   = "shader.delete"
+	ActionShaderRestore  = "shader.restore"
+	ActionShaderRevert   = "shader.revert"
+	ActionShaderProps    = "shader.properties"
+	ActionTagRename      = "tag.rename"
+	ActionTagDelete      = "tag.delete"
+	ActionSnapshot       = "data.snapshot"
+)
+
+// Kinds of audit log targets
+const (
+	TargetUser   = "user"
+	TargetShader = "shader"
+	TargetTag    = "tag"
+	TargetData   = "data"
+)
+
+// Log is an append-only record of who did what. Entries can only be added,
+// never changed or removed, other than by rotation of old entries.
+type Log interface {
+	Record(entry models.AuditEntry) error
+	// Query returns matching entries, newest first
+	Query(filter Filter) ([]models.AuditEntry, error)
+}
+
+// Filter selects audit log entries. Zero fields match everything.
+type Filter struct {
+	ActorID int
+	Action  string // Exact action, or a prefix ending in "." such as "shader."
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// Matches reports whether entry passes the filter
+func (f Filter) Matches(entry models.AuditEntry) bool {
+	if f.ActorID != 0 && entry.ActorID != f.ActorID {
+		return false
+	}
+	if f.Action != "" {
+		if strings.HasSuffix(f.Action, ".") {
+			if !strings.HasPrefix(entry.Action, f.Action) {
+				return false
+			}
+		} else if entry.Action != f.Action {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// newestFirst sorts entries by time, newest first, and applies the limit
+func (f Filter) newestFirst(entries []models.AuditEntry) []models.AuditEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[:f.Limit]
+	}
+	return entries
+}
+
+// MemoryLog keeps the audit log in process memory. It is lost when the server
+// restarts.
+type MemoryLog struct {
+	mu      sync.Mutex
+	entries []models.AuditEntry
+}
+
+// NewMemoryLog creates an empty in-memory audit log
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{}
+}
+
+func (l *MemoryLog) Record(entry models.AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+func (l *MemoryLog) Query(filter Filter) ([]models.AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	matches := []models.AuditEntry{}
+	for _, entry := range l.entries {
+		if filter.Matches(entry) {
+			matches = append(matches, entry)
+		}
+	}
+	return filter.newestFirst(matches), nil
+}
+
+// SummarizeShader describes a shader's auditable state in one line, or ""
+// for nil. Script code is summarized by size rather than copied into the log.
+func SummarizeShader(shader *models.Shader) string {
+	if shader == nil {
+		return ""
+	}
+
+	tags := make([]string, 0, len(shader.Tags))
+	for _, tag := range shader.Tags {
+		tags = append(tags, tag.Name)
+	}
+	codeBytes := len(shader.CommonScript)
+	for _, script := range shader.ShaderScripts {
+		codeBytes += len(script.Code)
+	}
+
+	summary := fmt.Sprintf("name=%q owner=%d tags=[%s] scripts=%d code_bytes=%d",
+		shader.Name, shader.UserID, strings.Join(tags, ","), len(shader.ShaderScripts), codeBytes)
+	if shader.TeamID != 0 {
+		summary += fmt.Sprintf(" team=%d", shader.TeamID)
+	}
+	return summary
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// PendingLogins holds logins whose password was correct but that still need
+// a second factor. Each is identified by a short-lived random token that is
+// exchanged, together with a valid code, for a session. Pending logins are
+// kept in memory only, a restart simply makes users enter their password
+// again.
+type PendingLogins struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	maxAttempts int
+	pending     map[string]pendingLogin // token hash -> login
+}
+
+type pendingLogin struct {
+	userID    int
+	expiresAt time.Time
+	failures  int
+}
+
+// NewPendingLogins creates a store whose tokens expire after ttl and are
+// discarded after maxAttempts wrong codes
+func NewPendingLogins(ttl time.Duration, maxAttempts int) *PendingLogins {
+	return &PendingLogins{
+		ttl:         ttl,
+		maxAttempts: maxAttempts,
+		pending:     make(map[string]pendingLogin),
+	}
+}
+
+// Create starts a pending login for userID and returns its token
+func (p *PendingLogins) Create(userID int) (string, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending[HashToken(token)] = pendingLogin{userID: userID, expiresAt: time.Now().Add(p.ttl)}
+	return token, nil
+}
+
+// Get returns the user of a pending login that has not expired
+func (p *PendingLogins) Get(token string) (int, bool) {
+	hash := HashToken(token)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	login, exists := p.pending[hash]
+	if !exists {
+		return 0, false
+	}
+	if !time.Now().Before(login.expiresAt) {
+		delete(p.pending, hash)
+		return 0, false
+	}
+	return login.userID, true
+}
+
+// Fail records a wrong code for a pending login, discarding it once it has
+// used up its attempts
+func (p *PendingLogins) Fail(token string) {
+	hash := HashToken(token)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	login, exists := p.pending[hash]
+	if !exists {
+		return
+	}
+	login.failures++
+	if login.failures >= p.maxAttempts {
+		delete(p.pending, hash)
+		return
+	}
+	p.pending[hash] = login
+}
+
+// Delete ends a pending login, once it has been completed
+func (p *PendingLogins) Delete(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.pending, HashToken(token))
+}
+
+// DeleteExpired removes pending logins past their expiry and returns how many
+// were removed
+func (p *PendingLogins) DeleteExpired() (int, error) {
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	removed := 0
+	for hash, login := range p.pending {
+		if !now.Before(login.expiresAt) {
+			delete(p.pending, hash)
+			removed++
+		}
+	}
+	return removed, nil
+}
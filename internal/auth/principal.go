@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+
+	"go-server/internal/models"
+)
+
+// Ways a request can be authenticated
+const (
+	MethodSession  = "session"
+	MethodAPIToken = "api_token"
+)
+
+// Principal is the authenticated identity behind a request
+type Principal struct {
+	User   *models.User
+	Role   string // The user's effective role, one of the models.Role constants
+	Method string // MethodSession or MethodAPIToken
+
+	// Scopes granted to the API token, nil for sessions which are unrestricted
+	Scopes []string
+	// SessionID is the opaque ID of the session, set for MethodSession
+	SessionID string
+	// TokenID is the ID of the API token, set for MethodAPIToken
+	TokenID int
+}
+
+// UserID returns the ID of the principal's user, or 0 for nil
+func (p *Principal) UserID() int {
+	if p == nil || p.User == nil {
+		return 0
+	}
+	return p.User.ID
+}
+
+// HasScopes reports whether the principal may act with every one of
+// required. Sessions may do anything the user can.
+func (p *Principal) HasScopes(required ...string) bool {
+	if p == nil {
+		return false
+	}
+	if p.Method == MethodSession {
+		return true
+	}
+	return HasScopes(p.Scopes, required...)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal stored in ctx, or nil for
+// anonymous requests
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// Scopes that can be granted to personal API tokens
+const (
+	ScopeShadersRead  = "shaders:read"
+	ScopeShadersWrite = "shaders:write"
+	ScopeTagsWrite    = "tags:write"
+)
+
+// APITokenPrefix marks personal API tokens so they are easy to recognise,
+// for example by secret scanners
+const APITokenPrefix = "ss_"
+
+var knownScopes = map[string]bool{
+	ScopeShadersRead:  true,
+	ScopeShadersWrite: true,
+	ScopeTagsWrite:    true,
+}
+
+// ValidScope reports whether scope is one that tokens can be granted
+func ValidScope(scope string) bool {
+	return knownScopes[scope]
+}
+
+// HasScopes reports whether granted contains every one of required
+func HasScopes(granted []string, required ...string) bool {
+	for _, scope := range required {
+		found := false
+		for _, g := range granted {
+			if g == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerateAPIToken creates a new random personal API token
+func GenerateAPIToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return APITokenPrefix + hex.EncodeToString(bytes), nil
+}
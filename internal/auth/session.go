@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"go-server/internal/models"
+	"go-server/internal/sweeper"
+)
+
+// SessionConfig controls how long sessions stay valid
+type SessionConfig struct {
+	// AbsoluteTimeout is the maximum lifetime of a session regardless of activity
+	AbsoluteTimeout time.Duration
+	// IdleTimeout expires a session that has not been used for this long
+	IdleTimeout time.Duration
+	// TouchInterval limits how often activity is recorded for a session, so
+	// that persistent stores are not rewritten on every request
+	TouchInterval time.Duration
+}
+
+// DefaultSessionConfig matches the 24h lifetime of the session cookie
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		AbsoluteTimeout: 24 * time.Hour,
+		IdleTimeout:     4 * time.Hour,
+		TouchInterval:   time.Minute,
+	}
+}
+
+// SessionStore keeps track of logged in sessions. Sessions are looked up by
+// their raw token but stored only by its hash, and are referred to by an
+// opaque ID everywhere else.
+type SessionStore interface {
+	// Create starts a new session for the user with a fresh random token
+	Create(userID int, userAgent, ip string) (models.Session, error)
+	// Get returns the session for token if it exists and has not expired,
+	// sliding its idle timeout forward
+	Get(token string) (models.Session, bool)
+	// Delete ends the session for token, if any
+	Delete(token string) error
+	// ListByUser returns the user's unexpired sessions, most recently used first
+	ListByUser(userID int) ([]models.Session, error)
+	// DeleteByID ends the user's session with the given ID and reports
+	// whether it existed
+	DeleteByID(userID int, id string) (bool, error)
+	// DeleteByUser ends all of the user's sessions except exceptID, which may
+	// be empty, and returns how many were ended
+	DeleteByUser(userID int, exceptID string) (int, error)
+	// DeleteExpired removes all expired sessions and returns how many were removed
+	DeleteExpired() (int, error)
+}
+
+// expired reports whether session is no longer valid at now
+func (c SessionConfig) expired(session models.Session, now time.Time) bool {
+	if !now.Before(session.ExpiresAt) {
+		return true
+	}
+	return c.IdleTimeout > 0 && now.Sub(session.LastSeenAt) >= c.IdleTimeout
+}
+
+// newSession builds a session for userID with a fresh random token and ID
+func (c SessionConfig) newSession(userID int, userAgent, ip string) (models.Session, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return models.Session{}, err
+	}
+	id, err := generateID()
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	now := time.Now()
+	return models.Session{
+		ID:         id,
+		Token:      token,
+		TokenHash:  HashToken(token),
+		UserID:     userID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(c.AbsoluteTimeout),
+		UserAgent:  userAgent,
+		IP:         ip,
+	}, nil
+}
+
+// GenerateToken creates a random 256 bit hex encoded token
+func GenerateToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// HashToken returns the hash under which a random token is stored. Tokens
+// carry 256 bits of entropy, so a plain SHA-256 is sufficient.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateID creates a random identifier that is safe to show to users
+func generateID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate id: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// StartSessionSweeper periodically removes expired sessions from store until
+// the returned stop function is called
+func StartSessionSweeper(store SessionStore, interval time.Duration) (stop func()) {
+	return sweeper.Start("session", interval, store.DeleteExpired)
+}
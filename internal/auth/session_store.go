@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go-server/internal/atomicfile"
+	"go-server/internal/models"
+)
+
+// MemorySessionStore keeps sessions in process memory. Sessions are lost when
+// the server restarts.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	config   SessionConfig
+	sessions map[string]models.Session // token hash -> session
+
+	// save persists the sessions map after a change, nil for memory only
+	save func() error
+}
+
+// NewMemorySessionStore creates an empty in-memory session store
+func NewMemorySessionStore(config SessionConfig) *MemorySessionStore {
+	return &MemorySessionStore{
+		config:   config,
+		sessions: make(map[string]models.Session),
+	}
+}
+
+// FileSessionStore is a MemorySessionStore that writes every change to a JSON
+// file so that sessions survive restarts
+type FileSessionStore struct {
+	*MemorySessionStore
+	path string
+}
+
+// NewFileSessionStore loads sessions from path, if it exists, dropping any
+// that expired while the server was down
+func NewFileSessionStore(path string, config SessionConfig) (*FileSessionStore, error) {
+	store := &FileSessionStore{
+		MemorySessionStore: NewMemorySessionStore(config),
+		path:               path,
+	}
+	store.save = store.saveSessions
+
+	if err := store.loadSessions(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *MemorySessionStore) Create(userID int, userAgent, ip string) (models.Session, error) {
+	session, err := s.config.newSession(userID, userAgent, ip)
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[session.TokenHash] = session
+	if err := s.persist(); err != nil {
+		delete(s.sessions, session.TokenHash)
+		return models.Session{}, err
+	}
+	return session, nil
+}
+
+func (s *MemorySessionStore) Get(token string) (models.Session, bool) {
+	hash := HashToken(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[hash]
+	if !exists {
+		return models.Session{}, false
+	}
+
+	now := time.Now()
+	if s.config.expired(session, now) {
+		delete(s.sessions, hash)
+		s.persistQuietly()
+		return models.Session{}, false
+	}
+
+	// Sliding renewal, throttled so persistent stores are not rewritten on
+	// every request
+	if now.Sub(session.LastSeenAt) >= s.config.TouchInterval {
+		session.LastSeenAt = now
+		s.sessions[hash] = session
+		s.persistQuietly()
+	}
+
+	return session, true
+}
+
+func (s *MemorySessionStore) Delete(token string) error {
+	hash := HashToken(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.sessions[hash]; !exists {
+		return nil
+	}
+	delete(s.sessions, hash)
+	return s.persist()
+}
+
+func (s *MemorySessionStore) ListByUser(userID int) ([]models.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var sessions []models.Session
+	for _, session := range s.sessions {
+		if session.UserID == userID && !s.config.expired(session, now) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+func (s *MemorySessionStore) DeleteByID(userID int, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, session := range s.sessions {
+		if session.ID == id && session.UserID == userID {
+			delete(s.sessions, hash)
+			return true, s.persist()
+		}
+	}
+	return false, nil
+}
+
+func (s *MemorySessionStore) DeleteByUser(userID int, exceptID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for hash, session := range s.sessions {
+		if session.UserID == userID && session.ID != exceptID {
+			delete(s.sessions, hash)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.persist()
+}
+
+func (s *MemorySessionStore) DeleteExpired() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := s.deleteExpiredLockFree(time.Now())
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.persist()
+}
+
+// Lock-free version for internal use when mutex is already held
+func (s *MemorySessionStore) deleteExpiredLockFree(now time.Time) int {
+	removed := 0
+	for hash, session := range s.sessions {
+		if s.config.expired(session, now) {
+			delete(s.sessions, hash)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (s *MemorySessionStore) persist() error {
+	if s.save == nil {
+		return nil
+	}
+	return s.save()
+}
+
+// persistQuietly is used on read paths, where a failed write should not
+// fail the request
+func (s *MemorySessionStore) persistQuietly() {
+	if err := s.persist(); err != nil {
+		fmt.Printf("Warning: Could not save sessions: %v\n", err)
+	}
+}
+
+func (s *FileSessionStore) loadSessions() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var sessions []models.Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range sessions {
+		// Sessions written before tokens were hashed cannot be looked up
+		if session.TokenHash == "" || session.ID == "" {
+			continue
+		}
+		s.sessions[session.TokenHash] = session
+	}
+	if s.deleteExpiredLockFree(time.Now()) > 0 {
+		return s.saveSessions()
+	}
+	return nil
+}
+
+func (s *FileSessionStore) saveSessions() error {
+	sessions := make([]models.Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Token hashes are not credentials, but there is no reason to share them
+	return atomicfile.WriteFile(s.path, data, 0600, 0)
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// sqliteTimeFormat stores times in UTC with a fixed width, so that they sort
+// and compare correctly as text
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+const sqliteSessionSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	token_hash   TEXT PRIMARY KEY,
+	id           TEXT NOT NULL UNIQUE,
+	user_id      INTEGER NOT NULL,
+	created_at   TEXT NOT NULL,
+	last_seen_at TEXT NOT NULL,
+	expires_at   TEXT NOT NULL,
+	user_agent   TEXT NOT NULL DEFAULT '',
+	ip           TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS sessions_user ON sessions (user_id);
+CREATE INDEX IF NOT EXISTS sessions_expires ON sessions (expires_at);
+`
+
+// SQLiteSessionStore keeps sessions in a table of an SQLite database, so
+// that they survive restarts without rewriting a file on every change
+type SQLiteSessionStore struct {
+	db     *sql.DB
+	config SessionConfig
+}
+
+// NewSQLiteSessionStore stores sessions in db, creating the sessions table
+// if it does not exist yet
+func NewSQLiteSessionStore(db *sql.DB, config SessionConfig) (*SQLiteSessionStore, error) {
+	if _, err := db.Exec(sqliteSessionSchema); err != nil {
+		return nil, fmt.Errorf("failed to create sessions table: %w", err)
+	}
+	return &SQLiteSessionStore{db: db, config: config}, nil
+}
+
+const sessionColumns = "token_hash, id, user_id, created_at, last_seen_at, expires_at, user_agent, ip"
+
+func (s *SQLiteSessionStore) Create(userID int, userAgent, ip string) (models.Session, error) {
+	session, err := s.config.newSession(userID, userAgent, ip)
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	_, err = s.db.Exec("INSERT INTO sessions ("+sessionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		session.TokenHash, session.ID, session.UserID, formatSQLiteTime(session.CreatedAt),
+		formatSQLiteTime(session.LastSeenAt), formatSQLiteTime(session.ExpiresAt), session.UserAgent, session.IP)
+	if err != nil {
+		return models.Session{}, err
+	}
+	return session, nil
+}
+
+func (s *SQLiteSessionStore) Get(token string) (models.Session, bool) {
+	hash := HashToken(token)
+
+	session, err := scanSession(s.db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE token_hash = ?", hash))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			fmt.Printf("Warning: Could not read session: %v\n", err)
+		}
+		return models.Session{}, false
+	}
+
+	now := time.Now()
+	if s.config.expired(session, now) {
+		if _, err := s.db.Exec("DELETE FROM sessions WHERE token_hash = ?", hash); err != nil {
+			fmt.Printf("Warning: Could not delete expired session: %v\n", err)
+		}
+		return models.Session{}, false
+	}
+
+	// Sliding renewal, throttled so the row is not rewritten on every request
+	if now.Sub(session.LastSeenAt) >= s.config.TouchInterval {
+		session.LastSeenAt = now
+		if _, err := s.db.Exec("UPDATE sessions SET last_seen_at = ? WHERE token_hash = ?", formatSQLiteTime(now), hash); err != nil {
+			fmt.Printf("Warning: Could not save sessions: %v\n", err)
+		}
+	}
+
+	return session, true
+}
+
+func (s *SQLiteSessionStore) Delete(token string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE token_hash = ?", HashToken(token))
+	return err
+}
+
+func (s *SQLiteSessionStore) ListByUser(userID int) ([]models.Session, error) {
+	rows, err := s.db.Query("SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? ORDER BY last_seen_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var sessions []models.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !s.config.expired(session, now) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLiteSessionStore) DeleteByID(userID int, id string) (bool, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+func (s *SQLiteSessionStore) DeleteByUser(userID int, exceptID string) (int, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", userID, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+func (s *SQLiteSessionStore) DeleteExpired() (int, error) {
+	now := time.Now()
+	// Matches SessionConfig.expired, a zero idle timeout never expires
+	idleCutoff := ""
+	if s.config.IdleTimeout > 0 {
+		idleCutoff = formatSQLiteTime(now.Add(-s.config.IdleTimeout))
+	}
+
+	result, err := s.db.Exec("DELETE FROM sessions WHERE expires_at <= ? OR last_seen_at <= ?",
+		formatSQLiteTime(now), idleCutoff)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSession(row rowScanner) (models.Session, error) {
+	var session models.Session
+	var createdAt, lastSeenAt, expiresAt string
+	err := row.Scan(&session.TokenHash, &session.ID, &session.UserID, &createdAt, &lastSeenAt,
+		&expiresAt, &session.UserAgent, &session.IP)
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	if session.CreatedAt, err = time.Parse(sqliteTimeFormat, createdAt); err != nil {
+		return models.Session{}, err
+	}
+	if session.LastSeenAt, err = time.Parse(sqliteTimeFormat, lastSeenAt); err != nil {
+		return models.Session{}, err
+	}
+	if session.ExpiresAt, err = time.Parse(sqliteTimeFormat, expiresAt); err != nil {
+		return models.Session{}, err
+	}
+	return session, nil
+}
+
+func formatSQLiteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ThrottleConfig controls when a throttle starts locking out a key and for
+// how long
+type ThrottleConfig struct {
+	// Threshold is the number of attempts allowed before lockouts start
+	Threshold int
+	// BaseLockout is the first lockout, doubled for every further attempt
+	BaseLockout time.Duration
+	// MaxLockout caps the lockout duration
+	MaxLockout time.Duration
+	// Window is how long attempts are remembered after the last one
+	Window time.Duration
+}
+
+// AttemptRecord counts recent attempts for one throttle key
+type AttemptRecord struct {
+	Count       int       `json:"count"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Throttle applies exponential backoff to repeated attempts, such as failed
+// logins, per key. Keys are namespaced by the throttle's name so several
+// throttles can share one store.
+type Throttle struct {
+	name   string
+	config ThrottleConfig
+	store  AttemptStore
+
+	// Serialises read-modify-write of records in the store
+	mu sync.Mutex
+}
+
+// NewThrottle creates a throttle named name that keeps its records in store
+func NewThrottle(name string, config ThrottleConfig, store AttemptStore) *Throttle {
+	return &Throttle{name: name, config: config, store: store}
+}
+
+// Attempt starts an attempt for all of keys. If any of them is locked out it
+// returns how long the caller must wait and counts nothing. Otherwise the
+// attempt is counted against each key straight away, locking a key out once
+// it passes the threshold, and zero is returned. Checking and counting under
+// one lock means concurrent attempts cannot all slip past the threshold
+// before any of them is counted. An attempt that turns out not to count,
+// such as a successful login, is given back with Release or Reset.
+func (t *Throttle) Attempt(keys ...string) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	records := make([]AttemptRecord, len(keys))
+	var wait time.Duration
+	for i, key := range keys {
+		record, exists := t.store.Get(t.key(key))
+		if !exists || now.Sub(record.LastAttempt) > t.config.Window {
+			record = AttemptRecord{}
+		}
+		if remaining := record.LockedUntil.Sub(now); remaining > wait {
+			wait = remaining
+		}
+		records[i] = record
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	for i, key := range keys {
+		record := records[i]
+		record.Count++
+		record.LastAttempt = now
+		if over := record.Count - t.config.Threshold; over > 0 {
+			record.LockedUntil = now.Add(t.lockout(over))
+		}
+
+		if err := t.store.Put(t.key(key), record); err != nil {
+			return 0, fmt.Errorf("failed to record attempt: %w", err)
+		}
+	}
+	return 0, nil
+}
+
+// Release gives back an attempt counted by Attempt against each of keys,
+// lifting a lockout it caused
+func (t *Throttle) Release(keys ...string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		record, exists := t.store.Get(t.key(key))
+		if !exists || record.Count == 0 {
+			continue
+		}
+
+		record.Count--
+		record.LockedUntil = time.Time{}
+		if over := record.Count - t.config.Threshold; over > 0 {
+			record.LockedUntil = record.LastAttempt.Add(t.lockout(over))
+		}
+
+		if err := t.store.Put(t.key(key), record); err != nil {
+			return fmt.Errorf("failed to release attempt: %w", err)
+		}
+	}
+	return nil
+}
+
+// Reset forgets all attempts for each of keys
+func (t *Throttle) Reset(keys ...string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		if err := t.store.Delete(t.key(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockout returns BaseLockout doubled for every attempt over the threshold
+// after the first, capped at MaxLockout
+func (t *Throttle) lockout(over int) time.Duration {
+	lockout := t.config.BaseLockout
+	for i := 1; i < over && lockout < t.config.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > t.config.MaxLockout {
+		lockout = t.config.MaxLockout
+	}
+	return lockout
+}
+
+func (t *Throttle) key(key string) string {
+	return t.name + ":" + key
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"go-server/internal/atomicfile"
+)
+
+// AttemptStore holds throttle records by key
+type AttemptStore interface {
+	Get(key string) (AttemptRecord, bool)
+	Put(key string, record AttemptRecord) error
+	Delete(key string) error
+	// DeleteStale removes records with no attempt or lockout since before
+	// and returns how many were removed
+	DeleteStale(before time.Time) (int, error)
+}
+
+// MemoryAttemptStore keeps throttle records in process memory. Counters are
+// reset when the server restarts.
+type MemoryAttemptStore struct {
+	mu      sync.Mutex
+	records map[string]AttemptRecord
+
+	// save persists the records map after a change, nil for memory only
+	save func() error
+}
+
+// NewMemoryAttemptStore creates an empty in-memory attempt store
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{records: make(map[string]AttemptRecord)}
+}
+
+// FileAttemptStore is a MemoryAttemptStore that writes every change to a
+// JSON file so that lockouts survive restarts
+type FileAttemptStore struct {
+	*MemoryAttemptStore
+	path string
+}
+
+// NewFileAttemptStore loads throttle records from path, if it exists
+func NewFileAttemptStore(path string) (*FileAttemptStore, error) {
+	store := &FileAttemptStore{
+		MemoryAttemptStore: NewMemoryAttemptStore(),
+		path:               path,
+	}
+	store.save = store.saveRecords
+
+	if err := store.loadRecords(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *MemoryAttemptStore) Get(key string) (AttemptRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, exists := s.records[key]
+	return record, exists
+}
+
+func (s *MemoryAttemptStore) Put(key string, record AttemptRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = record
+	return s.persist()
+}
+
+func (s *MemoryAttemptStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.records[key]; !exists {
+		return nil
+	}
+	delete(s.records, key)
+	return s.persist()
+}
+
+func (s *MemoryAttemptStore) DeleteStale(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for key, record := range s.records {
+		if record.LastAttempt.Before(before) && record.LockedUntil.Before(before) {
+			delete(s.records, key)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.persist()
+}
+
+func (s *MemoryAttemptStore) persist() error {
+	if s.save == nil {
+		return nil
+	}
+	return s.save()
+}
+
+func (s *FileAttemptStore) loadRecords() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make(map[string]AttemptRecord)
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	for key, record := range records {
+		s.records[key] = record
+	}
+	return nil
+}
+
+func (s *FileAttemptStore) saveRecords() error {
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path, data, 0600, 0)
+}
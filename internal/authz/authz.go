@@ -0,0 +1,159 @@
+package authz
+
+import "go-server/internal/models"
+
+// Permission names something a user may do beyond acting on their own
+// resources
+type Permission string
+
+const (
+	// EditAnyShader allows editing and deleting shaders owned by others
+	EditAnyShader Permission = "shader.edit.any"
+	// ManageTags allows renaming and deleting tags
+	ManageTags Permission = "tag.manage"
+	// BanUsers allows suspending and reinstating lower ranked users
+	BanUsers Permission = "user.ban"
+	// AssignRoles allows changing other users' roles
+	AssignRoles Permission = "user.role"
+	// ManageInvites allows creating and revoking registration invites
+	ManageInvites Permission = "user.invite"
+	// ViewAuditLog allows reading the audit log
+	ViewAuditLog Permission = "audit.view"
+	// ManageSnapshots allows listing and taking snapshots of the data
+	ManageSnapshots Permission = "data.snapshot"
+)
+
+// roles lists the permissions of each role, in ascending order of rank
+var roles = []struct {
+	name        string
+	permissions []Permission
+}{
+	{models.RoleUser, nil},
+	{models.RoleModerator, []Permission{EditAnyShader, ManageTags, BanUsers}},
+	{models.RoleAdmin, []Permission{EditAnyShader, ManageTags, BanUsers, AssignRoles, ManageInvites, ViewAuditLog, ManageSnapshots}},
+}
+
+// ValidRole reports whether role is a known role name
+func ValidRole(role string) bool {
+	return rank(role) >= 0
+}
+
+// RoleOf returns the user's role, treating users without one as plain users
+func RoleOf(user *models.User) string {
+	if user == nil || user.Role == "" {
+		return models.RoleUser
+	}
+	return user.Role
+}
+
+// Permissions returns everything user may do. Banned users may do nothing.
+func Permissions(user *models.User) []Permission {
+	if user == nil || user.Banned {
+		return nil
+	}
+	if i := rank(RoleOf(user)); i >= 0 {
+		return roles[i].permissions
+	}
+	return nil
+}
+
+// Can reports whether user has permission
+func Can(user *models.User, permission Permission) bool {
+	for _, p := range Permissions(user) {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// ShaderRole returns the user's role on shader: ShaderRoleOwner for the
+// owner, their collaborator role, or "" if they have none. team must be the
+// shader's owning team, or nil if a user owns it. Team owners own the team's
+// shaders and other members may edit them.
+func ShaderRole(user *models.User, shader *models.Shader, team *models.Team) string {
+	if user == nil || shader == nil {
+		return ""
+	}
+	if shader.TeamID != 0 {
+		switch TeamRole(user, team) {
+		case models.TeamRoleOwner:
+			return models.ShaderRoleOwner
+		case models.TeamRoleMember:
+			return models.ShaderRoleEditor
+		}
+	} else if shader.UserID != 0 && shader.UserID == user.ID {
+		return models.ShaderRoleOwner
+	}
+	for _, collaborator := range shader.Collaborators {
+		if collaborator.UserID == user.ID {
+			return collaborator.Role
+		}
+	}
+	return ""
+}
+
+// TeamRole returns the user's role in team, or "" if they are not a member
+func TeamRole(user *models.User, team *models.Team) string {
+	if user == nil || team == nil {
+		return ""
+	}
+	for _, member := range team.Members {
+		if member.UserID == user.ID {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+// ValidTeamRole reports whether role can be given to a team member
+func ValidTeamRole(role string) bool {
+	return role == models.TeamRoleOwner || role == models.TeamRoleMember
+}
+
+// ValidShaderRole reports whether role can be given to a collaborator.
+// Collaborators cannot be made owners.
+func ValidShaderRole(role string) bool {
+	return role == models.ShaderRoleEditor || role == models.ShaderRoleViewer
+}
+
+// CanEditShader reports whether user may save changes to shader, either as
+// an owner or editor or because their role allows editing any shader. team is
+// as for ShaderRole.
+func CanEditShader(user *models.User, shader *models.Shader, team *models.Team) bool {
+	if user == nil || shader == nil || user.Banned {
+		return false
+	}
+	switch ShaderRole(user, shader, team) {
+	case models.ShaderRoleOwner, models.ShaderRoleEditor:
+		return true
+	}
+	return Can(user, EditAnyShader)
+}
+
+// CanManageShader reports whether user may delete shader and change its
+// collaborators, which only owners and moderators may do
+func CanManageShader(user *models.User, shader *models.Shader, team *models.Team) bool {
+	if user == nil || shader == nil || user.Banned {
+		return false
+	}
+	if ShaderRole(user, shader, team) == models.ShaderRoleOwner {
+		return true
+	}
+	return Can(user, EditAnyShader)
+}
+
+// Outranks reports whether actor's role is strictly higher than target's,
+// which is required to ban target or change their role
+func Outranks(actor, target *models.User) bool {
+	return rank(RoleOf(actor)) > rank(RoleOf(target))
+}
+
+func rank(role string) int {
+	for i, r := range roles {
+		if r.name == role {
+			return i
+		}
+	}
+	return -1
+}
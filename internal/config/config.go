@@ -0,0 +1,334 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds server settings read from the environment
+type Config struct {
+	// Storage selects where users, shaders and everything else are kept:
+	// "json" files in DataDir or an "sqlite" database at SQLitePath
+	Storage    string
+	DataDir    string
+	SQLitePath string
+	// JSONBackups is how many previous versions of each JSON data file are
+	// kept to recover from if the file is damaged
+	JSONBackups int
+	// ShaderLogCompactSize is how large the shader change log may grow, in
+	// bytes, before it is compacted into shaders.json
+	ShaderLogCompactSize int
+
+	// SessionStore selects where sessions are kept: "store" alongside the
+	// rest of the data, "memory" or "file"
+	SessionStore           string
+	SessionFile            string
+	SessionAbsoluteTimeout time.Duration
+	SessionIdleTimeout     time.Duration
+	SessionSweepInterval   time.Duration
+
+	// AttemptStore selects where login throttling counters are kept:
+	// "memory" or "file"
+	AttemptStore string
+	AttemptFile  string
+
+	// OpenID Connect single sign-on, disabled when OIDCIssuer is empty
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+
+	// TrustedOrigins may make state-changing requests in addition to the
+	// server's own origin
+	TrustedOrigins []string
+
+	// PublicURL is the externally visible base URL, used for links in emails
+	PublicURL string
+	// Mailer selects how account emails are delivered: "spool", "smtp" or "none"
+	Mailer       string
+	MailFrom     string
+	MailSpoolDir string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	// RequireVerifiedEmail stops users logging in until they verify their email
+	RequireVerifiedEmail bool
+
+	// Registration policy for usernames and passwords
+	UsernameMinLength  int
+	UsernameMaxLength  int
+	ReservedUsernames  []string
+	PasswordMinLength  int
+	PasswordMinClasses int
+	// InviteOnly requires an invite code from an admin to register
+	InviteOnly bool
+	// AdminUsernames are given the admin role at startup if they exist, so
+	// there is always someone who can assign roles. There are none by
+	// default, the seeded accounts have well known passwords.
+	AdminUsernames []string
+
+	// AuditLogFile is where the audit log is appended, rotated once it
+	// reaches AuditLogMaxBytes keeping AuditLogMaxFiles old files. An empty
+	// AuditLogFile keeps the log in memory only.
+	AuditLogFile     string
+	AuditLogMaxBytes int
+	AuditLogMaxFiles int
+
+	// SnapshotDir is where snapshots of users, shaders, tags and teams are kept.
+	// One is taken every SnapshotInterval, unless it is 0, and only the
+	// newest SnapshotKeep are kept, or all of them if it is 0.
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+	SnapshotKeep     int
+
+	// Snapshots and the shader log are copied to an S3-compatible bucket
+	// under ReplicaPrefix, unless ReplicaEndpoint is empty. The newest
+	// ReplicaKeep snapshots are kept there, or all of them if it is 0, and
+	// shader changes are uploaded every ReplicaFlushInterval. At most
+	// ReplicaMaxQueue bytes of changes wait for the bucket, see
+	// replication.Replicator.
+	ReplicaEndpoint      string
+	ReplicaRegion        string
+	ReplicaBucket        string
+	ReplicaPrefix        string
+	ReplicaAccessKey     string
+	ReplicaSecretKey     string
+	ReplicaKeep          int
+	ReplicaFlushInterval time.Duration
+	ReplicaMaxQueue      int
+
+	// Deleted shaders stay in the trash for TrashRetention, and the trash is
+	// checked for older ones every TrashPurgeInterval
+	TrashRetention     time.Duration
+	TrashPurgeInterval time.Duration
+}
+
+// Load reads the configuration from environment variables, falling back to
+// defaults for anything unset
+func Load() (Config, error) {
+	cfg := Config{
+		Storage:    getString("STORAGE", "json"),
+		DataDir:    getString("DATA_DIR", "data"),
+		SQLitePath: getString("SQLITE_PATH", "data/shaderstack.db"),
+
+		SessionStore: getString("SESSION_STORE", "store"),
+		SessionFile:  getString("SESSION_FILE", "data/sessions.json"),
+		AttemptStore: getString("ATTEMPT_STORE", "memory"),
+		AttemptFile:  getString("ATTEMPT_FILE", "data/attempts.json"),
+
+		OIDCIssuer:       getString("OIDC_ISSUER", ""),
+		OIDCClientID:     getString("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret: getString("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:  getString("OIDC_REDIRECT_URL", "http://localhost:8080/api/oidc/callback"),
+		OIDCScopes:       strings.Fields(getString("OIDC_SCOPES", "openid profile email")),
+
+		TrustedOrigins: getList("TRUSTED_ORIGINS", ""),
+
+		PublicURL:    getString("PUBLIC_URL", "http://localhost:8080"),
+		Mailer:       getString("MAILER", "spool"),
+		MailFrom:     getString("MAIL_FROM", "ShaderStack <noreply@localhost>"),
+		MailSpoolDir: getString("MAIL_SPOOL_DIR", "data/mail"),
+		SMTPHost:     getString("SMTP_HOST", "localhost"),
+		SMTPUsername: getString("SMTP_USERNAME", ""),
+		SMTPPassword: getString("SMTP_PASSWORD", ""),
+
+		ReservedUsernames: getList("RESERVED_USERNAMES", "admin,api,static"),
+		AdminUsernames:    getList("ADMIN_USERNAMES", ""),
+
+		AuditLogFile: getString("AUDIT_LOG_FILE", "data/audit.log"),
+
+		SnapshotDir: getString("SNAPSHOT_DIR", "data/snapshots"),
+
+		ReplicaEndpoint:  getString("REPLICA_ENDPOINT", ""),
+		ReplicaRegion:    getString("REPLICA_REGION", "us-east-1"),
+		ReplicaBucket:    getString("REPLICA_BUCKET", ""),
+		ReplicaPrefix:    getString("REPLICA_PREFIX", ""),
+		ReplicaAccessKey: getString("REPLICA_ACCESS_KEY", ""),
+		ReplicaSecretKey: getString("REPLICA_SECRET_KEY", ""),
+	}
+
+	var err error
+	if cfg.JSONBackups, err = getInt("JSON_BACKUPS", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.ShaderLogCompactSize, err = getInt("SHADER_LOG_COMPACT_SIZE", 4<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.SessionAbsoluteTimeout, err = getDuration("SESSION_ABSOLUTE_TIMEOUT", 24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.SessionIdleTimeout, err = getDuration("SESSION_IDLE_TIMEOUT", 4*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.SessionSweepInterval, err = getDuration("SESSION_SWEEP_INTERVAL", 10*time.Minute); err != nil {
+		return cfg, err
+	}
+
+	if cfg.SMTPPort, err = getInt("SMTP_PORT", 587); err != nil {
+		return cfg, err
+	}
+	if cfg.RequireVerifiedEmail, err = getBool("REQUIRE_VERIFIED_EMAIL", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.UsernameMinLength, err = getInt("USERNAME_MIN_LENGTH", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.UsernameMaxLength, err = getInt("USERNAME_MAX_LENGTH", 32); err != nil {
+		return cfg, err
+	}
+	if cfg.PasswordMinLength, err = getInt("PASSWORD_MIN_LENGTH", 8); err != nil {
+		return cfg, err
+	}
+	if cfg.PasswordMinClasses, err = getInt("PASSWORD_MIN_CLASSES", 2); err != nil {
+		return cfg, err
+	}
+	if cfg.InviteOnly, err = getBool("INVITE_ONLY", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.AuditLogMaxBytes, err = getInt("AUDIT_LOG_MAX_BYTES", 10*1024*1024); err != nil {
+		return cfg, err
+	}
+	if cfg.AuditLogMaxFiles, err = getInt("AUDIT_LOG_MAX_FILES", 5); err != nil {
+		return cfg, err
+	}
+
+	if cfg.SnapshotInterval, err = getDuration("SNAPSHOT_INTERVAL", 24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.SnapshotKeep, err = getInt("SNAPSHOT_KEEP", 7); err != nil {
+		return cfg, err
+	}
+	if cfg.ReplicaKeep, err = getInt("REPLICA_KEEP", 30); err != nil {
+		return cfg, err
+	}
+	if cfg.ReplicaFlushInterval, err = getDuration("REPLICA_FLUSH_INTERVAL", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.ReplicaMaxQueue, err = getInt("REPLICA_MAX_QUEUE", 64<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.TrashRetention, err = getDuration("TRASH_RETENTION", 30*24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.TrashPurgeInterval, err = getDuration("TRASH_PURGE_INTERVAL", time.Hour); err != nil {
+		return cfg, err
+	}
+
+	if cfg.UsernameMinLength < 1 || cfg.UsernameMaxLength < cfg.UsernameMinLength {
+		return cfg, fmt.Errorf("USERNAME_MIN_LENGTH must be at least 1 and no more than USERNAME_MAX_LENGTH")
+	}
+	if cfg.PasswordMinClasses < 0 || cfg.PasswordMinClasses > 4 {
+		return cfg, fmt.Errorf("PASSWORD_MIN_CLASSES must be between 0 and 4")
+	}
+
+	switch cfg.Mailer {
+	case "spool", "smtp", "none":
+	default:
+		return cfg, fmt.Errorf("unknown MAILER %q", cfg.Mailer)
+	}
+
+	switch cfg.Storage {
+	case "json", "sqlite":
+	default:
+		return cfg, fmt.Errorf("unknown STORAGE %q", cfg.Storage)
+	}
+
+	if cfg.JSONBackups < 0 {
+		return cfg, fmt.Errorf("JSON_BACKUPS must not be negative")
+	}
+	if cfg.ShaderLogCompactSize <= 0 {
+		return cfg, fmt.Errorf("SHADER_LOG_COMPACT_SIZE must be positive")
+	}
+	if cfg.SnapshotInterval < 0 || cfg.SnapshotKeep < 0 {
+		return cfg, fmt.Errorf("SNAPSHOT_INTERVAL and SNAPSHOT_KEEP must not be negative")
+	}
+	if cfg.ReplicaEndpoint != "" {
+		if cfg.ReplicaBucket == "" || cfg.ReplicaAccessKey == "" || cfg.ReplicaSecretKey == "" {
+			return cfg, fmt.Errorf("REPLICA_BUCKET, REPLICA_ACCESS_KEY and REPLICA_SECRET_KEY are required when REPLICA_ENDPOINT is set")
+		}
+		if cfg.ReplicaKeep < 0 || cfg.ReplicaFlushInterval <= 0 || cfg.ReplicaMaxQueue <= 0 {
+			return cfg, fmt.Errorf("REPLICA_KEEP must not be negative, REPLICA_FLUSH_INTERVAL and REPLICA_MAX_QUEUE must be positive")
+		}
+	}
+
+	if cfg.TrashRetention <= 0 || cfg.TrashPurgeInterval <= 0 {
+		return cfg, fmt.Errorf("TRASH_RETENTION and TRASH_PURGE_INTERVAL must be positive")
+	}
+
+	switch cfg.SessionStore {
+	case "store", "memory", "file":
+	default:
+		return cfg, fmt.Errorf("unknown SESSION_STORE %q", cfg.SessionStore)
+	}
+
+	switch cfg.AttemptStore {
+	case "memory", "file":
+	default:
+		return cfg, fmt.Errorf("unknown ATTEMPT_STORE %q", cfg.AttemptStore)
+	}
+
+	if cfg.AuditLogMaxBytes < 1 || cfg.AuditLogMaxFiles < 0 {
+		return cfg, fmt.Errorf("AUDIT_LOG_MAX_BYTES must be positive and AUDIT_LOG_MAX_FILES not negative")
+	}
+
+	if cfg.OIDCIssuer != "" && cfg.OIDCClientID == "" {
+		return cfg, fmt.Errorf("OIDC_CLIENT_ID is required when OIDC_ISSUER is set")
+	}
+
+	return cfg, nil
+}
+
+func getString(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getList splits a comma or space separated value
+func getList(key, fallback string) []string {
+	return strings.Fields(strings.ReplaceAll(getString(key, fallback), ",", " "))
+}
+
+func getInt(key string, fallback int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func getBool(key string, fallback bool) (bool, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+func getDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
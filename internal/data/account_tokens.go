@@ -0,0 +1,88 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// Account token operations
+func (r *Repository) loadAccountTokens() error {
+	var tokens []models.AccountToken
+	if err := r.readJSON(accountTokensFile, &tokens); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		r.accountTokens[token.TokenHash] = token
+	}
+
+	return nil
+}
+
+func (r *Repository) saveAccountTokens() error {
+	tokens := make([]models.AccountToken, 0, len(r.accountTokens))
+	for _, token := range r.accountTokens {
+		tokens = append(tokens, token)
+	}
+
+	return r.writeJSON(accountTokensFile, tokens, 0600)
+}
+
+// CreateAccountToken stores a single-use token. Any earlier token the user
+// has for the same purpose is invalidated, and expired tokens are purged.
+func (r *Repository) CreateAccountToken(token models.AccountToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for hash, existing := range r.accountTokens {
+		if now.After(existing.ExpiresAt) || (existing.UserID == token.UserID && existing.Purpose == token.Purpose) {
+			delete(r.accountTokens, hash)
+		}
+	}
+	r.accountTokens[token.TokenHash] = token
+
+	if err := r.saveAccountTokens(); err != nil {
+		delete(r.accountTokens, token.TokenHash)
+		return fmt.Errorf("failed to save account tokens: %w", err)
+	}
+
+	return nil
+}
+
+// GetAccountToken looks up an unexpired token for purpose without using it up
+func (r *Repository) GetAccountToken(hash, purpose string) *models.AccountToken {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	token, exists := r.accountTokens[hash]
+	if !exists || token.Purpose != purpose || time.Now().After(token.ExpiresAt) {
+		return nil
+	}
+	return &token
+}
+
+// ConsumeAccountToken looks up a token for purpose and removes it, so that it
+// can only be used once
+func (r *Repository) ConsumeAccountToken(hash, purpose string) (*models.AccountToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token, exists := r.accountTokens[hash]
+	if !exists || token.Purpose != purpose {
+		return nil, fmt.Errorf("invalid or expired token")
+	}
+
+	delete(r.accountTokens, hash)
+	if err := r.saveAccountTokens(); err != nil {
+		r.accountTokens[hash] = token
+		return nil, fmt.Errorf("failed to save account tokens: %w", err)
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return nil, fmt.Errorf("invalid or expired token")
+	}
+	return &token, nil
+}
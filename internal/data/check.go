@@ -0,0 +1,218 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go-server/internal/models"
+)
+
+// Kinds of inconsistency found by Check
+const (
+	IssueTagMismatch         = "tag_mismatch"
+	IssueStaleAuthor         = "stale_author"
+	IssueDuplicateScriptID   = "duplicate_script_id"
+	IssueMissingOwner        = "missing_owner"
+	IssueMissingTeam         = "missing_team"
+	IssueMissingCollaborator = "missing_collaborator"
+)
+
+// CheckIssue is one inconsistency in a shader
+type CheckIssue struct {
+	Kind     string `json:"kind"`
+	ShaderID int    `json:"shader_id"`
+	Detail   string `json:"detail"`
+	Fixed    bool   `json:"fixed"`
+}
+
+// CheckReport lists every issue Check found, with how many there were of
+// each kind
+type CheckReport struct {
+	Shaders int            `json:"shaders"`
+	Issues  []CheckIssue   `json:"issues"`
+	Counts  map[string]int `json:"counts"`
+	Fixed   int            `json:"fixed"`
+}
+
+// CheckOptions say whether and how Check repairs what it finds
+type CheckOptions struct {
+	Fix bool
+	// OrphansTo receives shaders whose owner no longer exists. If it is 0
+	// they are kept without an owner, as when an account is deleted.
+	OrphansTo int
+}
+
+// Check looks for shaders that disagree with the rest of the data: tags that
+// do not match tags.json, a stale denormalized author, script IDs used twice
+// in one shader, and owners, teams or collaborators that no longer exist.
+// With options.Fix each shader is repaired and saved.
+func (r *Repository) Check(options CheckOptions) (*CheckReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if options.OrphansTo != 0 {
+		if _, exists := r.users[options.OrphansTo]; !exists {
+			return nil, fmt.Errorf("user not found")
+		}
+	}
+
+	report := &CheckReport{
+		Shaders: len(r.shaders),
+		Issues:  []CheckIssue{},
+		Counts:  make(map[string]int),
+	}
+
+	ids := make([]int, 0, len(r.shaders))
+	for id := range r.shaders {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var changed []int
+	tagsChanged := false
+	for _, id := range ids {
+		shader := r.shaders[id]
+		issues, createdTags, err := r.checkShaderLockFree(&shader, options)
+		if err != nil {
+			return nil, err
+		}
+		if len(issues) == 0 {
+			continue
+		}
+
+		for _, issue := range issues {
+			issue.ShaderID = id
+			issue.Fixed = options.Fix
+			report.Issues = append(report.Issues, issue)
+			report.Counts[issue.Kind]++
+		}
+		if options.Fix {
+			r.shaders[id] = shader
+			changed = append(changed, id)
+			tagsChanged = tagsChanged || createdTags
+			report.Fixed += len(issues)
+		}
+	}
+
+	if len(changed) == 0 {
+		return report, nil
+	}
+	r.buildIndexes()
+	if tagsChanged {
+		if err := r.saveTags(); err != nil {
+			return nil, fmt.Errorf("failed to save tags: %w", err)
+		}
+	}
+	if err := r.saveShaderChanges(changed...); err != nil {
+		return nil, fmt.Errorf("failed to save shaders: %w", err)
+	}
+	return report, nil
+}
+
+// Lock-free version for internal use when mutex is already held. Returns the
+// issues with shader, which is repaired in place if options.Fix is set, and
+// whether any tags had to be created to repair it.
+func (r *Repository) checkShaderLockFree(shader *models.Shader, options CheckOptions) ([]CheckIssue, bool, error) {
+	var issues []CheckIssue
+	report := func(kind, format string, args ...interface{}) {
+		issues = append(issues, CheckIssue{Kind: kind, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	// Owner, before the author is compared against them
+	if shader.UserID != 0 {
+		if _, exists := r.users[shader.UserID]; !exists {
+			report(IssueMissingOwner, "owner %d does not exist", shader.UserID)
+			// Team shaders stay with the team, as when an account is deleted
+			if shader.TeamID != 0 {
+				shader.UserID = 0
+			} else {
+				shader.UserID = options.OrphansTo
+			}
+		}
+	}
+
+	if shader.TeamID != 0 {
+		if _, exists := r.teams[shader.TeamID]; !exists {
+			report(IssueMissingTeam, "team %d does not exist", shader.TeamID)
+			shader.TeamID = 0
+		}
+	}
+
+	for _, collaborator := range shader.Collaborators {
+		if _, exists := r.users[collaborator.UserID]; !exists {
+			report(IssueMissingCollaborator, "collaborator %d does not exist", collaborator.UserID)
+			removeCollaborator(shader, collaborator.UserID)
+		}
+	}
+
+	// Authors are looked up from the owner, never stored
+	if shader.Author != "" {
+		report(IssueStaleAuthor, "stored author %q", shader.Author)
+		shader.Author = ""
+	}
+
+	// Tags are re-linked by name, which is what users see
+	createdTags := false
+	tags := make([]models.Tag, 0, len(shader.Tags))
+	seenTags := make(map[int]bool)
+	for _, tag := range shader.Tags {
+		current, exists := r.tags[tag.ID]
+		if exists && current.Name == tag.Name {
+			if !seenTags[tag.ID] {
+				seenTags[tag.ID] = true
+				tags = append(tags, tag)
+			}
+			continue
+		}
+
+		if exists {
+			report(IssueTagMismatch, "tag %d is named %q, not %q", tag.ID, current.Name, tag.Name)
+		} else {
+			report(IssueTagMismatch, "tag %d (%q) does not exist", tag.ID, tag.Name)
+		}
+		name := strings.TrimSpace(tag.Name)
+		if name == "" || !options.Fix {
+			continue
+		}
+		linked := r.getTagByNameLockFree(name)
+		if linked == nil {
+			var err error
+			if linked, err = r.createTagLockFree(name); err != nil {
+				return nil, false, fmt.Errorf("failed to create tag '%s': %v", name, err)
+			}
+			createdTags = true
+		}
+		if !seenTags[linked.ID] {
+			seenTags[linked.ID] = true
+			tags = append(tags, *linked)
+		}
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+	shader.Tags = tags
+
+	// The first script keeps a duplicated ID, the others are given new ones
+	nextScriptID := 1
+	for _, script := range shader.ShaderScripts {
+		if script.ID >= nextScriptID {
+			nextScriptID = script.ID + 1
+		}
+	}
+	scripts := make([]models.ShaderScript, len(shader.ShaderScripts))
+	copy(scripts, shader.ShaderScripts)
+	seenScripts := make(map[int]bool)
+	for i, script := range scripts {
+		if !seenScripts[script.ID] {
+			seenScripts[script.ID] = true
+			continue
+		}
+		report(IssueDuplicateScriptID, "script ID %d is used more than once", script.ID)
+		scripts[i].ID = nextScriptID
+		nextScriptID++
+	}
+	shader.ShaderScripts = scripts
+
+	return issues, createdTags, nil
+}
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"fmt"
+
+	"go-server/internal/models"
+)
+
+// SetCollaborator gives a user a role on a shader, or changes their existing
+// role. The owner cannot also be a collaborator.
+func (r *Repository) SetCollaborator(shaderID, userID int, role string) (*models.Shader, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	shader, exists := r.liveShaderLockFree(shaderID)
+	if !exists {
+		return nil, fmt.Errorf("shader not found")
+	}
+	if _, exists := r.users[userID]; !exists {
+		return nil, fmt.Errorf("user not found")
+	}
+	if shader.UserID == userID {
+		return nil, fmt.Errorf("the owner cannot be a collaborator")
+	}
+
+	previous := shader
+	collaborators := make([]models.Collaborator, 0, len(shader.Collaborators)+1)
+	found := false
+	for _, collaborator := range shader.Collaborators {
+		if collaborator.UserID == userID {
+			collaborator.Role = role
+			found = true
+		}
+		collaborators = append(collaborators, collaborator)
+	}
+	if !found {
+		collaborators = append(collaborators, models.Collaborator{UserID: userID, Role: role})
+	}
+	shader.Collaborators = collaborators
+
+	if err := r.saveShaderChangeLockFree(previous, shader); err != nil {
+		return nil, err
+	}
+	return &shader, nil
+}
+
+// RemoveCollaborator takes a user's role on a shader away
+func (r *Repository) RemoveCollaborator(shaderID, userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	shader, exists := r.liveShaderLockFree(shaderID)
+	if !exists {
+		return fmt.Errorf("shader not found")
+	}
+
+	previous := shader
+	if !removeCollaborator(&shader, userID) {
+		return fmt.Errorf("collaborator not found")
+	}
+
+	return r.saveShaderChangeLockFree(previous, shader)
+}
+
+// Lock-free version for internal use when mutex is already held. Stores
+// shader, restoring previous if it cannot be saved.
+func (r *Repository) saveShaderChangeLockFree(previous, shader models.Shader) error {
+	r.shaders[shader.ID] = shader
+	r.buildIndexes()
+
+	if err := r.saveShaderChanges(shader.ID); err != nil {
+		// Attempt to roll back
+		r.shaders[previous.ID] = previous
+		r.buildIndexes()
+		return fmt.Errorf("failed to save shaders: %w", err)
+	}
+	return nil
+}
+
+// removeCollaborator drops userID from the shader's collaborators and
+// reports whether they were one
+func removeCollaborator(shader *models.Shader, userID int) bool {
+	collaborators := make([]models.Collaborator, 0, len(shader.Collaborators))
+	for _, collaborator := range shader.Collaborators {
+		if collaborator.UserID != userID {
+			collaborators = append(collaborators, collaborator)
+		}
+	}
+	if len(collaborators) == len(shader.Collaborators) {
+		return false
+	}
+	if len(collaborators) == 0 {
+		collaborators = nil
+	}
+	shader.Collaborators = collaborators
+	return true
+}
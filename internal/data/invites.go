@@ -0,0 +1,151 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// ErrInvalidInvite is returned when an invite code is unknown, used or expired
+var ErrInvalidInvite = errors.New("invalid or expired invite code")
+
+// Invite operations
+func (r *Repository) loadInvites() error {
+	var invites []models.Invite
+	if err := r.readJSON(invitesFile, &invites); err != nil {
+		return err
+	}
+
+	for _, invite := range invites {
+		r.invites[invite.ID] = invite
+		if invite.ID >= r.nextInviteID {
+			r.nextInviteID = invite.ID + 1
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository) saveInvites() error {
+	invites := make([]models.Invite, 0, len(r.invites))
+	for _, invite := range r.invites {
+		invites = append(invites, invite)
+	}
+
+	return r.writeJSON(invitesFile, invites, 0600)
+}
+
+// CreateInvite stores a new invite. The caller is responsible for hashing
+// the code.
+func (r *Repository) CreateInvite(invite models.Invite) (*models.Invite, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.invitesByHash[invite.CodeHash]; exists {
+		return nil, fmt.Errorf("invite already exists")
+	}
+
+	invite.ID = r.nextInviteID
+	r.nextInviteID++
+
+	r.invites[invite.ID] = invite
+	r.invitesByHash[invite.CodeHash] = invite.ID
+
+	if err := r.saveInvites(); err != nil {
+		// Attempt to roll back
+		delete(r.invites, invite.ID)
+		delete(r.invitesByHash, invite.CodeHash)
+		r.nextInviteID--
+		return nil, fmt.Errorf("failed to save invites: %w", err)
+	}
+
+	return &invite, nil
+}
+
+// GetInvites returns all invites, newest first
+func (r *Repository) GetInvites() []models.Invite {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	invites := make([]models.Invite, 0, len(r.invites))
+	for _, invite := range r.invites {
+		invites = append(invites, invite)
+	}
+
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].CreatedAt.After(invites[j].CreatedAt)
+	})
+
+	return invites
+}
+
+// DeleteInvite revokes an invite. Used invites are kept as a record of who
+// invited whom.
+func (r *Repository) DeleteInvite(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invite, exists := r.invites[id]
+	if !exists {
+		return fmt.Errorf("invite not found")
+	}
+	if invite.UsedAt != nil {
+		return fmt.Errorf("invite has already been used")
+	}
+
+	delete(r.invites, id)
+	delete(r.invitesByHash, invite.CodeHash)
+
+	if err := r.saveInvites(); err != nil {
+		r.invites[id] = invite
+		r.invitesByHash[invite.CodeHash] = id
+		return fmt.Errorf("failed to save invites: %w", err)
+	}
+
+	return nil
+}
+
+// CreateUserWithInvite creates a user and redeems the invite with codeHash in
+// one step, so that an invite cannot be used twice by concurrent registrations
+func (r *Repository) CreateUserWithInvite(user models.User, codeHash string) (*models.User, error) {
+	// Hash outside the lock, argon2 is deliberately slow
+	if err := hashUserPassword(&user); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, exists := r.invitesByHash[codeHash]
+	invite := r.invites[id]
+	now := time.Now()
+	if !exists || invite.UsedAt != nil || (invite.ExpiresAt != nil && now.After(*invite.ExpiresAt)) {
+		return nil, ErrInvalidInvite
+	}
+
+	created, err := r.createUserLockFree(user)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := invite
+	invite.UsedBy = created.ID
+	invite.UsedAt = &now
+	r.invites[id] = invite
+
+	if err := r.saveInvites(); err != nil {
+		// The user is already saved, remove it again so the invite can be retried
+		r.invites[id] = previous
+		r.deleteUserIndexesLockFree(*created)
+		delete(r.users, created.ID)
+		if saveErr := r.saveUsers(); saveErr != nil {
+			fmt.Printf("Warning: Could not roll back user %d: %v\n", created.ID, saveErr)
+		}
+		return nil, fmt.Errorf("failed to save invites: %w", err)
+	}
+
+	return created, nil
+}
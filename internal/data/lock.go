@@ -0,0 +1,40 @@
+package data
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// lockFile is created in the data directory to hold its lock
+const lockFile = ".lock"
+
+// ErrDataDirLocked is returned by LockDataDir when another process holds the
+// lock
+var ErrDataDirLocked = errors.New("data directory is in use by another process")
+
+// DirLock is an exclusive lock on a data directory. The server holds one for
+// as long as it runs, and the shaderstack commands that change files take it
+// before they start, so the two never work on the same files at once. The
+// operating system releases it if the process dies.
+type DirLock struct {
+	file *os.File
+}
+
+// LockDataDir takes the lock on dir, creating the directory if needed. It
+// does not wait, ErrDataDirLocked is returned if the lock is held.
+func LockDataDir(dir string) (*DirLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := lockPath(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	return &DirLock{file: file}, nil
+}
+
+// Unlock releases the lock
+func (l *DirLock) Unlock() error {
+	return l.file.Close()
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockPath opens path and takes an exclusive flock on it, which is released
+// when the file is closed
+func lockPath(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrDataDirLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
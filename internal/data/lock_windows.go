@@ -0,0 +1,27 @@
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is returned when another handle has the file open
+const errorSharingViolation syscall.Errno = 32
+
+// lockPath opens path without sharing it, so that no other process can open
+// it until the handle is closed
+func lockPath(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if err == errorSharingViolation {
+			return nil, ErrDataDirLocked
+		}
+		return nil, err
+	}
+	return os.NewFile(uintptr(handle), path), nil
+}
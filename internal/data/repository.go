@@ -1,110 +1,268 @@
 package data
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"go-server/internal/atomicfile"
+	"go-server/internal/auth"
 	"go-server/internal/models"
+	"go-server/internal/policy"
 )
 
 const (
-	dataDir     = "data"
 	usersFile   = "users.json"
 	shadersFile = "shaders.json"
 	tagsFile    = "tags.json"
+	tokensFile  = "tokens.json"
+	invitesFile = "invites.json"
+	teamsFile   = "teams.json"
+
+	accountTokensFile = "account_tokens.json"
+	sessionsFile      = "sessions.json"
 )
 
+// usersPerm keeps users.json, which holds password hashes and second factor
+// secrets, and its backups readable by the server's user only
+const usersPerm os.FileMode = 0600
+
+// Repository is the Store that keeps everything in memory and writes each
+// collection to its own JSON file in a data directory
 type Repository struct {
 	mu      sync.RWMutex
+	dir     string
+	backups int // Backup generations kept of each file
 	users   map[int]models.User
 	shaders map[int]models.Shader
 	tags    map[int]models.Tag
+	tokens  map[int]models.APIToken
+	invites map[int]models.Invite
+	teams   map[int]models.Team
+
+	accountTokens map[string]models.AccountToken // tokenHash -> token
 
 	// Indexes for efficient querying
-	usersByUsername map[string]*models.User
-	shadersByUser   map[int][]int    // userID -> []shaderID
-	shadersByTag    map[string][]int // tagName -> []shaderID
+	usersByUsername map[string]*models.User // canonical username -> user
+	usersByIdentity map[string]int          // issuer|subject -> userID
+	shadersByUser   map[int][]int           // userID -> []shaderID
+	shadersByTag    map[string][]int        // tagName -> []shaderID
+	shadersShared   map[int][]int           // collaborator userID -> []shaderID
+	shadersByTeam   map[int][]int           // teamID -> []shaderID
+	tokensByHash    map[string]int          // tokenHash -> tokenID
+	invitesByHash   map[string]int          // codeHash -> inviteID
 
 	// Auto-increment counters
 	nextUserID   int
 	nextShaderID int
 	nextTagID    int
+	nextTokenID  int
+	nextInviteID int
+	nextTeamID   int
+
+	// Shader changes are appended to a log that is compacted into
+	// shaders.json once it reaches compactAt bytes
+	shaderLog     *os.File
+	shaderLogSize int64
+	compactAt     int
+	compacting    bool
+	compactions   sync.WaitGroup
+	onShaderLog   func(line []byte) // Set via SetShaderLogListener
+
+	// Revisions of each shader in order, with their code in blobs. blobRefs
+	// counts the uses of each blob, so that it is removed with the last.
+	revisions map[int][]storedRevision
+	blobRefs  map[string]int
 }
 
-var repo *Repository
-var once sync.Once
-
-// GetRepository returns the singleton repository instance
-func GetRepository() *Repository {
-	once.Do(func() {
-		repo = &Repository{
-			users:           make(map[int]models.User),
-			shaders:         make(map[int]models.Shader),
-			tags:            make(map[int]models.Tag),
-			usersByUsername: make(map[string]*models.User),
-			shadersByUser:   make(map[int][]int),
-			shadersByTag:    make(map[string][]int),
-			nextUserID:      1,
-			nextShaderID:    1,
-			nextTagID:       1,
-		}
-		repo.loadData()
-	})
-	return repo
+// NewRepository loads the repository from the JSON files in dir, creating
+// it with default data if it is empty. Each file keeps the given number of
+// backup generations, which are restored from if the file is damaged. It
+// fails rather than start with missing data if a file and all of its
+// backups are unreadable. Shader changes are logged and compacted into
+// shaders.json once the log reaches compactAt bytes.
+func NewRepository(dir string, backups, compactAt int) (*Repository, error) {
+	r := &Repository{
+		dir:             dir,
+		backups:         backups,
+		compactAt:       compactAt,
+		users:           make(map[int]models.User),
+		shaders:         make(map[int]models.Shader),
+		tags:            make(map[int]models.Tag),
+		tokens:          make(map[int]models.APIToken),
+		invites:         make(map[int]models.Invite),
+		teams:           make(map[int]models.Team),
+		accountTokens:   make(map[string]models.AccountToken),
+		usersByUsername: make(map[string]*models.User),
+		usersByIdentity: make(map[string]int),
+		shadersByUser:   make(map[int][]int),
+		shadersByTag:    make(map[string][]int),
+		shadersShared:   make(map[int][]int),
+		shadersByTeam:   make(map[int][]int),
+		tokensByHash:    make(map[string]int),
+		invitesByHash:   make(map[string]int),
+		revisions:       make(map[int][]storedRevision),
+		blobRefs:        make(map[string]int),
+		nextUserID:      1,
+		nextShaderID:    1,
+		nextTagID:       1,
+		nextTokenID:     1,
+		nextInviteID:    1,
+		nextTeamID:      1,
+	}
+	if err := r.loadData(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Sessions keeps sessions in a JSON file alongside the other data
+func (r *Repository) Sessions(config auth.SessionConfig) (auth.SessionStore, error) {
+	return auth.NewFileSessionStore(filepath.Join(r.dir, sessionsFile), config)
 }
 
-// loadData loads all data from JSON files and builds indexes
-func (r *Repository) loadData() {
+// Close waits for a running compaction and closes the shader log. Every
+// change has already been written when it was made.
+func (r *Repository) Close() error {
+	r.compactions.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.shaderLog == nil {
+		return nil
+	}
+	err := r.shaderLog.Close()
+	r.shaderLog = nil
+	return err
+}
+
+// loadData loads all data from JSON files and builds indexes. Only files
+// that have never been written are created with default data, any other
+// failure to load is returned.
+func (r *Repository) loadData() error {
 	r.ensureDataDir()
 
 	// Load users
-	if err := r.loadUsers(); err != nil {
-		fmt.Printf("Warning: Could not load users: %v\n", err)
+	if err := r.loadUsers(); errors.Is(err, os.ErrNotExist) {
+		fmt.Println("No users yet, creating default users")
 		r.createDefaultUsers()
+	} else if err != nil {
+		return fmt.Errorf("could not load users: %w", err)
 	}
 
 	// Load tags
-	if err := r.loadTags(); err != nil {
-		fmt.Printf("Warning: Could not load tags: %v\n", err)
+	if err := r.loadTags(); errors.Is(err, os.ErrNotExist) {
+		fmt.Println("No tags yet, creating default tags")
 		r.createDefaultTags()
+	} else if err != nil {
+		return fmt.Errorf("could not load tags: %w", err)
 	}
 
 	// Load shaders
-	if err := r.loadShaders(); err != nil {
-		fmt.Printf("Warning: Could not load shaders: %v\n", err)
+	if err := r.loadShaders(); errors.Is(err, os.ErrNotExist) {
+		fmt.Println("No shaders yet, creating default shaders")
 		r.createDefaultShaders()
+	} else if err != nil {
+		return fmt.Errorf("could not load shaders: %w", err)
+	}
+	if err := r.replayShaderLog(); err != nil {
+		return fmt.Errorf("could not load shaders: %w", err)
+	}
+
+	// Load API tokens and the rest, there are none by default
+	if err := r.loadTokens(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not load API tokens: %w", err)
+	}
+	if err := r.loadAccountTokens(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not load account tokens: %w", err)
+	}
+	if err := r.loadInvites(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not load invites: %w", err)
+	}
+	if err := r.loadTeams(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not load teams: %w", err)
+	}
+	if err := r.loadRevisions(); err != nil {
+		return fmt.Errorf("could not load revisions: %w", err)
 	}
 
 	r.buildIndexes()
+	return nil
 }
 
-// ensureDataDir creates the data directory if it doesn't exist
-func (r *Repository) ensureDataDir() {
-	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
-		os.MkdirAll(dataDir, 0755)
+// readJSON decodes a data file into v, restoring the newest readable backup
+// if the file is damaged. A file from an older schema version is migrated
+// and written back, keeping the original as a backup.
+func (r *Repository) readJSON(name string, v interface{}) error {
+	path := filepath.Join(r.dir, name)
+	version := SchemaVersion
+	restored, err := atomicfile.Load(path, r.backups, func(data []byte) error {
+		var err error
+		version, err = decodeDataFile(name, data, v)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if restored != "" {
+		fmt.Printf("Warning: %s was damaged and has been restored from %s\n", name, restored)
+	}
+
+	if version < SchemaVersion {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := r.writeJSON(name, v, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to save migrated %s: %w", name, err)
+		}
+		fmt.Printf("Migrated %s from schema version %d to %d\n", name, version, SchemaVersion)
 	}
+	return nil
 }
 
-// User operations
-func (r *Repository) loadUsers() error {
-	path := filepath.Join(dataDir, usersFile)
-	data, err := ioutil.ReadFile(path)
+// writeJSON atomically replaces a data file with v, keeping the previous
+// contents as a backup
+func (r *Repository) writeJSON(name string, v interface{}, perm os.FileMode) error {
+	data, err := encodeDataFile(v)
 	if err != nil {
 		return err
 	}
+	return atomicfile.WriteFile(filepath.Join(r.dir, name), data, perm, r.backups)
+}
 
+// ensureDataDir creates the data directory if it doesn't exist
+func (r *Repository) ensureDataDir() {
+	if _, err := os.Stat(r.dir); os.IsNotExist(err) {
+		os.MkdirAll(r.dir, 0755)
+	}
+}
+
+// User operations
+func (r *Repository) loadUsers() error {
 	var users []models.User
-	if err := json.Unmarshal(data, &users); err != nil {
+	if err := r.readJSON(usersFile, &users); err != nil {
 		return err
 	}
+	// Older versions left the file and its backups readable by everyone
+	if err := atomicfile.Chmod(filepath.Join(r.dir, usersFile), r.backups, usersPerm); err != nil {
+		fmt.Printf("Warning: Could not restrict access to %s: %v\n", usersFile, err)
+	}
 
+	// Usernames from before they were normalised may differ only in case
+	seen := make(map[string]string)
 	for _, user := range users {
+		key := policy.CanonicalUsername(user.Username)
+		if existing, exists := seen[key]; exists {
+			fmt.Printf("Warning: usernames %q and %q collide, only one can log in\n", existing, user.Username)
+		}
+		seen[key] = user.Username
+
 		r.users[user.ID] = user
 		if user.ID >= r.nextUserID {
 			r.nextUserID = user.ID + 1
@@ -120,23 +278,26 @@ func (r *Repository) saveUsers() error {
 		users = append(users, user)
 	}
 
-	data, err := json.MarshalIndent(users, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	path := filepath.Join(dataDir, usersFile)
-	return ioutil.WriteFile(path, data, 0644)
+	return r.writeJSON(usersFile, users, usersPerm)
 }
 
-func (r *Repository) createDefaultUsers() {
-	defaultUsers := []models.User{
+// defaultUsers are created when there is no user data yet. Their plaintext
+// passwords are hashed before they are stored. Their passwords are public,
+// so none of them is given a role; admins come from ADMIN_USERNAMES.
+func defaultUsers() []models.User {
+	return []models.User{
 		{ID: 1, Username: "admin", Password: "password123"},
 		{ID: 2, Username: "user", Password: "userpass"},
 		{ID: 3, Username: "demo", Password: "demo123"},
 	}
+}
 
-	for _, user := range defaultUsers {
+func (r *Repository) createDefaultUsers() {
+	for _, user := range defaultUsers() {
+		if err := hashUserPassword(&user); err != nil {
+			fmt.Printf("Warning: Could not hash password for %s: %v\n", user.Username, err)
+			continue
+		}
 		r.users[user.ID] = user
 	}
 	r.nextUserID = 4
@@ -145,14 +306,8 @@ func (r *Repository) createDefaultUsers() {
 
 // Tag operations
 func (r *Repository) loadTags() error {
-	path := filepath.Join(dataDir, tagsFile)
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return err
-	}
-
 	var tags []models.Tag
-	if err := json.Unmarshal(data, &tags); err != nil {
+	if err := r.readJSON(tagsFile, &tags); err != nil {
 		return err
 	}
 
@@ -172,17 +327,12 @@ func (r *Repository) saveTags() error {
 		tags = append(tags, tag)
 	}
 
-	data, err := json.MarshalIndent(tags, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	path := filepath.Join(dataDir, tagsFile)
-	return ioutil.WriteFile(path, data, 0644)
+	return r.writeJSON(tagsFile, tags, 0644)
 }
 
-func (r *Repository) createDefaultTags() {
-	defaultTags := []models.Tag{
+// defaultTags are created when there is no tag data yet
+func defaultTags() []models.Tag {
+	return []models.Tag{
 		{ID: 1, Name: "fragment"},
 		{ID: 2, Name: "vertex"},
 		{ID: 3, Name: "compute"},
@@ -192,8 +342,10 @@ func (r *Repository) createDefaultTags() {
 		{ID: 7, Name: "lighting"},
 		{ID: 8, Name: "post-processing"},
 	}
+}
 
-	for _, tag := range defaultTags {
+func (r *Repository) createDefaultTags() {
+	for _, tag := range defaultTags() {
 		r.tags[tag.ID] = tag
 	}
 	r.nextTagID = 9
@@ -202,14 +354,8 @@ func (r *Repository) createDefaultTags() {
 
 // Shader operations
 func (r *Repository) loadShaders() error {
-	path := filepath.Join(dataDir, shadersFile)
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return err
-	}
-
 	var shaders []models.Shader
-	if err := json.Unmarshal(data, &shaders); err != nil {
+	if err := r.readJSON(shadersFile, &shaders); err != nil {
 		return err
 	}
 
@@ -223,29 +369,30 @@ func (r *Repository) loadShaders() error {
 	return nil
 }
 
+// saveShaders writes every shader to shaders.json. Later changes are saved
+// with saveShaderChanges.
 func (r *Repository) saveShaders() error {
+	return r.writeJSON(shadersFile, r.shaderListLockFree(), 0644)
+}
+
+// Lock-free version for internal use when mutex is already held
+func (r *Repository) shaderListLockFree() []models.Shader {
 	shaders := make([]models.Shader, 0, len(r.shaders))
 	for _, shader := range r.shaders {
 		shaders = append(shaders, shader)
 	}
-
-	data, err := json.MarshalIndent(shaders, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	path := filepath.Join(dataDir, shadersFile)
-	return ioutil.WriteFile(path, data, 0644)
+	return shaders
 }
 
-func (r *Repository) createDefaultShaders() {
-	defaultShaders := []models.Shader{
+// defaultShaders are created when there is no shader data yet
+func defaultShaders() []models.Shader {
+	return []models.Shader{
 		{
 			ID:     1,
 			UserID: 1,
 			Name:   "Basic Fragment Shader",
 			ShaderScripts: []models.ShaderScript{
-				{ID: 1, Code: "precision mediump float;\nvoid main() {\n  gl_FragColor = vec4(1.0, 0.0, 0.0, 1.0);\n}"},
+				{ID: 1, Code: basicFragmentCode, Buffer: defaultBuffer, Kind: "fragment"},
 			},
 			Tags: []models.Tag{{ID: 1, Name: "fragment"}},
 		},
@@ -254,7 +401,7 @@ func (r *Repository) createDefaultShaders() {
 			UserID: 2,
 			Name:   "Simple Vertex Shader",
 			ShaderScripts: []models.ShaderScript{
-				{ID: 2, Code: "attribute vec4 position;\nvoid main() {\n  gl_Position = position;\n}"},
+				{ID: 2, Code: simpleVertexCode, Buffer: defaultBuffer, Kind: "fragment"},
 			},
 			Tags: []models.Tag{{ID: 2, Name: "vertex"}},
 		},
@@ -263,13 +410,15 @@ func (r *Repository) createDefaultShaders() {
 			UserID: 1,
 			Name:   "Animated Color Shader",
 			ShaderScripts: []models.ShaderScript{
-				{ID: 3, Code: "precision mediump float;\nuniform float time;\nvoid main() {\n  gl_FragColor = vec4(sin(time), cos(time), 0.5, 1.0);\n}"},
+				{ID: 3, Code: animatedColorCode, Buffer: defaultBuffer, Kind: "fragment"},
 			},
 			Tags: []models.Tag{{ID: 1, Name: "fragment"}, {ID: 5, Name: "animation"}},
 		},
 	}
+}
 
-	for _, shader := range defaultShaders {
+func (r *Repository) createDefaultShaders() {
+	for _, shader := range defaultShaders() {
 		r.shaders[shader.ID] = shader
 	}
 	r.nextShaderID = 4
@@ -280,17 +429,30 @@ func (r *Repository) createDefaultShaders() {
 func (r *Repository) buildIndexes() {
 	// Clear existing indexes
 	r.usersByUsername = make(map[string]*models.User)
+	r.usersByIdentity = make(map[string]int)
 	r.shadersByUser = make(map[int][]int)
 	r.shadersByTag = make(map[string][]int)
+	r.shadersShared = make(map[int][]int)
+	r.shadersByTeam = make(map[int][]int)
+	r.tokensByHash = make(map[string]int)
+	r.invitesByHash = make(map[string]int)
 
 	// Build user indexes
 	for _, user := range r.users {
 		userCopy := user
-		r.usersByUsername[user.Username] = &userCopy
+		r.usersByUsername[policy.CanonicalUsername(user.Username)] = &userCopy
+		for _, identity := range user.Identities {
+			r.usersByIdentity[identityKey(identity)] = user.ID
+		}
 	}
 
-	// Build shader indexes
+	// Build shader indexes. Shaders in the trash are left out, so that only
+	// the trash methods find them.
 	for _, shader := range r.shaders {
+		if shader.DeletedAt != nil {
+			continue
+		}
+
 		// Index by user
 		r.shadersByUser[shader.UserID] = append(r.shadersByUser[shader.UserID], shader.ID)
 
@@ -299,16 +461,39 @@ func (r *Repository) buildIndexes() {
 			tagName := strings.ToLower(tag.Name)
 			r.shadersByTag[tagName] = append(r.shadersByTag[tagName], shader.ID)
 		}
+
+		// Index by owning team
+		if shader.TeamID != 0 {
+			r.shadersByTeam[shader.TeamID] = append(r.shadersByTeam[shader.TeamID], shader.ID)
+		}
+
+		// Index by collaborator
+		for _, collaborator := range shader.Collaborators {
+			r.shadersShared[collaborator.UserID] = append(r.shadersShared[collaborator.UserID], shader.ID)
+		}
+	}
+
+	// Build token index
+	for _, token := range r.tokens {
+		r.tokensByHash[token.TokenHash] = token.ID
+	}
+
+	// Build invite index
+	for _, invite := range r.invites {
+		r.invitesByHash[invite.CodeHash] = invite.ID
 	}
 }
 
 // Public API methods
 
 // User methods
+
+// GetUserByUsername looks a user up by username, ignoring case and Unicode
+// normalisation differences
 func (r *Repository) GetUserByUsername(username string) *models.User {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return r.usersByUsername[username]
+	return r.usersByUsername[policy.CanonicalUsername(username)]
 }
 
 func (r *Repository) GetUserByID(id int) *models.User {
@@ -321,24 +506,37 @@ func (r *Repository) GetUserByID(id int) *models.User {
 }
 
 func (r *Repository) CreateUser(user models.User) (*models.User, error) {
+	// Hash outside the lock, argon2 is deliberately slow
+	if err := hashUserPassword(&user); err != nil {
+		return nil, err
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, exists := r.usersByUsername[user.Username]; exists {
+	return r.createUserLockFree(user)
+}
+
+// Lock-free version for internal use when mutex is already held
+func (r *Repository) createUserLockFree(user models.User) (*models.User, error) {
+	if _, exists := r.usersByUsername[policy.CanonicalUsername(user.Username)]; exists {
 		return nil, fmt.Errorf("username already exists: %s", user.Username)
 	}
+	for _, identity := range user.Identities {
+		if _, exists := r.usersByIdentity[identityKey(identity)]; exists {
+			return nil, fmt.Errorf("identity already linked to another user")
+		}
+	}
 
 	user.ID = r.nextUserID
 	r.nextUserID++
 
-	r.users[user.ID] = user
-	userCopy := user
-	r.usersByUsername[user.Username] = &userCopy
+	r.setUserLockFree(user)
 
 	if err := r.saveUsers(); err != nil {
 		// Attempt to roll back
+		r.deleteUserIndexesLockFree(user)
 		delete(r.users, user.ID)
-		delete(r.usersByUsername, user.Username)
 		r.nextUserID--
 		return nil, fmt.Errorf("failed to save users: %w", err)
 	}
@@ -346,16 +544,422 @@ func (r *Repository) CreateUser(user models.User) (*models.User, error) {
 	return &user, nil
 }
 
+// SetPasswordHash replaces a user's password hash and drops any legacy
+// plaintext password still stored for them
+func (r *Repository) SetPasswordHash(userID int, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, exists := r.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	previous := user
+	user.PasswordHash = hash
+	user.Password = ""
+	r.setUserLockFree(user)
+
+	if err := r.saveUsers(); err != nil {
+		// Attempt to roll back
+		r.setUserLockFree(previous)
+		return fmt.Errorf("failed to save users: %w", err)
+	}
+
+	return nil
+}
+
+// MigrateLegacyPasswords hashes every plaintext password still present in
+// users.json and returns how many users were migrated
+func (r *Repository) MigrateLegacyPasswords() (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	migrated := 0
+	for _, user := range r.users {
+		if user.Password == "" {
+			continue
+		}
+		if err := hashUserPassword(&user); err != nil {
+			return migrated, fmt.Errorf("failed to hash password for %s: %w", user.Username, err)
+		}
+		r.setUserLockFree(user)
+		migrated++
+	}
+
+	if migrated == 0 {
+		return 0, nil
+	}
+	if err := r.saveUsers(); err != nil {
+		return 0, fmt.Errorf("failed to save users: %w", err)
+	}
+
+	return migrated, nil
+}
+
+// ChangeUsername renames a user, keeping the username index consistent
+func (r *Repository) ChangeUsername(userID int, username string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, exists := r.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	if user.Username == username {
+		return nil
+	}
+	// Changing only the case of your own username is allowed
+	if existing, exists := r.usersByUsername[policy.CanonicalUsername(username)]; exists && existing.ID != userID {
+		return fmt.Errorf("username already exists: %s", username)
+	}
+
+	previous := user
+
+	user.Username = username
+	delete(r.usersByUsername, policy.CanonicalUsername(previous.Username))
+	r.setUserLockFree(user)
+
+	if err := r.saveUsers(); err != nil {
+		// Attempt to roll back
+		delete(r.usersByUsername, policy.CanonicalUsername(username))
+		r.setUserLockFree(previous)
+		r.saveUsers()
+		return fmt.Errorf("failed to save username change: %w", err)
+	}
+
+	return nil
+}
+
+// GetUsersByEmail returns every user with the given email address, compared
+// case-insensitively
+func (r *Repository) GetUsersByEmail(email string) []models.User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var users []models.User
+	for _, user := range r.users {
+		if user.Email != "" && strings.EqualFold(user.Email, email) {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// SetEmail changes a user's email address, which then needs verifying again
+func (r *Repository) SetEmail(userID int, email string) error {
+	return r.updateUser(userID, func(user *models.User) {
+		if !strings.EqualFold(user.Email, email) {
+			user.EmailVerified = false
+		}
+		user.Email = email
+	})
+}
+
+// VerifyEmail marks email as verified if it is still the user's address
+func (r *Repository) VerifyEmail(userID int, email string) error {
+	r.mu.RLock()
+	user, exists := r.users[userID]
+	r.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	if !strings.EqualFold(user.Email, email) {
+		return fmt.Errorf("email address has changed since verification was requested")
+	}
+
+	return r.updateUser(userID, func(user *models.User) {
+		user.EmailVerified = true
+	})
+}
+
+// SetRole changes a user's role
+func (r *Repository) SetRole(userID int, role string) error {
+	return r.updateUser(userID, func(user *models.User) {
+		user.Role = role
+	})
+}
+
+// SetBanned suspends or reinstates a user
+func (r *Repository) SetBanned(userID int, banned bool) error {
+	return r.updateUser(userID, func(user *models.User) {
+		user.Banned = banned
+	})
+}
+
+// updateUser applies change to a user and saves, rolling back on failure.
+// change must not modify the username.
+func (r *Repository) updateUser(userID int, change func(user *models.User)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, exists := r.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	previous := user
+	change(&user)
+	r.setUserLockFree(user)
+
+	if err := r.saveUsers(); err != nil {
+		// Attempt to roll back
+		r.setUserLockFree(previous)
+		return fmt.Errorf("failed to save users: %w", err)
+	}
+
+	return nil
+}
+
+// ShaderDisposition says what happens to a deleted user's shaders
+type ShaderDisposition string
+
+const (
+	// DeleteShaders deletes the user's shaders along with the account
+	DeleteShaders ShaderDisposition = "delete"
+	// OrphanShaders keeps the shaders without an owner
+	OrphanShaders ShaderDisposition = "orphan"
+	// TransferShaders gives the shaders to another user
+	TransferShaders ShaderDisposition = "transfer"
+)
+
+// DeleteUser removes a user and their API tokens. Their shaders are deleted,
+// orphaned or transferred to transferTo according to disposition, except for
+// shaders a team owns, which stay with the team.
+func (r *Repository) DeleteUser(userID int, disposition ShaderDisposition, transferTo int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, exists := r.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	newOwner := 0
+	switch disposition {
+	case DeleteShaders, OrphanShaders:
+	case TransferShaders:
+		recipient, exists := r.users[transferTo]
+		if !exists || transferTo == userID {
+			return fmt.Errorf("invalid transfer recipient")
+		}
+		newOwner = recipient.ID
+	default:
+		return fmt.Errorf("unknown shader disposition: %s", disposition)
+	}
+
+	// Keep copies of everything touched so a failed save can be rolled back
+	previousShaders := make(map[int]models.Shader)
+	previousTokens := make(map[int]models.APIToken)
+
+	previousTeams := make(map[int]models.Team)
+
+	for _, shaderID := range r.shadersByUser[userID] {
+		shader := r.shaders[shaderID]
+		previousShaders[shaderID] = shader
+		// Team shaders stay with the team, only the author is forgotten
+		if shader.TeamID != 0 {
+			shader.UserID = 0
+			r.shaders[shaderID] = shader
+			continue
+		}
+		if disposition == DeleteShaders {
+			delete(r.shaders, shaderID)
+			continue
+		}
+		shader.UserID = newOwner
+		r.shaders[shaderID] = shader
+	}
+	// Their trash is emptied, except for team shaders, which stay in the
+	// team's trash
+	for shaderID, shader := range r.shaders {
+		if shader.DeletedAt == nil || shader.UserID != userID {
+			continue
+		}
+		previousShaders[shaderID] = shader
+		if shader.TeamID != 0 {
+			shader.UserID = 0
+			r.shaders[shaderID] = shader
+		} else {
+			delete(r.shaders, shaderID)
+		}
+	}
+	for shaderID, shader := range r.shaders {
+		// Drop the user as a collaborator, and the recipient from shaders
+		// they now own
+		removed := removeCollaborator(&shader, userID)
+		if disposition == TransferShaders && shader.TeamID == 0 && shader.UserID == newOwner {
+			removed = removeCollaborator(&shader, newOwner) || removed
+		}
+		if !removed {
+			continue
+		}
+		if _, saved := previousShaders[shaderID]; !saved {
+			previousShaders[shaderID] = r.shaders[shaderID]
+		}
+		r.shaders[shaderID] = shader
+	}
+	for teamID, team := range r.teams {
+		if removeTeamMember(&team, userID) {
+			previousTeams[teamID] = r.teams[teamID]
+			r.teams[teamID] = team
+		}
+	}
+	for id, token := range r.tokens {
+		if token.UserID == userID {
+			previousTokens[id] = token
+			delete(r.tokens, id)
+		}
+	}
+	for hash, token := range r.accountTokens {
+		if token.UserID == userID {
+			delete(r.accountTokens, hash)
+		}
+	}
+	delete(r.users, userID)
+	r.buildIndexes()
+
+	err := r.saveShaderChanges(shaderIDs(previousShaders)...)
+	if err == nil {
+		err = r.saveTokens()
+	}
+	if err == nil && len(previousTeams) > 0 {
+		err = r.saveTeams()
+	}
+	if err == nil {
+		err = r.saveUsers()
+	}
+	if err == nil {
+		// Leftover account tokens are harmless, they cannot match a user
+		if saveErr := r.saveAccountTokens(); saveErr != nil {
+			fmt.Printf("Warning: Could not save account tokens: %v\n", saveErr)
+		}
+	}
+	if err != nil {
+		// Attempt to roll back
+		r.users[userID] = user
+		for id, shader := range previousShaders {
+			r.shaders[id] = shader
+		}
+		for id, token := range previousTokens {
+			r.tokens[id] = token
+		}
+		for id, team := range previousTeams {
+			r.teams[id] = team
+		}
+		r.buildIndexes()
+		r.saveShaderChanges(shaderIDs(previousShaders)...)
+		r.saveTokens()
+		r.saveTeams()
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	r.pruneRevisionsLockFree()
+
+	return nil
+}
+
+// GetUserByIdentity returns the user linked to an external identity
+func (r *Repository) GetUserByIdentity(identity models.ExternalIdentity) *models.User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id, exists := r.usersByIdentity[identityKey(identity)]; exists {
+		user := r.users[id]
+		return &user
+	}
+	return nil
+}
+
+// LinkIdentity links an external identity to an existing user
+func (r *Repository) LinkIdentity(userID int, identity models.ExternalIdentity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, exists := r.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	if linked, exists := r.usersByIdentity[identityKey(identity)]; exists {
+		if linked == userID {
+			return nil
+		}
+		return fmt.Errorf("identity already linked to another user")
+	}
+
+	previous := user
+	user.Identities = append(append([]models.ExternalIdentity{}, user.Identities...), identity)
+	r.setUserLockFree(user)
+
+	if err := r.saveUsers(); err != nil {
+		// Attempt to roll back
+		delete(r.usersByIdentity, identityKey(identity))
+		r.setUserLockFree(previous)
+		return fmt.Errorf("failed to save users: %w", err)
+	}
+
+	return nil
+}
+
+// Lock-free version for internal use when mutex is already held
+func (r *Repository) setUserLockFree(user models.User) {
+	r.users[user.ID] = user
+	userCopy := user
+	r.usersByUsername[policy.CanonicalUsername(user.Username)] = &userCopy
+	for _, identity := range user.Identities {
+		r.usersByIdentity[identityKey(identity)] = user.ID
+	}
+}
+
+// Lock-free version for internal use when mutex is already held
+func (r *Repository) deleteUserIndexesLockFree(user models.User) {
+	delete(r.usersByUsername, policy.CanonicalUsername(user.Username))
+	for _, identity := range user.Identities {
+		delete(r.usersByIdentity, identityKey(identity))
+	}
+}
+
+func identityKey(identity models.ExternalIdentity) string {
+	return identity.Issuer + "|" + identity.Subject
+}
+
+// hashUserPassword replaces a plaintext Password with its hash so that it
+// is never persisted
+func hashUserPassword(user *models.User) error {
+	if user.Password == "" {
+		return nil
+	}
+	hash, err := auth.HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	user.Password = ""
+	return nil
+}
+
 // Shader methods
+
+// GetShaderByID returns a shader with its owner's current username as the
+// Author, or nil if it does not exist
 func (r *Repository) GetShaderByID(id int) *models.Shader {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	if shader, exists := r.shaders[id]; exists {
+	if shader, exists := r.liveShaderLockFree(id); exists {
+		shader.Author = r.authorLockFree(shader.UserID)
 		return &shader
 	}
 	return nil
 }
 
+// authorLockFree returns the username shown as the author of the shaders
+// userID owns
+func (r *Repository) authorLockFree(userID int) string {
+	if user, exists := r.users[userID]; exists {
+		return user.Username
+	}
+	return "Unknown"
+}
+
 // Helper method to process tags and ensure they have proper IDs (lock-free for internal use)
 func (r *Repository) processTags(tags []models.Tag) ([]models.Tag, error) {
 	var processedTags []models.Tag
@@ -415,7 +1019,9 @@ func (r *Repository) createTagLockFree(name string) (*models.Tag, error) {
 	return &tag, nil
 }
 
-func (r *Repository) CreateShader(shader models.Shader) (*models.Shader, error) {
+// CreateShader stores a new shader, recording its code as the first
+// revision
+func (r *Repository) CreateShader(shader models.Shader, revision models.ShaderRevision) (*models.Shader, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -425,21 +1031,34 @@ func (r *Repository) CreateShader(shader models.Shader) (*models.Shader, error)
 		return nil, err
 	}
 	shader.Tags = processedTags
+	// Authors are looked up from the owner, never stored
+	shader.Author = ""
 
 	shader.ID = r.nextShaderID
+	if err := r.recordRevisionsLockFree(nil, shader, revision); err != nil {
+		return nil, fmt.Errorf("failed to save revision: %w", err)
+	}
 	r.nextShaderID++
 
 	r.shaders[shader.ID] = shader
 
 	// Update indexes
 	r.shadersByUser[shader.UserID] = append(r.shadersByUser[shader.UserID], shader.ID)
+	if shader.TeamID != 0 {
+		r.shadersByTeam[shader.TeamID] = append(r.shadersByTeam[shader.TeamID], shader.ID)
+	}
 	for _, tag := range shader.Tags {
 		tagName := strings.ToLower(tag.Name)
 		r.shadersByTag[tagName] = append(r.shadersByTag[tagName], shader.ID)
 	}
 
 	// Save both shaders and tags since we may have created new tags
-	if err := r.saveShaders(); err != nil {
+	if err := r.saveShaderChanges(shader.ID); err != nil {
+		// Attempt to roll back
+		delete(r.shaders, shader.ID)
+		r.nextShaderID--
+		r.buildIndexes()
+		r.truncateRevisionsLockFree(shader.ID, 0)
 		return nil, err
 	}
 	if err := r.saveTags(); err != nil {
@@ -449,11 +1068,14 @@ func (r *Repository) CreateShader(shader models.Shader) (*models.Shader, error)
 	return &shader, nil
 }
 
-func (r *Repository) UpdateShader(id int, shader models.Shader) (*models.Shader, error) {
+// UpdateShader replaces a shader. Unless revision is nil its code is
+// recorded as a new revision.
+func (r *Repository) UpdateShader(id int, shader models.Shader, revision *models.ShaderRevision) (*models.Shader, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, exists := r.shaders[id]; !exists {
+	previous, exists := r.liveShaderLockFree(id)
+	if !exists {
 		return nil, fmt.Errorf("shader not found")
 	}
 
@@ -463,15 +1085,27 @@ func (r *Repository) UpdateShader(id int, shader models.Shader) (*models.Shader,
 		return nil, err
 	}
 	shader.Tags = processedTags
+	// Authors are looked up from the owner, never stored
+	shader.Author = ""
 
 	shader.ID = id
+	latest := r.latestRevisionLockFree(id)
+	if revision != nil {
+		if err := r.recordRevisionsLockFree(&previous, shader, *revision); err != nil {
+			return nil, fmt.Errorf("failed to save revision: %w", err)
+		}
+	}
 	r.shaders[id] = shader
 
 	// Rebuild indexes (could be optimized)
 	r.buildIndexes()
 
 	// Save both shaders and tags since we may have created new tags
-	if err := r.saveShaders(); err != nil {
+	if err := r.saveShaderChanges(id); err != nil {
+		// Attempt to roll back
+		r.shaders[id] = previous
+		r.buildIndexes()
+		r.truncateRevisionsLockFree(id, latest)
 		return nil, err
 	}
 	if err := r.saveTags(); err != nil {
@@ -481,20 +1115,22 @@ func (r *Repository) UpdateShader(id int, shader models.Shader) (*models.Shader,
 	return &shader, nil
 }
 
+// DeleteShader moves a shader to the trash, from where it can be restored
+// until it is purged
 func (r *Repository) DeleteShader(id int) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, exists := r.shaders[id]; !exists {
+	shader, exists := r.liveShaderLockFree(id)
+	if !exists {
 		return fmt.Errorf("shader not found")
 	}
 
-	delete(r.shaders, id)
+	previous := shader
+	deletedAt := time.Now().UTC()
+	shader.DeletedAt = &deletedAt
 
-	// Rebuild indexes
-	r.buildIndexes()
-
-	return r.saveShaders()
+	return r.saveShaderChangeLockFree(previous, shader)
 }
 
 // SearchShaders performs efficient searching based on parameters
@@ -557,6 +1193,16 @@ func (r *Repository) SearchShaders(params models.SearchParams) []models.Shader {
 		candidateIDs = r.intersectIDs(candidateIDs, r.shadersByUser[params.UserID])
 	}
 
+	// Filter by owning team
+	if params.TeamID != 0 {
+		candidateIDs = r.intersectIDs(candidateIDs, r.shadersByTeam[params.TeamID])
+	}
+
+	// Filter to shaders shared with a collaborator
+	if params.SharedWith != 0 {
+		candidateIDs = r.intersectIDs(candidateIDs, r.shadersShared[params.SharedWith])
+	}
+
 	// Filter by tags (intersection - shader must have ALL specified tags)
 	for _, tagName := range params.Tags {
 		tagName = strings.ToLower(tagName)
@@ -577,6 +1223,9 @@ func (r *Repository) SearchShaders(params models.SearchParams) []models.Shader {
 	// Iterate through candidate IDs (no sorting for efficiency)
 	for _, id := range candidateIDs {
 		shader := r.shaders[id]
+		if shader.DeletedAt != nil {
+			continue
+		}
 
 		// Skip records for pagination offset
 		if skipped < params.Offset {
@@ -584,12 +1233,10 @@ func (r *Repository) SearchShaders(params models.SearchParams) []models.Shader {
 			continue
 		}
 
-		// Populate author field by looking up the user
-		if user := r.GetUserByID(shader.UserID); user != nil {
-			shader.Author = user.Username
-		} else {
-			shader.Author = "Unknown"
-		}
+		// Populate author field by looking up the user. The read lock is
+		// already held, and taking it again could deadlock with a waiting
+		// writer.
+		shader.Author = r.authorLockFree(shader.UserID)
 
 		results = append(results, shader)
 		collected++
@@ -641,6 +1288,16 @@ func (r *Repository) GetAllTags() []models.Tag {
 	return tags
 }
 
+// GetTagByID returns a tag, or nil if it does not exist
+func (r *Repository) GetTagByID(id int) *models.Tag {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if tag, exists := r.tags[id]; exists {
+		return &tag
+	}
+	return nil
+}
+
 func (r *Repository) GetTagByName(name string) *models.Tag {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -678,3 +1335,110 @@ func (r *Repository) CreateTag(name string) (*models.Tag, error) {
 
 	return &tag, nil
 }
+
+// RenameTag changes a tag's name everywhere it is used
+func (r *Repository) RenameTag(id int, name string) (*models.Tag, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tag, exists := r.tags[id]
+	if !exists {
+		return nil, fmt.Errorf("tag not found")
+	}
+	if existing := r.getTagByNameLockFree(name); existing != nil && existing.ID != id {
+		return nil, fmt.Errorf("tag already exists: %s", name)
+	}
+
+	previous := tag
+	tag.Name = name
+	r.tags[id] = tag
+
+	changed := r.replaceShaderTagLockFree(id, &tag)
+	if err := r.saveTagChangeLockFree(changed); err != nil {
+		// Attempt to roll back
+		r.tags[id] = previous
+		r.replaceShaderTagLockFree(id, &previous)
+		return nil, err
+	}
+
+	return &tag, nil
+}
+
+// DeleteTag removes a tag and takes it off every shader that had it
+func (r *Repository) DeleteTag(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tag, exists := r.tags[id]
+	if !exists {
+		return fmt.Errorf("tag not found")
+	}
+
+	previousShaders := make(map[int]models.Shader)
+	for _, shader := range r.shaders {
+		for _, shaderTag := range shader.Tags {
+			if shaderTag.ID == id {
+				previousShaders[shader.ID] = shader
+				break
+			}
+		}
+	}
+
+	delete(r.tags, id)
+	r.replaceShaderTagLockFree(id, nil)
+
+	if err := r.saveTagChangeLockFree(shaderIDs(previousShaders)); err != nil {
+		// Attempt to roll back
+		r.tags[id] = tag
+		for shaderID, shader := range previousShaders {
+			r.shaders[shaderID] = shader
+		}
+		r.buildIndexes()
+		return err
+	}
+
+	return nil
+}
+
+// Lock-free version for internal use when mutex is already held. Replaces the
+// tag with the given ID on every shader, or removes it if replacement is nil,
+// and returns the IDs of the shaders that changed.
+func (r *Repository) replaceShaderTagLockFree(id int, replacement *models.Tag) []int {
+	var changed []int
+	for shaderID, shader := range r.shaders {
+		tags := make([]models.Tag, 0, len(shader.Tags))
+		found := false
+		for _, tag := range shader.Tags {
+			if tag.ID != id {
+				tags = append(tags, tag)
+				continue
+			}
+			found = true
+			if replacement != nil {
+				tags = append(tags, *replacement)
+			}
+		}
+		if found {
+			shader.Tags = tags
+			r.shaders[shaderID] = shader
+			changed = append(changed, shaderID)
+		}
+	}
+	if len(changed) > 0 {
+		r.buildIndexes()
+	}
+	return changed
+}
+
+// Lock-free version for internal use when mutex is already held
+func (r *Repository) saveTagChangeLockFree(changedShaders []int) error {
+	if err := r.saveTags(); err != nil {
+		return fmt.Errorf("failed to save tags: %w", err)
+	}
+	if len(changedShaders) > 0 {
+		if err := r.saveShaderChanges(changedShaders...); err != nil {
+			return fmt.Errorf("failed to save shaders: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-server/internal/atomicfile"
+	"go-server/internal/models"
+)
+
+// Every save of a shader's code records a revision. The code is kept in
+// blobs named after the SHA-256 of their contents, so a script that did not
+// change between revisions is only stored once. The JSON storage keeps the
+// blobs as files under revisionsDir/objects, and appends the rest of each
+// revision to a log per shader, revisionsDir/<shader ID>.log, whose lines
+// are in the format of the shader log.
+const (
+	revisionsDir = "revisions"
+	objectsDir   = "objects"
+)
+
+// baselineMessage describes the revision recorded of the code a shader had
+// before revisions were kept, the first time it is saved
+const baselineMessage = "Saved before revision history was kept"
+
+// storedRevision is a revision with its code replaced by blob hashes
+type storedRevision struct {
+	ShaderID  int            `json:"shader_id"`
+	Number    int            `json:"number"`
+	UserID    int            `json:"user_id"`
+	Message   string         `json:"message,omitempty"`
+	RevertOf  int            `json:"revert_of,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	Common    string         `json:"common,omitempty"` // "" if there is no common script
+	Scripts   []storedScript `json:"scripts"`
+}
+
+type storedScript struct {
+	ID     int               `json:"id"`
+	Code   string            `json:"code"`
+	Buffer models.BufferSpec `json:"buffer"`
+	Kind   string            `json:"kind,omitempty"`
+}
+
+// pendingRevisions returns the revisions that saving shader records after
+// the revision numbered latest, and the blobs they need by hash. A shader
+// without revisions first gets one of its code as it was, previous, unless
+// it is new.
+func pendingRevisions(previous *models.Shader, shader models.Shader, latest int, revision models.ShaderRevision) ([]storedRevision, map[string]string) {
+	blobs := make(map[string]string)
+	revisions := []storedRevision{}
+	if previous != nil && latest == 0 {
+		baseline := models.ShaderRevision{UserID: previous.UserID, Message: baselineMessage, CreatedAt: revision.CreatedAt}
+		latest++
+		revisions = append(revisions, newStoredRevision(*previous, latest, baseline, blobs))
+	}
+	revisions = append(revisions, newStoredRevision(shader, latest+1, revision, blobs))
+	return revisions, blobs
+}
+
+// newStoredRevision makes revision number of shader's code, adding the
+// blobs it needs to blobs
+func newStoredRevision(shader models.Shader, number int, revision models.ShaderRevision, blobs map[string]string) storedRevision {
+	stored := storedRevision{
+		ShaderID:  shader.ID,
+		Number:    number,
+		UserID:    revision.UserID,
+		Message:   revision.Message,
+		RevertOf:  revision.RevertOf,
+		CreatedAt: revision.CreatedAt.UTC(),
+		Scripts:   make([]storedScript, 0, len(shader.ShaderScripts)),
+	}
+	if shader.CommonScript != "" {
+		stored.Common = blobHash(shader.CommonScript)
+		blobs[stored.Common] = shader.CommonScript
+	}
+	for _, script := range shader.ShaderScripts {
+		hash := blobHash(script.Code)
+		blobs[hash] = script.Code
+		stored.Scripts = append(stored.Scripts, storedScript{ID: script.ID, Code: hash, Buffer: script.Buffer, Kind: script.Kind})
+	}
+	return stored
+}
+
+// summary returns the revision without its code
+func (stored storedRevision) summary() models.ShaderRevision {
+	return models.ShaderRevision{
+		ShaderID:  stored.ShaderID,
+		Number:    stored.Number,
+		UserID:    stored.UserID,
+		Message:   stored.Message,
+		RevertOf:  stored.RevertOf,
+		CreatedAt: stored.CreatedAt,
+	}
+}
+
+// expand returns the revision with its code, reading each blob with read
+func (stored storedRevision) expand(read func(hash string) (string, error)) (*models.ShaderRevision, error) {
+	revision := stored.summary()
+	if stored.Common != "" {
+		code, err := read(stored.Common)
+		if err != nil {
+			return nil, err
+		}
+		revision.CommonScript = code
+	}
+	revision.ShaderScripts = make([]models.ShaderScript, 0, len(stored.Scripts))
+	for _, script := range stored.Scripts {
+		code, err := read(script.Code)
+		if err != nil {
+			return nil, err
+		}
+		revision.ShaderScripts = append(revision.ShaderScripts, models.ShaderScript{ID: script.ID, Code: code, Buffer: script.Buffer, Kind: script.Kind})
+	}
+	return &revision, nil
+}
+
+// hashes returns the blobs the revision uses, once for each use
+func (stored storedRevision) hashes() []string {
+	hashes := make([]string, 0, len(stored.Scripts)+1)
+	if stored.Common != "" {
+		hashes = append(hashes, stored.Common)
+	}
+	for _, script := range stored.Scripts {
+		hashes = append(hashes, script.Code)
+	}
+	return hashes
+}
+
+// validate checks that a revision read back names its blobs by hash
+func (stored storedRevision) validate() error {
+	for _, hash := range stored.hashes() {
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return fmt.Errorf("invalid blob hash %q", hash)
+		}
+	}
+	return nil
+}
+
+func blobHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetShaderRevisions returns the revisions of a shader without their code,
+// newest first
+func (r *Repository) GetShaderRevisions(shaderID int) []models.ShaderRevision {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stored := r.revisions[shaderID]
+	revisions := make([]models.ShaderRevision, 0, len(stored))
+	for i := len(stored) - 1; i >= 0; i-- {
+		revisions = append(revisions, stored[i].summary())
+	}
+	return revisions
+}
+
+// GetShaderRevision returns a revision of a shader with its code, or nil if
+// there is no such revision
+func (r *Repository) GetShaderRevision(shaderID, number int) *models.ShaderRevision {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, stored := range r.revisions[shaderID] {
+		if stored.Number != number {
+			continue
+		}
+		revision, err := stored.expand(r.readBlob)
+		if err != nil {
+			fmt.Printf("Warning: Could not read revision %d of shader %d: %v\n", number, shaderID, err)
+			return nil
+		}
+		return revision
+	}
+	return nil
+}
+
+// loadRevisions reads the revision log of every shader. Logs of shaders that
+// do not exist are kept, such as those of shaders a replayed shader log
+// deleted after a restore, and are only removed when the trash is purged.
+// New shaders are numbered past them so that none takes over their history.
+// A record cut short by a crash at the end of a log is dropped, damage
+// anywhere else is an error.
+func (r *Repository) loadRevisions() error {
+	entries, err := ioutil.ReadDir(filepath.Join(r.dir, revisionsDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		shaderID, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".log"))
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") || err != nil {
+			continue
+		}
+		path := r.revisionPath(shaderID)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		offset := 0
+		for offset < len(data) {
+			rest := data[offset:]
+			end := bytes.IndexByte(rest, '\n')
+			if end >= 0 {
+				var stored storedRevision
+				payload, err := verifyLogLine(rest[:end])
+				if err == nil {
+					err = json.Unmarshal(payload, &stored)
+				}
+				if err == nil {
+					err = stored.validate()
+				}
+				if err == nil && stored.ShaderID != shaderID {
+					err = fmt.Errorf("revision of shader %d", stored.ShaderID)
+				}
+				if err == nil {
+					r.addRevisionLockFree(stored)
+					offset += end + 1
+					continue
+				}
+				if end+1 < len(rest) {
+					return fmt.Errorf("%s is damaged at byte %d: %v", path, offset, err)
+				}
+			}
+			fmt.Printf("Warning: Dropping incomplete last record of %s\n", path)
+			if err := os.Truncate(path, int64(offset)); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	for shaderID := range r.revisions {
+		if shaderID >= r.nextShaderID {
+			r.nextShaderID = shaderID + 1
+		}
+	}
+	return nil
+}
+
+// Lock-free version for internal use when mutex is already held. Records the
+// revisions of a save of shader, see pendingRevisions.
+func (r *Repository) recordRevisionsLockFree(previous *models.Shader, shader models.Shader, revision models.ShaderRevision) error {
+	revisions, blobs := pendingRevisions(previous, shader, r.latestRevisionLockFree(shader.ID), revision)
+
+	for hash, content := range blobs {
+		if err := r.writeBlob(hash, content); err != nil {
+			return err
+		}
+	}
+
+	var lines []byte
+	for _, stored := range revisions {
+		line, err := encodeLogLine(stored)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line...)
+	}
+
+	if err := os.MkdirAll(filepath.Join(r.dir, revisionsDir), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.revisionPath(shader.ID), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(lines)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// Cut off anything partly written
+		f.Truncate(info.Size())
+		return err
+	}
+
+	for _, stored := range revisions {
+		r.addRevisionLockFree(stored)
+	}
+	return nil
+}
+
+// Lock-free version for internal use when mutex is already held. Removes the
+// revisions of a shader after the one numbered latest, taking back a save
+// that failed.
+func (r *Repository) truncateRevisionsLockFree(shaderID, latest int) error {
+	kept := []storedRevision{}
+	dropped := []storedRevision{}
+	for _, stored := range r.revisions[shaderID] {
+		if stored.Number <= latest {
+			kept = append(kept, stored)
+		} else {
+			dropped = append(dropped, stored)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	var lines []byte
+	for _, stored := range kept {
+		line, err := encodeLogLine(stored)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line...)
+	}
+	if err := atomicfile.WriteFile(r.revisionPath(shaderID), lines, 0644, 0); err != nil {
+		return err
+	}
+
+	r.revisions[shaderID] = kept
+	r.releaseBlobsLockFree(dropped)
+	return nil
+}
+
+// Lock-free version for internal use when mutex is already held. Removes the
+// revisions of shaders that no longer exist, along with the blobs only they
+// used.
+func (r *Repository) pruneRevisionsLockFree() {
+	for shaderID, revisions := range r.revisions {
+		if _, exists := r.shaders[shaderID]; exists {
+			continue
+		}
+		if err := os.Remove(r.revisionPath(shaderID)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Warning: Could not remove revisions of shader %d: %v\n", shaderID, err)
+			continue
+		}
+		delete(r.revisions, shaderID)
+		r.releaseBlobsLockFree(revisions)
+	}
+}
+
+// Lock-free version for internal use when mutex is already held
+func (r *Repository) latestRevisionLockFree(shaderID int) int {
+	revisions := r.revisions[shaderID]
+	if len(revisions) == 0 {
+		return 0
+	}
+	return revisions[len(revisions)-1].Number
+}
+
+// Lock-free version for internal use when mutex is already held
+func (r *Repository) addRevisionLockFree(stored storedRevision) {
+	r.revisions[stored.ShaderID] = append(r.revisions[stored.ShaderID], stored)
+	for _, hash := range stored.hashes() {
+		r.blobRefs[hash]++
+	}
+}
+
+// Lock-free version for internal use when mutex is already held. Removes the
+// blobs that no revision uses once revisions are gone.
+func (r *Repository) releaseBlobsLockFree(revisions []storedRevision) {
+	for _, stored := range revisions {
+		for _, hash := range stored.hashes() {
+			r.blobRefs[hash]--
+			if r.blobRefs[hash] > 0 {
+				continue
+			}
+			delete(r.blobRefs, hash)
+			path := r.blobPath(hash)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				fmt.Printf("Warning: Could not remove blob %s: %v\n", hash, err)
+			}
+			// Fails harmlessly while other blobs share the directory
+			os.Remove(filepath.Dir(path))
+		}
+	}
+}
+
+// writeBlob stores content under its hash, unless it is already stored
+func (r *Repository) writeBlob(hash, content string) error {
+	path := r.blobPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, []byte(content), 0644, 0)
+}
+
+// readBlob returns the content stored under hash, checking that it still
+// matches
+func (r *Repository) readBlob(hash string) (string, error) {
+	data, err := ioutil.ReadFile(r.blobPath(hash))
+	if err != nil {
+		return "", err
+	}
+	if blobHash(string(data)) != hash {
+		return "", fmt.Errorf("blob %s does not match its hash", hash)
+	}
+	return string(data), nil
+}
+
+func (r *Repository) revisionPath(shaderID int) string {
+	return filepath.Join(r.dir, revisionsDir, strconv.Itoa(shaderID)+".log")
+}
+
+// blobPath spreads blobs over directories named after the first two digits
+// of their hash, so that no directory grows too large
+func (r *Repository) blobPath(hash string) string {
+	return filepath.Join(r.dir, revisionsDir, objectsDir, hash[:2], hash[2:])
+}
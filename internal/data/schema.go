@@ -0,0 +1,170 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"go-server/internal/atomicfile"
+	"go-server/internal/models"
+)
+
+// SchemaVersion is the version of the data files this build writes. Files
+// from older versions are migrated when they are loaded, newer ones are
+// refused.
+const SchemaVersion = 5
+
+// dataFile is the layout of every JSON data file. Files that are just the
+// data, from before there was a schema version, are version 1.
+type dataFile struct {
+	SchemaVersion int             `json:"schema_version"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// migration upgrades one data file to version from the version before it.
+// Migrations must be idempotent, and must keep every element of an array in
+// its place, as the shaders of a log record are migrated as an array too.
+type migration struct {
+	version     int
+	file        string
+	description string
+	apply       func(data []byte) ([]byte, error)
+}
+
+// migrations are run in order, each on files older than its version
+var migrations = []migration{
+	{2, shadersFile, "default script kind to fragment", eachShader(func(shader *models.Shader) {
+		for i := range shader.ShaderScripts {
+			if shader.ShaderScripts[i].Kind == "" {
+				shader.ShaderScripts[i].Kind = "fragment"
+			}
+		}
+	})},
+	{3, shadersFile, "drop stored author", eachShader(func(shader *models.Shader) {
+		// Authors are looked up from the owner when shaders are listed
+		shader.Author = ""
+	})},
+	{4, shadersFile, "convert legacy default shaders to WGSL", eachShader(func(shader *models.Shader) {
+		for i := range shader.ShaderScripts {
+			script := &shader.ShaderScripts[i]
+			code, legacy := legacyDefaultCode[script.Code]
+			if !legacy {
+				continue
+			}
+			script.Code = code
+			if script.Buffer.Format == "" {
+				script.Buffer = defaultBuffer
+			}
+		}
+	})},
+	// Nothing to change, but older builds would show shaders in the trash
+	{5, shadersFile, "add the trash", func(data []byte) ([]byte, error) {
+		return data, nil
+	}},
+}
+
+// eachShader makes a migration of shaders.json that changes every shader
+func eachShader(change func(shader *models.Shader)) func(data []byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		var shaders []models.Shader
+		if err := json.Unmarshal(data, &shaders); err != nil {
+			return nil, err
+		}
+		for i := range shaders {
+			change(&shaders[i])
+		}
+		return json.Marshal(shaders)
+	}
+}
+
+// encodeDataFile marshals v as a data file of the current schema version
+func encodeDataFile(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(dataFile{SchemaVersion: SchemaVersion, Data: data}, "", "  ")
+}
+
+// decodeDataFile migrates the contents of the data file called name to the
+// current schema version and decodes them into v. It returns the version
+// the file was at. A file newer than this build is refused with an error
+// wrapping atomicfile.ErrUnsupported.
+func decodeDataFile(name string, raw []byte, v interface{}) (int, error) {
+	version := 1
+	data := raw
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '{' {
+		var file dataFile
+		if err := json.Unmarshal(raw, &file); err != nil {
+			return 0, err
+		}
+		if file.SchemaVersion < 1 {
+			return 0, fmt.Errorf("no schema version")
+		}
+		version = file.SchemaVersion
+		data = file.Data
+	}
+	if version > SchemaVersion {
+		return version, fmt.Errorf("schema version %d is newer than this build supports (%d): %w", version, SchemaVersion, atomicfile.ErrUnsupported)
+	}
+
+	data, err := migrate(name, version, data)
+	if err != nil {
+		return version, err
+	}
+	return version, json.Unmarshal(data, v)
+}
+
+// migrate runs the migrations of the data file called name that are newer
+// than version on data
+func migrate(name string, version int, data []byte) ([]byte, error) {
+	for _, m := range migrations {
+		if m.version <= version || m.file != name {
+			continue
+		}
+		var err error
+		if data, err = m.apply(data); err != nil {
+			return nil, fmt.Errorf("migration to version %d (%s) failed: %w", m.version, m.description, err)
+		}
+	}
+	return data, nil
+}
+
+// defaultBuffer is the render target of scripts that do not set their own
+var defaultBuffer = models.BufferSpec{Format: "rgba8unorm", Width: 512, Height: 512}
+
+// legacyDefaultCode maps the GLSL of the default shaders created before the
+// editor moved to WebGPU to WGSL that does the same
+var legacyDefaultCode = map[string]string{
+	"precision mediump float;\nvoid main() {\n  gl_FragColor = vec4(1.0, 0.0, 0.0, 1.0);\n}":                                  basicFragmentCode,
+	"attribute vec4 position;\nvoid main() {\n  gl_Position = position;\n}":                                                   simpleVertexCode,
+	"precision mediump float;\nuniform float time;\nvoid main() {\n  gl_FragColor = vec4(sin(time), cos(time), 0.5, 1.0);\n}": animatedColorCode,
+}
+
+const basicFragmentCode = `@fragment
+fn fs_main(@builtin(position) coord: vec4<f32>) -> @location(0) vec4<f32> {
+    return vec4<f32>(1.0, 0.0, 0.0, 1.0);
+}
+`
+
+const simpleVertexCode = `@vertex
+fn vs_main(@builtin(vertex_index) vertex_index: u32) -> @builtin(position) vec4<f32> {
+    var pos = array<vec2<f32>, 3>(
+        vec2<f32>(-1.0, -1.0),
+        vec2<f32>( 3.0, -1.0),
+        vec2<f32>(-1.0,  3.0)
+    );
+    return vec4<f32>(pos[vertex_index], 0.0, 1.0);
+}
+
+@fragment
+fn fs_main(@builtin(position) coord: vec4<f32>) -> @location(0) vec4<f32> {
+    return vec4<f32>(coord.xy / u.resolution, 0.0, 1.0);
+}
+`
+
+const animatedColorCode = `@fragment
+fn fs_main(@builtin(position) coord: vec4<f32>) -> @location(0) vec4<f32> {
+    return vec4<f32>(sin(u.time), cos(u.time), 0.5, 1.0);
+}
+`
@@ -0,0 +1,340 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go-server/internal/atomicfile"
+	"go-server/internal/models"
+)
+
+// Changes to shaders are appended to shaderLogFile, one line per mutation,
+// instead of rewriting shaders.json every time. On startup the log is
+// replayed on top of shaders.json, and once it grows past the compaction
+// size it is folded into a new shaders.json in the background.
+//
+// Each line is the CRC-32 of a JSON record in hex, a space and the record.
+// A record holds the complete state of every shader a mutation touched, so
+// replaying a record that shaders.json already includes changes nothing.
+// Records are migrated like shaders.json from the schema version they were
+// written at.
+const shaderLogFile = "shaders.log"
+
+type shaderLogRecord struct {
+	Version int           `json:"v,omitempty"` // Schema version, 0 for records from before there was one
+	Ops     []shaderLogOp `json:"ops"`
+}
+
+type shaderLogOp struct {
+	Op     string         `json:"op"` // "put" or "delete"
+	ID     int            `json:"id"`
+	Shader *models.Shader `json:"shader,omitempty"`
+}
+
+// replayShaderLog applies the log to the shaders loaded from shaders.json
+// and opens it for appending. A record cut short by a crash at the end of
+// the log is dropped, damage anywhere else is an error.
+func (r *Repository) replayShaderLog() error {
+	path := filepath.Join(r.dir, shaderLogFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var offset int64
+	for offset < int64(len(data)) {
+		rest := data[offset:]
+		end := bytes.IndexByte(rest, '\n')
+		if end >= 0 {
+			record, err := decodeShaderLogRecord(rest[:end])
+			if err == nil {
+				if err := migrateShaderLogRecord(&record); err != nil {
+					return fmt.Errorf("%s at byte %d: %w", path, offset, err)
+				}
+				r.applyShaderLogRecord(record)
+				offset += int64(end) + 1
+				continue
+			}
+			if end+1 < len(rest) {
+				return fmt.Errorf("%s is damaged at byte %d: %v", path, offset, err)
+			}
+		}
+		fmt.Printf("Warning: Dropping incomplete last record of %s\n", path)
+		break
+	}
+
+	if err := r.openShaderLog(); err != nil {
+		return err
+	}
+	if offset < int64(len(data)) {
+		if err := r.shaderLog.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	r.shaderLogSize = offset
+	return nil
+}
+
+func (r *Repository) openShaderLog() error {
+	f, err := os.OpenFile(filepath.Join(r.dir, shaderLogFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	r.shaderLog = f
+	return nil
+}
+
+func (r *Repository) applyShaderLogRecord(record shaderLogRecord) {
+	for _, op := range record.Ops {
+		if op.Op == "delete" {
+			delete(r.shaders, op.ID)
+			continue
+		}
+		r.shaders[op.ID] = *op.Shader
+		if op.ID >= r.nextShaderID {
+			r.nextShaderID = op.ID + 1
+		}
+	}
+}
+
+// saveShaderChanges appends the current state of the given shaders to the
+// log as a single record, deleting those that no longer exist, and starts a
+// compaction once the log is big enough. The mutex must be held.
+func (r *Repository) saveShaderChanges(ids ...int) error {
+	if r.shaderLog == nil {
+		return fmt.Errorf("shader log is closed")
+	}
+
+	record := shaderLogRecord{Version: SchemaVersion}
+	for _, id := range ids {
+		if shader, exists := r.shaders[id]; exists {
+			record.Ops = append(record.Ops, shaderLogOp{Op: "put", ID: id, Shader: &shader})
+		} else {
+			record.Ops = append(record.Ops, shaderLogOp{Op: "delete", ID: id})
+		}
+	}
+	if len(record.Ops) == 0 {
+		return nil
+	}
+
+	line, err := encodeShaderLogRecord(record)
+	if err != nil {
+		return err
+	}
+	_, err = r.shaderLog.Write(line)
+	if err == nil {
+		err = r.shaderLog.Sync()
+	}
+	if err != nil {
+		// Cut off anything partly written, so that later records are not
+		// stuck behind a damaged one
+		r.shaderLog.Truncate(r.shaderLogSize)
+		return err
+	}
+	r.shaderLogSize += int64(len(line))
+	if r.onShaderLog != nil {
+		r.onShaderLog(line)
+	}
+
+	if r.shaderLogSize >= int64(r.compactAt) && !r.compacting {
+		r.compacting = true
+		r.compactions.Add(1)
+		go r.compactShaderLog()
+	}
+	return nil
+}
+
+// SetShaderLogListener has listener called with every line appended to the
+// shader log, once it is on disk. It is called with the mutex held, so it
+// must not block or use the repository.
+func (r *Repository) SetShaderLogListener(listener func(line []byte)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onShaderLog = listener
+}
+
+// ValidateShaderLog checks that every line of a shader log is a complete,
+// intact record
+func ValidateShaderLog(log []byte) error {
+	for offset := 0; offset < len(log); {
+		end := bytes.IndexByte(log[offset:], '\n')
+		if end < 0 {
+			return fmt.Errorf("shader log ends with an incomplete record")
+		}
+		record, err := decodeShaderLogRecord(log[offset : offset+end])
+		if err != nil {
+			return fmt.Errorf("shader log is damaged at byte %d: %v", offset, err)
+		}
+		if err := migrateShaderLogRecord(&record); err != nil {
+			return fmt.Errorf("shader log at byte %d: %w", offset, err)
+		}
+		offset += end + 1
+	}
+	return nil
+}
+
+// compactShaderLog writes every shader to shaders.json and removes the
+// records it now includes from the log
+func (r *Repository) compactShaderLog() {
+	defer r.compactions.Done()
+
+	// Only writers wait while the snapshot is taken, readers carry on
+	r.mu.RLock()
+	data, err := encodeDataFile(r.shaderListLockFree())
+	compacted := r.shaderLogSize
+	r.mu.RUnlock()
+
+	if err == nil {
+		err = atomicfile.WriteFile(filepath.Join(r.dir, shadersFile), data, 0644, r.backups)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		err = r.trimShaderLogLockFree(compacted)
+	}
+	if err != nil {
+		fmt.Printf("Warning: Could not compact %s: %v\n", shaderLogFile, err)
+	}
+	r.compacting = false
+}
+
+// Lock-free version for internal use when mutex is already held. Replaces
+// the log with the records written after the first offset bytes.
+func (r *Repository) trimShaderLogLockFree(offset int64) error {
+	path := filepath.Join(r.dir, shaderLogFile)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	tail, err := ioutil.ReadAll(io.NewSectionReader(f, offset, r.shaderLogSize-offset))
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := atomicfile.WriteFile(path, tail, 0644, 0); err != nil {
+		return err
+	}
+	r.shaderLog.Close()
+	r.shaderLog = nil
+	if err := r.openShaderLog(); err != nil {
+		return err
+	}
+	r.shaderLogSize = int64(len(tail))
+	return nil
+}
+
+func encodeShaderLogRecord(record shaderLogRecord) ([]byte, error) {
+	return encodeLogLine(record)
+}
+
+func decodeShaderLogRecord(line []byte) (shaderLogRecord, error) {
+	var record shaderLogRecord
+	payload, err := verifyLogLine(line)
+	if err != nil {
+		return record, err
+	}
+
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, err
+	}
+	for _, op := range record.Ops {
+		if op.Op != "delete" && (op.Op != "put" || op.Shader == nil) {
+			return record, fmt.Errorf("invalid operation %q", op.Op)
+		}
+	}
+	return record, nil
+}
+
+// migrateShaderLogRecord brings the shaders a record puts up to the current
+// schema version, running the migrations of shaders.json on them
+func migrateShaderLogRecord(record *shaderLogRecord) error {
+	version := record.Version
+	if version == 0 {
+		version = 1
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("schema version %d is newer than this build supports (%d)", version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return nil
+	}
+
+	shaders := []models.Shader{}
+	for _, op := range record.Ops {
+		if op.Shader != nil {
+			shaders = append(shaders, *op.Shader)
+		}
+	}
+	data, err := json.Marshal(shaders)
+	if err == nil {
+		data, err = migrate(shadersFile, version, data)
+	}
+	// Decoding into a new slice, so that fields a migration dropped are
+	// not left behind
+	var migrated []models.Shader
+	if err == nil {
+		err = json.Unmarshal(data, &migrated)
+	}
+	if err == nil && len(migrated) != len(shaders) {
+		err = fmt.Errorf("migration changed the number of shaders")
+	}
+	if err != nil {
+		return err
+	}
+
+	next := 0
+	for i := range record.Ops {
+		if record.Ops[i].Shader != nil {
+			record.Ops[i].Shader = &migrated[next]
+			next++
+		}
+	}
+	record.Version = SchemaVersion
+	return nil
+}
+
+// encodeLogLine marshals v as a line of a log: the CRC-32 of the JSON in
+// hex, a space and the JSON
+func encodeLogLine(v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)
+	return []byte(line), nil
+}
+
+// verifyLogLine checks a line written by encodeLogLine, without its newline,
+// and returns the JSON it holds
+func verifyLogLine(line []byte) ([]byte, error) {
+	if len(line) < 9 || line[8] != ' ' {
+		return nil, fmt.Errorf("malformed record")
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("malformed checksum")
+	}
+	payload := line[9:]
+	if crc32.ChecksumIEEE(payload) != uint32(sum) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// shaderIDs returns the keys of a set of shaders
+func shaderIDs(shaders map[int]models.Shader) []int {
+	ids := make([]int, 0, len(shaders))
+	for id := range shaders {
+		ids = append(ids, id)
+	}
+	return ids
+}
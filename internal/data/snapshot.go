@@ -0,0 +1,352 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go-server/internal/atomicfile"
+	"go-server/internal/models"
+)
+
+// snapshotFiles are the data files a snapshot holds, besides the revisions
+// directory. API tokens, invites, account tokens and sessions are left out:
+// they are credentials, and a restore must not bring back ones that were
+// revoked or used since.
+var snapshotFiles = []string{usersFile, shadersFile, tagsFile, teamsFile}
+
+// Snapshot returns users.json, shaders.json, tags.json, teams.json and the
+// files of the revisions directory as they would be written now. They are
+// all taken under the read lock, so they agree with each other.
+func (r *Repository) Snapshot() (map[string][]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := make([]models.User, 0, len(r.users))
+	for _, user := range r.users {
+		users = append(users, user)
+	}
+	tags := make([]models.Tag, 0, len(r.tags))
+	for _, tag := range r.tags {
+		tags = append(tags, tag)
+	}
+	teams := make([]models.Team, 0, len(r.teams))
+	for _, team := range r.teams {
+		teams = append(teams, team)
+	}
+	files, err := marshalSnapshot(users, r.shaderListLockFree(), tags, teams)
+	if err != nil {
+		return nil, err
+	}
+	if err := addSnapshotRevisions(files, r.revisions, r.readBlob); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Snapshot reads users, shaders, tags, teams and revisions in one
+// transaction and returns them as the files the JSON storage keeps them in
+func (s *SQLiteStore) Snapshot() (map[string][]byte, error) {
+	var users []models.User
+	var shaders []models.Shader
+	var teams []models.Team
+	tags := []models.Tag{}
+	revisions := make(map[int][]storedRevision)
+	blobs := make(map[string]string)
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		if users, err = queryUsersTx(tx, "1 = 1"); err != nil {
+			return err
+		}
+		if shaders, err = queryShadersTx(tx, selectShaders+" ORDER BY s.id"); err != nil {
+			return err
+		}
+		// Authors are looked up from the owner, never stored
+		for i := range shaders {
+			shaders[i].Author = ""
+		}
+		// The JSON storage keeps the trash in shaders.json too
+		trashed, err := queryTrashTx(tx, "ORDER BY id")
+		if err != nil {
+			return err
+		}
+		shaders = append(shaders, trashed...)
+		sort.Slice(shaders, func(i, j int) bool { return shaders[i].ID < shaders[j].ID })
+
+		if teams, err = queryTeamsTx(tx, "SELECT id, name, created_at FROM teams ORDER BY id"); err != nil {
+			return err
+		}
+
+		stored, err := queryRevisionsTx(tx, "ORDER BY shader_id, number")
+		if err != nil {
+			return err
+		}
+		for _, revision := range stored {
+			revisions[revision.ShaderID] = append(revisions[revision.ShaderID], revision)
+		}
+		blobRows, err := tx.Query("SELECT hash, content FROM shader_blobs")
+		if err != nil {
+			return err
+		}
+		for blobRows.Next() {
+			var hash, content string
+			if err := blobRows.Scan(&hash, &content); err != nil {
+				blobRows.Close()
+				return err
+			}
+			blobs[hash] = content
+		}
+		blobRows.Close()
+		if err := blobRows.Err(); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query("SELECT id, name FROM tags ORDER BY id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var tag models.Tag
+			if err := rows.Scan(&tag.ID, &tag.Name); err != nil {
+				return err
+			}
+			tags = append(tags, tag)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := marshalSnapshot(users, shaders, tags, teams)
+	if err != nil {
+		return nil, err
+	}
+	err = addSnapshotRevisions(files, revisions, func(hash string) (string, error) {
+		content, exists := blobs[hash]
+		if !exists {
+			return "", fmt.Errorf("blob %s is missing", hash)
+		}
+		return content, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func marshalSnapshot(users []models.User, shaders []models.Shader, tags []models.Tag, teams []models.Team) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for name, v := range map[string]interface{}{usersFile: users, shadersFile: shaders, tagsFile: tags, teamsFile: teams} {
+		data, err := encodeDataFile(v)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// addSnapshotRevisions adds the revision log of each shader and the blobs
+// they use to files, named as they are in the revisions directory. read
+// returns the content of a blob.
+func addSnapshotRevisions(files map[string][]byte, revisions map[int][]storedRevision, read func(hash string) (string, error)) error {
+	for shaderID, stored := range revisions {
+		var lines []byte
+		for _, revision := range stored {
+			line, err := encodeLogLine(revision)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line...)
+
+			for _, hash := range revision.hashes() {
+				name := snapshotBlobName(hash)
+				if _, exists := files[name]; exists {
+					continue
+				}
+				content, err := read(hash)
+				if err != nil {
+					return fmt.Errorf("failed to read revisions of shader %d: %w", shaderID, err)
+				}
+				files[name] = []byte(content)
+			}
+		}
+		files[snapshotRevisionLogName(shaderID)] = lines
+	}
+	return nil
+}
+
+// Names of the revisions directory's files in a snapshot, which always use
+// forward slashes
+func snapshotRevisionLogName(shaderID int) string {
+	return path.Join(revisionsDir, strconv.Itoa(shaderID)+".log")
+}
+
+func snapshotBlobName(hash string) string {
+	return path.Join(revisionsDir, objectsDir, hash[:2], hash[2:])
+}
+
+// validateSnapshotRevisions checks the revision logs and blobs in files.
+// Every revision must be of the shader its log is named after, and every
+// blob it uses must be there and match its hash.
+func validateSnapshotRevisions(files map[string][]byte) error {
+	needed := make(map[string]int) // Blob name -> shader ID of a revision using it
+	for name, data := range files {
+		if !strings.HasPrefix(name, revisionsDir+"/") {
+			continue
+		}
+
+		hash := strings.Replace(strings.TrimPrefix(name, revisionsDir+"/"+objectsDir+"/"), "/", "", 1)
+		if len(hash) == sha256.Size*2 && snapshotBlobName(hash) == name {
+			if blobHash(string(data)) != hash {
+				return fmt.Errorf("snapshot blob %s does not match its hash", name)
+			}
+			continue
+		}
+
+		shaderID, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, revisionsDir+"/"), ".log"))
+		if err != nil || shaderID <= 0 || snapshotRevisionLogName(shaderID) != name {
+			return fmt.Errorf("snapshot holds %s, which is not a revision log or blob", name)
+		}
+		for i, line := range bytes.SplitAfter(data, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var stored storedRevision
+			payload, err := verifyLogLine(bytes.TrimSuffix(line, []byte("\n")))
+			if err == nil {
+				err = json.Unmarshal(payload, &stored)
+			}
+			if err == nil {
+				err = stored.validate()
+			}
+			if err == nil && stored.ShaderID != shaderID {
+				err = fmt.Errorf("revision of shader %d", stored.ShaderID)
+			}
+			if err != nil {
+				return fmt.Errorf("snapshot has an unreadable %s at line %d: %w", name, i+1, err)
+			}
+			for _, hash := range stored.hashes() {
+				needed[snapshotBlobName(hash)] = shaderID
+			}
+		}
+	}
+
+	for name, shaderID := range needed {
+		if _, exists := files[name]; !exists {
+			return fmt.Errorf("snapshot is missing %s, used by revisions of shader %d", name, shaderID)
+		}
+	}
+	return nil
+}
+
+// ValidateSnapshot checks that files holds every data file a snapshot needs,
+// each of them readable by this build
+func ValidateSnapshot(files map[string][]byte) error {
+	targets := map[string]interface{}{
+		usersFile:   &[]models.User{},
+		shadersFile: &[]models.Shader{},
+		tagsFile:    &[]models.Tag{},
+		teamsFile:   &[]models.Team{},
+	}
+	for _, name := range snapshotFiles {
+		data, exists := files[name]
+		if !exists {
+			return fmt.Errorf("snapshot has no %s", name)
+		}
+		if _, err := decodeDataFile(name, data, targets[name]); err != nil {
+			return fmt.Errorf("snapshot has an unreadable %s: %w", name, err)
+		}
+	}
+	return validateSnapshotRevisions(files)
+}
+
+// RestoreSnapshot replaces the users, shaders, tags, teams and revisions in
+// a JSON data directory with those from a snapshot, and the shader log with
+// log, which may be empty. The current files are kept as backups, the shader
+// log is moved to shaders.log.bak and the revisions directory to
+// revisions.bak, so that the restore can be undone. The caller must hold the
+// LockDataDir lock, which keeps the server away.
+func RestoreSnapshot(dir string, files map[string][]byte, log []byte, backups int) error {
+	if err := ValidateSnapshot(files); err != nil {
+		return err
+	}
+	if err := ValidateShaderLog(log); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// The revisions are written aside first, and swapped in once the other
+	// files are restored
+	revisionsPath := filepath.Join(dir, revisionsDir)
+	staged := revisionsPath + ".restore"
+	if err := os.RemoveAll(staged); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staged, 0755); err != nil {
+		return err
+	}
+	for name, data := range files {
+		if !strings.HasPrefix(name, revisionsDir+"/") {
+			continue
+		}
+		target := filepath.Join(staged, filepath.FromSlash(strings.TrimPrefix(name, revisionsDir+"/")))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := atomicfile.WriteFile(target, data, 0644, 0); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+
+	// Changes logged since the current shaders.json must not be replayed on
+	// top of the restored one
+	logPath := filepath.Join(dir, shaderLogFile)
+	if err := os.Rename(logPath, logPath+".bak"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, name := range snapshotFiles {
+		perm := os.FileMode(0644)
+		if name == usersFile {
+			perm = usersPerm
+		}
+		if err := atomicfile.WriteFile(filepath.Join(dir, name), files[name], perm, backups); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+	if len(log) > 0 {
+		if err := atomicfile.WriteFile(logPath, log, 0644, 0); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", shaderLogFile, err)
+		}
+	}
+
+	// A restore run again after failing here keeps the first backup
+	if _, err := os.Stat(revisionsPath); err == nil {
+		if err := os.RemoveAll(revisionsPath + ".bak"); err != nil {
+			return err
+		}
+		if err := os.Rename(revisionsPath, revisionsPath+".bak"); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(staged, revisionsPath); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", revisionsDir, err)
+	}
+	return nil
+}
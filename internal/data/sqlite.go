@@ -0,0 +1,731 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// Pure Go SQLite driver, registered as "sqlite"
+	_ "modernc.org/sqlite"
+
+	"go-server/internal/auth"
+	"go-server/internal/models"
+	"go-server/internal/policy"
+)
+
+// sqliteSchemaVersion is stored in the database's user_version so that a
+// database written by a newer server is not misread
+const sqliteSchemaVersion = 4
+
+const sqliteSchema = `
+CREATE TABLE users (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	username       TEXT NOT NULL,
+	username_key   TEXT NOT NULL UNIQUE, -- policy.CanonicalUsername(username)
+	password_hash  TEXT NOT NULL DEFAULT '',
+	email          TEXT NOT NULL DEFAULT '',
+	email_verified INTEGER NOT NULL DEFAULT 0,
+	role           TEXT NOT NULL DEFAULT '',
+	banned         INTEGER NOT NULL DEFAULT 0,
+	totp_secret    TEXT NOT NULL DEFAULT '',
+	totp_enabled   INTEGER NOT NULL DEFAULT 0,
+	totp_last_step INTEGER NOT NULL DEFAULT 0,
+	recovery_codes TEXT NOT NULL DEFAULT 'null' -- JSON array of hashes
+);
+CREATE INDEX users_email ON users (email COLLATE NOCASE);
+
+CREATE TABLE user_identities (
+	issuer  TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	PRIMARY KEY (issuer, subject)
+);
+CREATE INDEX user_identities_user ON user_identities (user_id);
+
+CREATE TABLE tags (
+	id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE COLLATE NOCASE
+);
+
+-- user_id and team_id are 0 for orphaned and personal shaders, so they are
+-- not foreign keys
+CREATE TABLE shaders (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id       INTEGER NOT NULL DEFAULT 0,
+	team_id       INTEGER NOT NULL DEFAULT 0,
+	name          TEXT NOT NULL,
+	author        TEXT NOT NULL DEFAULT '', -- no longer used, see sqliteUpgrades
+	common_script TEXT NOT NULL DEFAULT '',
+	scripts       TEXT NOT NULL DEFAULT '[]' -- JSON array of models.ShaderScript
+);
+CREATE INDEX shaders_user ON shaders (user_id);
+CREATE INDEX shaders_team ON shaders (team_id);
+
+CREATE TABLE shader_tags (
+	shader_id INTEGER NOT NULL REFERENCES shaders (id) ON DELETE CASCADE,
+	tag_id    INTEGER NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+	position  INTEGER NOT NULL,
+	PRIMARY KEY (shader_id, tag_id)
+);
+CREATE INDEX shader_tags_tag ON shader_tags (tag_id);
+
+CREATE TABLE shader_collaborators (
+	shader_id INTEGER NOT NULL REFERENCES shaders (id) ON DELETE CASCADE,
+	user_id   INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	role      TEXT NOT NULL,
+	position  INTEGER NOT NULL,
+	PRIMARY KEY (shader_id, user_id)
+);
+CREATE INDEX shader_collaborators_user ON shader_collaborators (user_id);
+
+CREATE TABLE teams (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	name       TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	created_at TEXT NOT NULL
+);
+
+CREATE TABLE team_members (
+	team_id  INTEGER NOT NULL REFERENCES teams (id) ON DELETE CASCADE,
+	user_id  INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	role     TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (team_id, user_id)
+);
+CREATE INDEX team_members_user ON team_members (user_id);
+
+CREATE TABLE api_tokens (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id      INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	name         TEXT NOT NULL,
+	token_hash   TEXT NOT NULL UNIQUE,
+	scopes       TEXT NOT NULL, -- JSON array
+	created_at   TEXT NOT NULL,
+	expires_at   TEXT,
+	last_used_at TEXT
+);
+CREATE INDEX api_tokens_user ON api_tokens (user_id);
+
+CREATE TABLE account_tokens (
+	token_hash TEXT PRIMARY KEY,
+	user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	purpose    TEXT NOT NULL,
+	email      TEXT NOT NULL DEFAULT '',
+	expires_at TEXT NOT NULL
+);
+CREATE INDEX account_tokens_user ON account_tokens (user_id, purpose);
+
+-- Used invites are kept as a record of who invited whom, so created_by and
+-- used_by are not foreign keys
+CREATE TABLE invites (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	code_hash  TEXT NOT NULL UNIQUE,
+	created_by INTEGER NOT NULL,
+	created_at TEXT NOT NULL,
+	expires_at TEXT,
+	used_by    INTEGER NOT NULL DEFAULT 0,
+	used_at    TEXT
+);
+`
+
+// sqliteUpgrades bring a database from sqliteSchema, which is version 1, up
+// to sqliteSchemaVersion. The first upgrades it to version 2.
+var sqliteUpgrades = []string{
+	// Deleted shaders are kept whole, as JSON of models.Shader, until they
+	// are restored or purged. The owner and team are columns so that
+	// deleting a user or team can update them.
+	`CREATE TABLE shader_trash (
+	id         INTEGER PRIMARY KEY,
+	user_id    INTEGER NOT NULL DEFAULT 0,
+	team_id    INTEGER NOT NULL DEFAULT 0,
+	deleted_at TEXT NOT NULL,
+	shader     TEXT NOT NULL
+);
+CREATE INDEX shader_trash_deleted ON shader_trash (deleted_at);`,
+
+	// Revisions name their code by the hash of a blob, see storedRevision.
+	// shader_id is not a foreign key, as shaders in the trash keep theirs.
+	`CREATE TABLE shader_blobs (
+	hash    TEXT PRIMARY KEY,
+	content TEXT NOT NULL
+);
+CREATE TABLE shader_revisions (
+	shader_id  INTEGER NOT NULL,
+	number     INTEGER NOT NULL,
+	user_id    INTEGER NOT NULL,
+	message    TEXT NOT NULL DEFAULT '',
+	revert_of  INTEGER NOT NULL DEFAULT 0,
+	created_at TEXT NOT NULL,
+	common     TEXT NOT NULL DEFAULT '',
+	scripts    TEXT NOT NULL, -- JSON array of storedScript
+	PRIMARY KEY (shader_id, number)
+);`,
+
+	// Authors are looked up from the owner, as in version 3 of the data
+	// files. The column is only cleared, dropping it needs SQLite 3.35.
+	`UPDATE shaders SET author = '';
+UPDATE shader_trash SET shader = json_remove(shader, '$.author');`,
+}
+
+// sqliteTimeFormat stores times in UTC with a fixed width, so that they sort
+// and compare correctly as text
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// SQLiteStore is the Store that keeps everything in an embedded SQLite
+// database. Every method that changes more than one row runs in a single
+// transaction.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// NewSQLiteStore opens the database at path, creating it with default data
+// if it does not exist yet
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time. A single connection serialises
+	// transactions instead of failing them with SQLITE_BUSY, so no method may
+	// use s.db while it holds a transaction or open rows.
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteStore{db: db}
+	if err := s.initSchema(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// initSchema creates the tables and default data in a new database, or
+// upgrades an older one
+func (s *SQLiteStore) initSchema() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version == sqliteSchemaVersion {
+		return nil
+	}
+	if version > sqliteSchemaVersion {
+		return fmt.Errorf("unsupported schema version %d", version)
+	}
+	if version != 0 {
+		return s.withTx(func(tx *sql.Tx) error {
+			return upgradeSchemaTx(tx, version)
+		})
+	}
+
+	// Hash outside the transaction, argon2 is deliberately slow
+	users := defaultUsers()
+	for i := range users {
+		if err := hashUserPassword(&users[i]); err != nil {
+			return fmt.Errorf("failed to hash password for %s: %w", users[i].Username, err)
+		}
+	}
+
+	return s.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteSchema); err != nil {
+			return err
+		}
+		for _, user := range users {
+			if _, err := createUserTx(tx, user); err != nil {
+				return err
+			}
+		}
+		for _, tag := range defaultTags() {
+			if _, err := tx.Exec("INSERT INTO tags (id, name) VALUES (?, ?)", tag.ID, tag.Name); err != nil {
+				return err
+			}
+		}
+		for _, shader := range defaultShaders() {
+			if _, err := insertShaderTx(tx, shader); err != nil {
+				return err
+			}
+		}
+		return upgradeSchemaTx(tx, 1)
+	})
+}
+
+// upgradeSchemaTx runs the upgrades after version and records the new version
+func upgradeSchemaTx(tx *sql.Tx, version int) error {
+	for v := version + 1; v <= sqliteSchemaVersion; v++ {
+		if _, err := tx.Exec(sqliteUpgrades[v-2]); err != nil {
+			return fmt.Errorf("upgrade to schema version %d failed: %w", v, err)
+		}
+	}
+	_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", sqliteSchemaVersion))
+	return err
+}
+
+// withTx runs fn in a transaction, committing it if fn succeeds
+func (s *SQLiteStore) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Sessions keeps sessions in a table of the same database
+func (s *SQLiteStore) Sessions(config auth.SessionConfig) (auth.SessionStore, error) {
+	return auth.NewSQLiteSessionStore(s.db, config)
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// User methods
+
+const userColumns = "id, username, username_key, password_hash, email, email_verified, role, banned, totp_secret, totp_enabled, totp_last_step, recovery_codes"
+
+// GetUserByUsername looks a user up by username, ignoring case and Unicode
+// normalisation differences
+func (s *SQLiteStore) GetUserByUsername(username string) *models.User {
+	user, err := getUserTx(s.db, "username_key = ?", policy.CanonicalUsername(username))
+	logReadError("user", err)
+	return user
+}
+
+func (s *SQLiteStore) GetUserByID(id int) *models.User {
+	user, err := getUserTx(s.db, "id = ?", id)
+	logReadError("user", err)
+	return user
+}
+
+// GetUserByIdentity returns the user linked to an external identity
+func (s *SQLiteStore) GetUserByIdentity(identity models.ExternalIdentity) *models.User {
+	user, err := getUserTx(s.db, "id = (SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?)",
+		identity.Issuer, identity.Subject)
+	logReadError("user", err)
+	return user
+}
+
+// GetUsersByEmail returns every user with the given email address, compared
+// case-insensitively
+func (s *SQLiteStore) GetUsersByEmail(email string) []models.User {
+	users, err := queryUsersTx(s.db, "email != '' AND email = ? COLLATE NOCASE", email)
+	logReadError("users", err)
+	return users
+}
+
+func (s *SQLiteStore) CreateUser(user models.User) (*models.User, error) {
+	// Hash outside the transaction, argon2 is deliberately slow
+	if err := hashUserPassword(&user); err != nil {
+		return nil, err
+	}
+
+	var created *models.User
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		created, err = createUserTx(tx, user)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// SetPasswordHash replaces a user's password hash
+func (s *SQLiteStore) SetPasswordHash(userID int, hash string) error {
+	return s.updateUser(userID, func(user *models.User) {
+		user.PasswordHash = hash
+	})
+}
+
+// MigrateLegacyPasswords has nothing to do, plaintext passwords are never
+// written to the database
+func (s *SQLiteStore) MigrateLegacyPasswords() (int, error) {
+	return 0, nil
+}
+
+// ChangeUsername renames a user
+func (s *SQLiteStore) ChangeUsername(userID int, username string) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		user, err := getUserTx(tx, "id = ?", userID)
+		if err != nil {
+			return notFound(err, "user not found")
+		}
+		if user.Username == username {
+			return nil
+		}
+		// Changing only the case of your own username is allowed
+		key := policy.CanonicalUsername(username)
+		if existing, err := getUserTx(tx, "username_key = ?", key); err == nil && existing.ID != userID {
+			return fmt.Errorf("username already exists: %s", username)
+		} else if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE users SET username = ?, username_key = ? WHERE id = ?", username, key, userID); err != nil {
+			return fmt.Errorf("failed to save username change: %w", err)
+		}
+		return nil
+	})
+}
+
+// SetEmail changes a user's email address, which then needs verifying again
+func (s *SQLiteStore) SetEmail(userID int, email string) error {
+	return s.updateUser(userID, func(user *models.User) {
+		if !strings.EqualFold(user.Email, email) {
+			user.EmailVerified = false
+		}
+		user.Email = email
+	})
+}
+
+// VerifyEmail marks email as verified if it is still the user's address
+func (s *SQLiteStore) VerifyEmail(userID int, email string) error {
+	user := s.GetUserByID(userID)
+	if user == nil {
+		return fmt.Errorf("user not found")
+	}
+	if !strings.EqualFold(user.Email, email) {
+		return fmt.Errorf("email address has changed since verification was requested")
+	}
+
+	return s.updateUser(userID, func(user *models.User) {
+		user.EmailVerified = true
+	})
+}
+
+// SetRole changes a user's role
+func (s *SQLiteStore) SetRole(userID int, role string) error {
+	return s.updateUser(userID, func(user *models.User) {
+		user.Role = role
+	})
+}
+
+// SetBanned suspends or reinstates a user
+func (s *SQLiteStore) SetBanned(userID int, banned bool) error {
+	return s.updateUser(userID, func(user *models.User) {
+		user.Banned = banned
+	})
+}
+
+// updateUser applies change to a user and saves it in one transaction.
+// change must not modify the username or identities.
+func (s *SQLiteStore) updateUser(userID int, change func(user *models.User)) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		user, err := getUserTx(tx, "id = ?", userID)
+		if err != nil {
+			return notFound(err, "user not found")
+		}
+		change(user)
+		return saveUserTx(tx, *user)
+	})
+}
+
+// DeleteUser removes a user and their API tokens. Their shaders are deleted,
+// orphaned or transferred to transferTo according to disposition, except for
+// shaders a team owns, which stay with the team.
+func (s *SQLiteStore) DeleteUser(userID int, disposition ShaderDisposition, transferTo int) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		if _, err := getUserTx(tx, "id = ?", userID); err != nil {
+			return notFound(err, "user not found")
+		}
+
+		newOwner := 0
+		switch disposition {
+		case DeleteShaders, OrphanShaders:
+		case TransferShaders:
+			recipient, err := getUserTx(tx, "id = ?", transferTo)
+			if err == sql.ErrNoRows || (err == nil && transferTo == userID) {
+				return fmt.Errorf("invalid transfer recipient")
+			}
+			if err != nil {
+				return err
+			}
+			newOwner = recipient.ID
+		default:
+			return fmt.Errorf("unknown shader disposition: %s", disposition)
+		}
+
+		// Stop at the first failure, the transaction is then rolled back
+		var err error
+		exec := func(query string, args ...interface{}) {
+			if err == nil {
+				_, err = tx.Exec(query, args...)
+			}
+		}
+
+		// Team shaders stay with the team, only the owner is forgotten
+		exec("UPDATE shaders SET user_id = 0 WHERE user_id = ? AND team_id != 0", userID)
+		// Their trash is emptied, except for team shaders, which stay in the
+		// team's trash
+		exec("DELETE FROM shader_trash WHERE user_id = ? AND team_id = 0", userID)
+		exec("UPDATE shader_trash SET user_id = 0 WHERE user_id = ?", userID)
+		if disposition == DeleteShaders {
+			exec("DELETE FROM shader_tags WHERE shader_id IN (SELECT id FROM shaders WHERE user_id = ?)", userID)
+			exec("DELETE FROM shader_collaborators WHERE shader_id IN (SELECT id FROM shaders WHERE user_id = ?)", userID)
+			exec("DELETE FROM shaders WHERE user_id = ?", userID)
+		} else {
+			exec("UPDATE shaders SET user_id = ? WHERE user_id = ?", newOwner, userID)
+		}
+		exec("DELETE FROM shader_collaborators WHERE user_id = ?", userID)
+		if disposition == TransferShaders {
+			// The recipient cannot also collaborate on shaders they now own
+			exec("DELETE FROM shader_collaborators WHERE user_id = ? AND shader_id IN (SELECT id FROM shaders WHERE user_id = ? AND team_id = 0)", newOwner, newOwner)
+		}
+		if err == nil {
+			err = leaveTeamsTx(tx, userID)
+		}
+		exec("DELETE FROM api_tokens WHERE user_id = ?", userID)
+		exec("DELETE FROM account_tokens WHERE user_id = ?", userID)
+		exec("DELETE FROM user_identities WHERE user_id = ?", userID)
+		exec("DELETE FROM users WHERE id = ?", userID)
+		if err == nil {
+			err = pruneRevisionsTx(tx)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+		return nil
+	})
+}
+
+// LinkIdentity links an external identity to an existing user
+func (s *SQLiteStore) LinkIdentity(userID int, identity models.ExternalIdentity) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		if _, err := getUserTx(tx, "id = ?", userID); err != nil {
+			return notFound(err, "user not found")
+		}
+
+		var linked int
+		err := tx.QueryRow("SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?",
+			identity.Issuer, identity.Subject).Scan(&linked)
+		if err == nil {
+			if linked == userID {
+				return nil
+			}
+			return fmt.Errorf("identity already linked to another user")
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO user_identities (issuer, subject, user_id) VALUES (?, ?, ?)",
+			identity.Issuer, identity.Subject, userID)
+		return err
+	})
+}
+
+// createUserTx inserts a user, with the ID it already has if it is not 0
+func createUserTx(tx *sql.Tx, user models.User) (*models.User, error) {
+	key := policy.CanonicalUsername(user.Username)
+	var exists int
+	err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE username_key = ?", key).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists > 0 {
+		return nil, fmt.Errorf("username already exists: %s", user.Username)
+	}
+	for _, identity := range user.Identities {
+		err := tx.QueryRow("SELECT COUNT(*) FROM user_identities WHERE issuer = ? AND subject = ?",
+			identity.Issuer, identity.Subject).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if exists > 0 {
+			return nil, fmt.Errorf("identity already linked to another user")
+		}
+	}
+
+	recoveryCodes, err := json.Marshal(user.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec("INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		nullID(user.ID), user.Username, key, user.PasswordHash, user.Email, user.EmailVerified, user.Role,
+		user.Banned, user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep, string(recoveryCodes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to save users: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	user.ID = int(id)
+
+	for _, identity := range user.Identities {
+		_, err := tx.Exec("INSERT INTO user_identities (issuer, subject, user_id) VALUES (?, ?, ?)",
+			identity.Issuer, identity.Subject, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save users: %w", err)
+		}
+	}
+
+	return &user, nil
+}
+
+// saveUserTx writes every field of an existing user except the username and
+// identities, which change through their own methods
+func saveUserTx(tx *sql.Tx, user models.User) error {
+	recoveryCodes, err := json.Marshal(user.RecoveryCodes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE users SET password_hash = ?, email = ?, email_verified = ?, role = ?, banned = ?,
+		totp_secret = ?, totp_enabled = ?, totp_last_step = ?, recovery_codes = ? WHERE id = ?`,
+		user.PasswordHash, user.Email, user.EmailVerified, user.Role, user.Banned,
+		user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep, string(recoveryCodes), user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to save users: %w", err)
+	}
+	return nil
+}
+
+// getUserTx returns the user matching where, or sql.ErrNoRows
+func getUserTx(q querier, where string, args ...interface{}) (*models.User, error) {
+	user, err := scanUser(q.QueryRow("SELECT "+userColumns+" FROM users WHERE "+where, args...))
+	if err != nil {
+		return nil, err
+	}
+	if user.Identities, err = identitiesTx(q, user.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// queryUsersTx returns every user matching where, ordered by ID
+func queryUsersTx(q querier, where string, args ...interface{}) ([]models.User, error) {
+	rows, err := q.Query("SELECT "+userColumns+" FROM users WHERE "+where+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	var users []models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Only one connection is open, so identities are read once the rows
+	// above are closed
+	for i := range users {
+		if users[i].Identities, err = identitiesTx(q, users[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+func scanUser(row rowScanner) (*models.User, error) {
+	var user models.User
+	var key, recoveryCodes string
+	err := row.Scan(&user.ID, &user.Username, &key, &user.PasswordHash, &user.Email, &user.EmailVerified,
+		&user.Role, &user.Banned, &user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep, &recoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(recoveryCodes), &user.RecoveryCodes); err != nil {
+		return nil, fmt.Errorf("invalid recovery codes for user %d: %w", user.ID, err)
+	}
+	return &user, nil
+}
+
+func identitiesTx(q querier, userID int) ([]models.ExternalIdentity, error) {
+	rows, err := q.Query("SELECT issuer, subject FROM user_identities WHERE user_id = ? ORDER BY rowid", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []models.ExternalIdentity
+	for rows.Next() {
+		var identity models.ExternalIdentity
+		if err := rows.Scan(&identity.Issuer, &identity.Subject); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// nullID lets SQLite pick the next ID for a row whose ID is 0
+func nullID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// notFound turns sql.ErrNoRows into an error with the given message, which
+// matches what Repository returns
+func notFound(err error, message string) error {
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%s", message)
+	}
+	return err
+}
+
+// logReadError reports an unexpected error from a method that, like its
+// Repository counterpart, returns nil rather than an error
+func logReadError(what string, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Printf("Warning: Could not read %s: %v\n", what, err)
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// formatOptionalTime returns NULL for a nil time
+func formatOptionalTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return formatTime(*t)
+}
+
+func parseTime(value string) (time.Time, error) {
+	return time.Parse(sqliteTimeFormat, value)
+}
+
+func parseOptionalTime(value sql.NullString) (*time.Time, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+	t, err := parseTime(value.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,119 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"go-server/internal/models"
+)
+
+// Revision methods
+
+const revisionColumns = "shader_id, number, user_id, message, revert_of, created_at, common, scripts"
+
+// GetShaderRevisions returns the revisions of a shader without their code,
+// newest first
+func (s *SQLiteStore) GetShaderRevisions(shaderID int) []models.ShaderRevision {
+	stored, err := queryRevisionsTx(s.db, "WHERE shader_id = ? ORDER BY number DESC", shaderID)
+	logReadError("revisions", err)
+	revisions := make([]models.ShaderRevision, 0, len(stored))
+	for _, revision := range stored {
+		revisions = append(revisions, revision.summary())
+	}
+	return revisions
+}
+
+// GetShaderRevision returns a revision of a shader with its code, or nil if
+// there is no such revision
+func (s *SQLiteStore) GetShaderRevision(shaderID, number int) *models.ShaderRevision {
+	var revision *models.ShaderRevision
+	err := s.withTx(func(tx *sql.Tx) error {
+		stored, err := queryRevisionsTx(tx, "WHERE shader_id = ? AND number = ?", shaderID, number)
+		if err != nil || len(stored) == 0 {
+			return err
+		}
+		revision, err = stored[0].expand(func(hash string) (string, error) {
+			var content string
+			err := tx.QueryRow("SELECT content FROM shader_blobs WHERE hash = ?", hash).Scan(&content)
+			if err == sql.ErrNoRows {
+				return "", fmt.Errorf("blob %s is missing", hash)
+			}
+			return content, err
+		})
+		return err
+	})
+	logReadError("revision", err)
+	return revision
+}
+
+// recordRevisionsTx records the revisions of a save of shader, see
+// pendingRevisions
+func recordRevisionsTx(tx *sql.Tx, previous *models.Shader, shader models.Shader, revision models.ShaderRevision) error {
+	var latest int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(number), 0) FROM shader_revisions WHERE shader_id = ?", shader.ID).Scan(&latest); err != nil {
+		return err
+	}
+	revisions, blobs := pendingRevisions(previous, shader, latest, revision)
+
+	for hash, content := range blobs {
+		if _, err := tx.Exec("INSERT INTO shader_blobs (hash, content) VALUES (?, ?) ON CONFLICT (hash) DO NOTHING", hash, content); err != nil {
+			return err
+		}
+	}
+	for _, stored := range revisions {
+		scripts, err := json.Marshal(stored.Scripts)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO shader_revisions ("+revisionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			stored.ShaderID, stored.Number, stored.UserID, stored.Message, stored.RevertOf,
+			formatTime(stored.CreatedAt), stored.Common, string(scripts))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneRevisionsTx removes the revisions of shaders that no longer exist,
+// along with the blobs only they used
+func pruneRevisionsTx(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM shader_revisions
+		WHERE shader_id NOT IN (SELECT id FROM shaders) AND shader_id NOT IN (SELECT id FROM shader_trash)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM shader_blobs WHERE hash NOT IN (
+		SELECT common FROM shader_revisions
+		UNION SELECT json_extract(script.value, '$.code') FROM shader_revisions, json_each(shader_revisions.scripts) AS script)`)
+	return err
+}
+
+// queryRevisionsTx returns the revisions selected by the rest of a query
+func queryRevisionsTx(q querier, rest string, args ...interface{}) ([]storedRevision, error) {
+	rows, err := q.Query("SELECT "+revisionColumns+" FROM shader_revisions "+rest, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []storedRevision
+	for rows.Next() {
+		var stored storedRevision
+		var createdAt, scripts string
+		err := rows.Scan(&stored.ShaderID, &stored.Number, &stored.UserID, &stored.Message, &stored.RevertOf,
+			&createdAt, &stored.Common, &scripts)
+		if err != nil {
+			return nil, err
+		}
+		if stored.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(scripts), &stored.Scripts); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, stored)
+	}
+	return revisions, rows.Err()
+}
@@ -0,0 +1,477 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// Shader methods
+
+const shaderColumns = "id, user_id, team_id, name, common_script, scripts"
+
+// selectShaders reads the shaders s with their owner's current username as
+// the Author, which is never stored
+const selectShaders = `SELECT s.id, s.user_id, s.team_id, s.name, COALESCE(u.username, 'Unknown'),
+	s.common_script, s.scripts FROM shaders s LEFT JOIN users u ON u.id = s.user_id`
+
+// GetShaderByID returns a shader with its owner's current username as the
+// Author, or nil if it does not exist
+func (s *SQLiteStore) GetShaderByID(id int) *models.Shader {
+	shader, err := getShaderTx(s.db, id)
+	logReadError("shader", err)
+	return shader
+}
+
+func (s *SQLiteStore) CreateShader(shader models.Shader, revision models.ShaderRevision) (*models.Shader, error) {
+	var created *models.Shader
+	err := s.withTx(func(tx *sql.Tx) error {
+		tags, err := processTagsTx(tx, shader.Tags)
+		if err != nil {
+			return err
+		}
+		shader.Tags = tags
+		shader.ID = 0
+
+		if created, err = insertShaderTx(tx, shader); err != nil {
+			return err
+		}
+		return recordRevisionsTx(tx, nil, *created, revision)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (s *SQLiteStore) UpdateShader(id int, shader models.Shader, revision *models.ShaderRevision) (*models.Shader, error) {
+	err := s.withTx(func(tx *sql.Tx) error {
+		previous, err := getShaderTx(tx, id)
+		if err != nil {
+			return notFound(err, "shader not found")
+		}
+
+		tags, err := processTagsTx(tx, shader.Tags)
+		if err != nil {
+			return err
+		}
+		shader.Tags = tags
+		shader.ID = id
+
+		scripts, err := json.Marshal(shader.ShaderScripts)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE shaders SET user_id = ?, team_id = ?, name = ?, common_script = ?, scripts = ? WHERE id = ?",
+			shader.UserID, shader.TeamID, shader.Name, shader.CommonScript, string(scripts), id)
+		if err != nil {
+			return err
+		}
+		if err := saveShaderChildrenTx(tx, shader); err != nil {
+			return err
+		}
+		if revision == nil {
+			return nil
+		}
+		return recordRevisionsTx(tx, previous, shader, *revision)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &shader, nil
+}
+
+// DeleteShader moves a shader to the trash, from where it can be restored
+// until it is purged
+func (s *SQLiteStore) DeleteShader(id int) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		shader, err := getShaderTx(tx, id)
+		if err != nil {
+			return notFound(err, "shader not found")
+		}
+		if err := trashShaderTx(tx, *shader, time.Now()); err != nil {
+			return err
+		}
+
+		for _, query := range []string{
+			"DELETE FROM shader_tags WHERE shader_id = ?",
+			"DELETE FROM shader_collaborators WHERE shader_id = ?",
+			"DELETE FROM shaders WHERE id = ?",
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SearchShaders finds shaders matching params, ordered by ID. The Author of
+// each result is its owner's current username.
+func (s *SQLiteStore) SearchShaders(params models.SearchParams) []models.Shader {
+	var conditions []string
+	var args []interface{}
+
+	// Query is inclusive - search across shader names, usernames, and tag names
+	if params.Query != "" {
+		query := strings.ToLower(params.Query)
+		conditions = append(conditions, `(instr(lower(s.name), ?) > 0
+			OR EXISTS (SELECT 1 FROM users u WHERE u.id = s.user_id AND instr(lower(u.username), ?) > 0)
+			OR EXISTS (SELECT 1 FROM shader_tags st JOIN tags t ON t.id = st.tag_id WHERE st.shader_id = s.id AND instr(lower(t.name), ?) > 0))`)
+		args = append(args, query, query, query)
+	}
+	if params.UserID != 0 {
+		conditions = append(conditions, "s.user_id = ?")
+		args = append(args, params.UserID)
+	}
+	if params.TeamID != 0 {
+		conditions = append(conditions, "s.team_id = ?")
+		args = append(args, params.TeamID)
+	}
+	if params.SharedWith != 0 {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM shader_collaborators c WHERE c.shader_id = s.id AND c.user_id = ?)")
+		args = append(args, params.SharedWith)
+	}
+	// Shaders must have ALL specified tags, tag names ignore case
+	for _, tagName := range params.Tags {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM shader_tags st JOIN tags t ON t.id = st.tag_id WHERE st.shader_id = s.id AND t.name = ?)")
+		args = append(args, tagName)
+	}
+
+	where := "1"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = -1 // No limit
+	}
+	offset := params.Offset
+	if offset < 0 {
+		offset = 0
+	}
+	args = append(args, limit, offset)
+
+	shaders, err := queryShadersTx(s.db, selectShaders+" WHERE "+where+" ORDER BY s.id LIMIT ? OFFSET ?", args...)
+	logReadError("shaders", err)
+	return shaders
+}
+
+// SetCollaborator gives a user a role on a shader, or changes their existing
+// role. The owner cannot also be a collaborator.
+func (s *SQLiteStore) SetCollaborator(shaderID, userID int, role string) (*models.Shader, error) {
+	var shader *models.Shader
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		if shader, err = getShaderTx(tx, shaderID); err != nil {
+			return notFound(err, "shader not found")
+		}
+		if _, err := getUserTx(tx, "id = ?", userID); err != nil {
+			return notFound(err, "user not found")
+		}
+		if shader.UserID == userID {
+			return fmt.Errorf("the owner cannot be a collaborator")
+		}
+
+		_, err = tx.Exec(`INSERT INTO shader_collaborators (shader_id, user_id, role, position)
+			VALUES (?, ?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM shader_collaborators WHERE shader_id = ?))
+			ON CONFLICT (shader_id, user_id) DO UPDATE SET role = excluded.role`,
+			shaderID, userID, role, shaderID)
+		if err != nil {
+			return err
+		}
+		shader, err = getShaderTx(tx, shaderID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shader, nil
+}
+
+// RemoveCollaborator takes a user's role on a shader away
+func (s *SQLiteStore) RemoveCollaborator(shaderID, userID int) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		if err := shaderExistsTx(tx, shaderID); err != nil {
+			return err
+		}
+		result, err := tx.Exec("DELETE FROM shader_collaborators WHERE shader_id = ? AND user_id = ?", shaderID, userID)
+		if err != nil {
+			return err
+		}
+		if removed, err := result.RowsAffected(); err != nil {
+			return err
+		} else if removed == 0 {
+			return fmt.Errorf("collaborator not found")
+		}
+		return nil
+	})
+}
+
+// Tag methods
+func (s *SQLiteStore) GetAllTags() []models.Tag {
+	rows, err := s.db.Query("SELECT id, name FROM tags ORDER BY name COLLATE BINARY")
+	if err != nil {
+		logReadError("tags", err)
+		return []models.Tag{}
+	}
+	defer rows.Close()
+
+	tags := []models.Tag{}
+	for rows.Next() {
+		var tag models.Tag
+		if err := rows.Scan(&tag.ID, &tag.Name); err != nil {
+			logReadError("tags", err)
+			break
+		}
+		tags = append(tags, tag)
+	}
+	logReadError("tags", rows.Err())
+	return tags
+}
+
+// GetTagByID returns a tag, or nil if it does not exist
+func (s *SQLiteStore) GetTagByID(id int) *models.Tag {
+	var tag models.Tag
+	err := s.db.QueryRow("SELECT id, name FROM tags WHERE id = ?", id).Scan(&tag.ID, &tag.Name)
+	if err != nil {
+		logReadError("tag", err)
+		return nil
+	}
+	return &tag
+}
+
+// RenameTag changes a tag's name everywhere it is used
+func (s *SQLiteStore) RenameTag(id int, name string) (*models.Tag, error) {
+	tag := models.Tag{ID: id, Name: name}
+	err := s.withTx(func(tx *sql.Tx) error {
+		var existing int
+		if err := tx.QueryRow("SELECT id FROM tags WHERE id = ?", id).Scan(&existing); err != nil {
+			return notFound(err, "tag not found")
+		}
+		err := tx.QueryRow("SELECT id FROM tags WHERE name = ? AND id != ?", name, id).Scan(&existing)
+		if err == nil {
+			return fmt.Errorf("tag already exists: %s", name)
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		// Shaders refer to tags by ID, so they pick up the new name
+		if _, err := tx.Exec("UPDATE tags SET name = ? WHERE id = ?", name, id); err != nil {
+			return fmt.Errorf("failed to save tags: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+// DeleteTag removes a tag and takes it off every shader that had it
+func (s *SQLiteStore) DeleteTag(id int) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM shader_tags WHERE tag_id = ?", id); err != nil {
+			return fmt.Errorf("failed to save shaders: %w", err)
+		}
+		result, err := tx.Exec("DELETE FROM tags WHERE id = ?", id)
+		if err != nil {
+			return fmt.Errorf("failed to save tags: %w", err)
+		}
+		if removed, err := result.RowsAffected(); err != nil {
+			return err
+		} else if removed == 0 {
+			return fmt.Errorf("tag not found")
+		}
+		return nil
+	})
+}
+
+// processTagsTx looks up each named tag, creating those that do not exist
+// yet, and returns them with their IDs. Empty and repeated names are dropped.
+func processTagsTx(tx *sql.Tx, tags []models.Tag) ([]models.Tag, error) {
+	var processedTags []models.Tag
+	seen := make(map[int]bool)
+
+	for _, tag := range tags {
+		tagName := strings.TrimSpace(tag.Name)
+		if tagName == "" {
+			continue // Skip empty tag names
+		}
+
+		existing := models.Tag{Name: tagName}
+		err := tx.QueryRow("SELECT id, name FROM tags WHERE name = ?", tagName).Scan(&existing.ID, &existing.Name)
+		if err == sql.ErrNoRows {
+			result, err := tx.Exec("INSERT INTO tags (name) VALUES (?)", tagName)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create tag '%s': %v", tagName, err)
+			}
+			id, err := result.LastInsertId()
+			if err != nil {
+				return nil, err
+			}
+			existing.ID = int(id)
+		} else if err != nil {
+			return nil, err
+		}
+
+		if seen[existing.ID] {
+			continue
+		}
+		seen[existing.ID] = true
+		processedTags = append(processedTags, existing)
+	}
+
+	return processedTags, nil
+}
+
+// insertShaderTx inserts a shader whose tags already have IDs, with the ID
+// it already has if it is not 0
+func insertShaderTx(tx *sql.Tx, shader models.Shader) (*models.Shader, error) {
+	scripts, err := json.Marshal(shader.ShaderScripts)
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec("INSERT INTO shaders ("+shaderColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+		nullID(shader.ID), shader.UserID, shader.TeamID, shader.Name, shader.CommonScript, string(scripts))
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	shader.ID = int(id)
+
+	if err := saveShaderChildrenTx(tx, shader); err != nil {
+		return nil, err
+	}
+	return &shader, nil
+}
+
+// saveShaderChildrenTx replaces the shader's tags and collaborators, keeping
+// their order
+func saveShaderChildrenTx(tx *sql.Tx, shader models.Shader) error {
+	if _, err := tx.Exec("DELETE FROM shader_tags WHERE shader_id = ?", shader.ID); err != nil {
+		return err
+	}
+	for i, tag := range shader.Tags {
+		_, err := tx.Exec("INSERT INTO shader_tags (shader_id, tag_id, position) VALUES (?, ?, ?)", shader.ID, tag.ID, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM shader_collaborators WHERE shader_id = ?", shader.ID); err != nil {
+		return err
+	}
+	for i, collaborator := range shader.Collaborators {
+		_, err := tx.Exec("INSERT INTO shader_collaborators (shader_id, user_id, role, position) VALUES (?, ?, ?, ?)",
+			shader.ID, collaborator.UserID, collaborator.Role, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shaderExistsTx(q querier, id int) error {
+	var exists int
+	if err := q.QueryRow("SELECT COUNT(*) FROM shaders WHERE id = ?", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return fmt.Errorf("shader not found")
+	}
+	return nil
+}
+
+// getShaderTx returns a shader with its tags and collaborators, or
+// sql.ErrNoRows
+func getShaderTx(q querier, id int) (*models.Shader, error) {
+	shaders, err := queryShadersTx(q, selectShaders+" WHERE s.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(shaders) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &shaders[0], nil
+}
+
+// queryShadersTx runs a query starting with selectShaders and fills in the tags
+// and collaborators of each shader it returns
+func queryShadersTx(q querier, query string, args ...interface{}) ([]models.Shader, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var shaders []models.Shader
+	for rows.Next() {
+		var shader models.Shader
+		var scripts string
+		err := rows.Scan(&shader.ID, &shader.UserID, &shader.TeamID, &shader.Name, &shader.Author,
+			&shader.CommonScript, &scripts)
+		if err == nil {
+			err = json.Unmarshal([]byte(scripts), &shader.ShaderScripts)
+		}
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		shaders = append(shaders, shader)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Only one connection is open, so the children are read once the rows
+	// above are closed
+	for i := range shaders {
+		if err := loadShaderChildrenTx(q, &shaders[i]); err != nil {
+			return nil, err
+		}
+	}
+	return shaders, nil
+}
+
+func loadShaderChildrenTx(q querier, shader *models.Shader) error {
+	rows, err := q.Query(`SELECT t.id, t.name FROM shader_tags st JOIN tags t ON t.id = st.tag_id
+		WHERE st.shader_id = ? ORDER BY st.position`, shader.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var tag models.Tag
+		if err := rows.Scan(&tag.ID, &tag.Name); err != nil {
+			rows.Close()
+			return err
+		}
+		shader.Tags = append(shader.Tags, tag)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = q.Query("SELECT user_id, role FROM shader_collaborators WHERE shader_id = ? ORDER BY position", shader.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var collaborator models.Collaborator
+		if err := rows.Scan(&collaborator.UserID, &collaborator.Role); err != nil {
+			return err
+		}
+		shader.Collaborators = append(shader.Collaborators, collaborator)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,337 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// Team methods
+
+// GetTeamByID returns a team, or nil if it does not exist
+func (s *SQLiteStore) GetTeamByID(id int) *models.Team {
+	team, err := getTeamTx(s.db, id)
+	logReadError("team", err)
+	return team
+}
+
+// GetTeams returns all teams, or only those userID belongs to if it is not 0,
+// sorted by name
+func (s *SQLiteStore) GetTeams(userID int) []models.Team {
+	query := "SELECT id, name, created_at FROM teams ORDER BY lower(name)"
+	var args []interface{}
+	if userID != 0 {
+		query = "SELECT id, name, created_at FROM teams WHERE id IN (SELECT team_id FROM team_members WHERE user_id = ?) ORDER BY lower(name)"
+		args = append(args, userID)
+	}
+
+	teams, err := queryTeamsTx(s.db, query, args...)
+	if err != nil {
+		logReadError("teams", err)
+		return []models.Team{}
+	}
+	return teams
+}
+
+// CreateTeam stores a new team with ownerID as its only member
+func (s *SQLiteStore) CreateTeam(name string, ownerID int, createdAt time.Time) (*models.Team, error) {
+	var team *models.Team
+	err := s.withTx(func(tx *sql.Tx) error {
+		if taken, err := teamNameTakenTx(tx, name, 0); err != nil {
+			return err
+		} else if taken {
+			return fmt.Errorf("team name already exists: %s", name)
+		}
+		if _, err := getUserTx(tx, "id = ?", ownerID); err != nil {
+			return notFound(err, "user not found")
+		}
+
+		result, err := tx.Exec("INSERT INTO teams (name, created_at) VALUES (?, ?)", name, formatTime(createdAt))
+		if err != nil {
+			return fmt.Errorf("failed to save teams: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO team_members (team_id, user_id, role, position) VALUES (?, ?, ?, 0)",
+			id, ownerID, models.TeamRoleOwner)
+		if err != nil {
+			return fmt.Errorf("failed to save teams: %w", err)
+		}
+
+		team, err = getTeamTx(tx, int(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// RenameTeam changes a team's name
+func (s *SQLiteStore) RenameTeam(id int, name string) (*models.Team, error) {
+	var team *models.Team
+	err := s.withTx(func(tx *sql.Tx) error {
+		if err := teamExistsTx(tx, id); err != nil {
+			return err
+		}
+		if taken, err := teamNameTakenTx(tx, name, id); err != nil {
+			return err
+		} else if taken {
+			return fmt.Errorf("team name already exists: %s", name)
+		}
+
+		if _, err := tx.Exec("UPDATE teams SET name = ? WHERE id = ?", name, id); err != nil {
+			return fmt.Errorf("failed to save teams: %w", err)
+		}
+		var err error
+		team, err = getTeamTx(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// DeleteTeam removes a team, emptying its trash. Teams that still own
+// shaders cannot be deleted.
+func (s *SQLiteStore) DeleteTeam(id int) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		if err := teamExistsTx(tx, id); err != nil {
+			return err
+		}
+		var shaders int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM shaders WHERE team_id = ?", id).Scan(&shaders); err != nil {
+			return err
+		}
+		if shaders > 0 {
+			return fmt.Errorf("team still owns shaders")
+		}
+
+		// The team's trash goes with it
+		if _, err := tx.Exec("DELETE FROM shader_trash WHERE team_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM team_members WHERE team_id = ?", id); err != nil {
+			return fmt.Errorf("failed to save teams: %w", err)
+		}
+		if _, err := tx.Exec("DELETE FROM teams WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to save teams: %w", err)
+		}
+		return pruneRevisionsTx(tx)
+	})
+}
+
+// SetTeamMember adds a user to a team or changes their role. A team always
+// keeps at least one owner.
+func (s *SQLiteStore) SetTeamMember(teamID, userID int, role string) (*models.Team, error) {
+	var team *models.Team
+	err := s.withTx(func(tx *sql.Tx) error {
+		if err := teamExistsTx(tx, teamID); err != nil {
+			return err
+		}
+		if _, err := getUserTx(tx, "id = ?", userID); err != nil {
+			return notFound(err, "user not found")
+		}
+
+		_, err := tx.Exec(`INSERT INTO team_members (team_id, user_id, role, position)
+			VALUES (?, ?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM team_members WHERE team_id = ?))
+			ON CONFLICT (team_id, user_id) DO UPDATE SET role = excluded.role`,
+			teamID, userID, role, teamID)
+		if err != nil {
+			return fmt.Errorf("failed to save teams: %w", err)
+		}
+
+		if team, err = getTeamTx(tx, teamID); err != nil {
+			return err
+		}
+		if !hasTeamOwner(*team) {
+			return fmt.Errorf("team must keep at least one owner")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// RemoveTeamMember takes a user out of a team. The last owner cannot leave
+// while there are other members.
+func (s *SQLiteStore) RemoveTeamMember(teamID, userID int) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		if err := teamExistsTx(tx, teamID); err != nil {
+			return err
+		}
+
+		result, err := tx.Exec("DELETE FROM team_members WHERE team_id = ? AND user_id = ?", teamID, userID)
+		if err != nil {
+			return fmt.Errorf("failed to save teams: %w", err)
+		}
+		if removed, err := result.RowsAffected(); err != nil {
+			return err
+		} else if removed == 0 {
+			return fmt.Errorf("member not found")
+		}
+
+		team, err := getTeamTx(tx, teamID)
+		if err != nil {
+			return err
+		}
+		if len(team.Members) > 0 && !hasTeamOwner(*team) {
+			return fmt.Errorf("team must keep at least one owner")
+		}
+		return nil
+	})
+}
+
+// SetShaderTeam moves a shader into a team, or out of it to userID when
+// teamID is 0
+func (s *SQLiteStore) SetShaderTeam(shaderID, teamID, userID int) (*models.Shader, error) {
+	var shader *models.Shader
+	err := s.withTx(func(tx *sql.Tx) error {
+		if err := shaderExistsTx(tx, shaderID); err != nil {
+			return err
+		}
+
+		var err error
+		if teamID != 0 {
+			if err := teamExistsTx(tx, teamID); err != nil {
+				return err
+			}
+			_, err = tx.Exec("UPDATE shaders SET team_id = ? WHERE id = ?", teamID, shaderID)
+		} else {
+			if _, err := getUserTx(tx, "id = ?", userID); err != nil {
+				return notFound(err, "user not found")
+			}
+			_, err = tx.Exec("UPDATE shaders SET team_id = 0, user_id = ? WHERE id = ?", userID, shaderID)
+			if err == nil {
+				_, err = tx.Exec("DELETE FROM shader_collaborators WHERE shader_id = ? AND user_id = ?", shaderID, userID)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save shaders: %w", err)
+		}
+
+		shader, err = getShaderTx(tx, shaderID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shader, nil
+}
+
+// leaveTeamsTx takes a user out of every team, promoting the longest
+// standing remaining member of any team left without an owner
+func leaveTeamsTx(tx *sql.Tx, userID int) error {
+	teams, err := queryTeamsTx(tx, "SELECT id, name, created_at FROM teams WHERE id IN (SELECT team_id FROM team_members WHERE user_id = ?)", userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM team_members WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	for _, team := range teams {
+		if !removeTeamMember(&team, userID) || len(team.Members) == 0 || team.Members[0].Role != models.TeamRoleOwner {
+			continue
+		}
+		// removeTeamMember may have promoted the first remaining member
+		_, err := tx.Exec("UPDATE team_members SET role = ? WHERE team_id = ? AND user_id = ?",
+			models.TeamRoleOwner, team.ID, team.Members[0].UserID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func teamExistsTx(q querier, id int) error {
+	var exists int
+	if err := q.QueryRow("SELECT COUNT(*) FROM teams WHERE id = ?", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return fmt.Errorf("team not found")
+	}
+	return nil
+}
+
+// teamNameTakenTx reports whether another team than exceptID has name,
+// ignoring case
+func teamNameTakenTx(q querier, name string, exceptID int) (bool, error) {
+	var taken int
+	err := q.QueryRow("SELECT COUNT(*) FROM teams WHERE name = ? AND id != ?", name, exceptID).Scan(&taken)
+	return taken > 0, err
+}
+
+// getTeamTx returns a team with its members, or sql.ErrNoRows
+func getTeamTx(q querier, id int) (*models.Team, error) {
+	teams, err := queryTeamsTx(q, "SELECT id, name, created_at FROM teams WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(teams) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &teams[0], nil
+}
+
+// queryTeamsTx runs a query selecting id, name and created_at from teams
+// and fills in the members of each team it returns
+func queryTeamsTx(q querier, query string, args ...interface{}) ([]models.Team, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	teams := []models.Team{}
+	for rows.Next() {
+		var team models.Team
+		var createdAt string
+		err := rows.Scan(&team.ID, &team.Name, &createdAt)
+		if err == nil {
+			team.CreatedAt, err = parseTime(createdAt)
+		}
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		teams = append(teams, team)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Only one connection is open, so members are read once the rows above
+	// are closed
+	for i := range teams {
+		if teams[i].Members, err = teamMembersTx(q, teams[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return teams, nil
+}
+
+func teamMembersTx(q querier, teamID int) ([]models.TeamMember, error) {
+	rows, err := q.Query("SELECT user_id, role FROM team_members WHERE team_id = ? ORDER BY position", teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.TeamMember{}
+	for rows.Next() {
+		var member models.TeamMember
+		if err := rows.Scan(&member.UserID, &member.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
@@ -0,0 +1,344 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// API token methods
+
+const apiTokenColumns = "id, user_id, name, token_hash, scopes, created_at, expires_at, last_used_at"
+
+// CreateAPIToken stores a new token. The caller is responsible for hashing it.
+func (s *SQLiteStore) CreateAPIToken(token models.APIToken) (*models.APIToken, error) {
+	scopes, err := json.Marshal(token.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.withTx(func(tx *sql.Tx) error {
+		if _, err := getAPITokenTx(tx, "token_hash = ?", token.TokenHash); err == nil {
+			return fmt.Errorf("token already exists")
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		result, err := tx.Exec("INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			token.UserID, token.Name, token.TokenHash, string(scopes), formatTime(token.CreatedAt),
+			formatOptionalTime(token.ExpiresAt), formatOptionalTime(token.LastUsedAt))
+		if err != nil {
+			return fmt.Errorf("failed to save tokens: %w", err)
+		}
+		id, err := result.LastInsertId()
+		token.ID = int(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// GetAPITokenByHash returns the token with the given hash, expired or not
+func (s *SQLiteStore) GetAPITokenByHash(hash string) *models.APIToken {
+	token, err := getAPITokenTx(s.db, "token_hash = ?", hash)
+	logReadError("API token", err)
+	return token
+}
+
+// GetAPITokensByUser returns a user's tokens, newest first
+func (s *SQLiteStore) GetAPITokensByUser(userID int) []models.APIToken {
+	rows, err := s.db.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC", userID)
+	if err != nil {
+		logReadError("API tokens", err)
+		return []models.APIToken{}
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			logReadError("API tokens", err)
+			break
+		}
+		tokens = append(tokens, *token)
+	}
+	logReadError("API tokens", rows.Err())
+	return tokens
+}
+
+// DeleteAPIToken revokes one of a user's tokens
+func (s *SQLiteStore) DeleteAPIToken(userID, id int) error {
+	result, err := s.db.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to save tokens: %w", err)
+	}
+	if removed, err := result.RowsAffected(); err != nil {
+		return err
+	} else if removed == 0 {
+		return fmt.Errorf("token not found")
+	}
+	return nil
+}
+
+// TouchAPIToken records that a token was just used
+func (s *SQLiteStore) TouchAPIToken(id int) error {
+	now := time.Now()
+	// The interval check happens in the update, so that concurrent requests
+	// with the same token do not each write it
+	result, err := s.db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at <= ?)",
+		formatTime(now), id, formatTime(now.Add(-tokenTouchInterval)))
+	if err != nil {
+		return fmt.Errorf("failed to save tokens: %w", err)
+	}
+	if touched, err := result.RowsAffected(); err != nil || touched > 0 {
+		return err
+	}
+
+	var exists int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE id = ?", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return fmt.Errorf("token not found")
+	}
+	return nil
+}
+
+func getAPITokenTx(q querier, where string, args ...interface{}) (*models.APIToken, error) {
+	return scanAPIToken(q.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE "+where, args...))
+}
+
+func scanAPIToken(row rowScanner) (*models.APIToken, error) {
+	var token models.APIToken
+	var scopes, createdAt string
+	var expiresAt, lastUsedAt sql.NullString
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.TokenHash, &scopes, &createdAt, &expiresAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(scopes), &token.Scopes); err != nil {
+		return nil, fmt.Errorf("invalid scopes for token %d: %w", token.ID, err)
+	}
+	if token.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, err
+	}
+	if token.ExpiresAt, err = parseOptionalTime(expiresAt); err != nil {
+		return nil, err
+	}
+	if token.LastUsedAt, err = parseOptionalTime(lastUsedAt); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Account token methods
+
+// CreateAccountToken stores a single-use token. Any earlier token the user
+// has for the same purpose is invalidated, and expired tokens are purged.
+func (s *SQLiteStore) CreateAccountToken(token models.AccountToken) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM account_tokens WHERE expires_at < ? OR (user_id = ? AND purpose = ?)",
+			formatTime(time.Now()), token.UserID, token.Purpose)
+		if err == nil {
+			_, err = tx.Exec("INSERT OR REPLACE INTO account_tokens (token_hash, user_id, purpose, email, expires_at) VALUES (?, ?, ?, ?, ?)",
+				token.TokenHash, token.UserID, token.Purpose, token.Email, formatTime(token.ExpiresAt))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save account tokens: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetAccountToken looks up an unexpired token for purpose without using it up
+func (s *SQLiteStore) GetAccountToken(hash, purpose string) *models.AccountToken {
+	token, err := getAccountTokenTx(s.db, hash, purpose)
+	if err != nil {
+		logReadError("account token", err)
+		return nil
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil
+	}
+	return token
+}
+
+// ConsumeAccountToken looks up a token for purpose and removes it, so that it
+// can only be used once
+func (s *SQLiteStore) ConsumeAccountToken(hash, purpose string) (*models.AccountToken, error) {
+	var token *models.AccountToken
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		if token, err = getAccountTokenTx(tx, hash, purpose); err != nil {
+			return notFound(err, "invalid or expired token")
+		}
+		if _, err := tx.Exec("DELETE FROM account_tokens WHERE token_hash = ?", hash); err != nil {
+			return fmt.Errorf("failed to save account tokens: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return nil, fmt.Errorf("invalid or expired token")
+	}
+	return token, nil
+}
+
+func getAccountTokenTx(q querier, hash, purpose string) (*models.AccountToken, error) {
+	var token models.AccountToken
+	var expiresAt string
+	err := q.QueryRow("SELECT token_hash, user_id, purpose, email, expires_at FROM account_tokens WHERE token_hash = ? AND purpose = ?",
+		hash, purpose).Scan(&token.TokenHash, &token.UserID, &token.Purpose, &token.Email, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if token.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Invite methods
+
+const inviteColumns = "id, code_hash, created_by, created_at, expires_at, used_by, used_at"
+
+// CreateInvite stores a new invite. The caller is responsible for hashing
+// the code.
+func (s *SQLiteStore) CreateInvite(invite models.Invite) (*models.Invite, error) {
+	err := s.withTx(func(tx *sql.Tx) error {
+		if _, err := getInviteTx(tx, invite.CodeHash); err == nil {
+			return fmt.Errorf("invite already exists")
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		result, err := tx.Exec("INSERT INTO invites (code_hash, created_by, created_at, expires_at, used_by, used_at) VALUES (?, ?, ?, ?, ?, ?)",
+			invite.CodeHash, invite.CreatedBy, formatTime(invite.CreatedAt), formatOptionalTime(invite.ExpiresAt),
+			invite.UsedBy, formatOptionalTime(invite.UsedAt))
+		if err != nil {
+			return fmt.Errorf("failed to save invites: %w", err)
+		}
+		id, err := result.LastInsertId()
+		invite.ID = int(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// GetInvites returns all invites, newest first
+func (s *SQLiteStore) GetInvites() []models.Invite {
+	rows, err := s.db.Query("SELECT " + inviteColumns + " FROM invites ORDER BY created_at DESC")
+	if err != nil {
+		logReadError("invites", err)
+		return []models.Invite{}
+	}
+	defer rows.Close()
+
+	invites := []models.Invite{}
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			logReadError("invites", err)
+			break
+		}
+		invites = append(invites, *invite)
+	}
+	logReadError("invites", rows.Err())
+	return invites
+}
+
+// DeleteInvite revokes an invite. Used invites are kept as a record of who
+// invited whom.
+func (s *SQLiteStore) DeleteInvite(id int) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		invite, err := scanInvite(tx.QueryRow("SELECT "+inviteColumns+" FROM invites WHERE id = ?", id))
+		if err != nil {
+			return notFound(err, "invite not found")
+		}
+		if invite.UsedAt != nil {
+			return fmt.Errorf("invite has already been used")
+		}
+
+		if _, err := tx.Exec("DELETE FROM invites WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to save invites: %w", err)
+		}
+		return nil
+	})
+}
+
+// CreateUserWithInvite creates a user and redeems the invite with codeHash in
+// one transaction, so that an invite cannot be used twice by concurrent
+// registrations
+func (s *SQLiteStore) CreateUserWithInvite(user models.User, codeHash string) (*models.User, error) {
+	// Hash outside the transaction, argon2 is deliberately slow
+	if err := hashUserPassword(&user); err != nil {
+		return nil, err
+	}
+
+	var created *models.User
+	err := s.withTx(func(tx *sql.Tx) error {
+		invite, err := getInviteTx(tx, codeHash)
+		if err == sql.ErrNoRows {
+			return ErrInvalidInvite
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if invite.UsedAt != nil || (invite.ExpiresAt != nil && now.After(*invite.ExpiresAt)) {
+			return ErrInvalidInvite
+		}
+
+		if created, err = createUserTx(tx, user); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE invites SET used_by = ?, used_at = ? WHERE id = ?", created.ID, formatTime(now), invite.ID)
+		if err != nil {
+			return fmt.Errorf("failed to save invites: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func getInviteTx(q querier, codeHash string) (*models.Invite, error) {
+	return scanInvite(q.QueryRow("SELECT "+inviteColumns+" FROM invites WHERE code_hash = ?", codeHash))
+}
+
+func scanInvite(row rowScanner) (*models.Invite, error) {
+	var invite models.Invite
+	var createdAt string
+	var expiresAt, usedAt sql.NullString
+	err := row.Scan(&invite.ID, &invite.CodeHash, &invite.CreatedBy, &createdAt, &expiresAt, &invite.UsedBy, &usedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if invite.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, err
+	}
+	if invite.ExpiresAt, err = parseOptionalTime(expiresAt); err != nil {
+		return nil, err
+	}
+	if invite.UsedAt, err = parseOptionalTime(usedAt); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
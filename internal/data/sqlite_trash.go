@@ -0,0 +1,151 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// Trash methods. Deleted shaders are moved whole into shader_trash, so that
+// no other query has to leave them out.
+
+// GetDeletedShaderByID returns a shader in the trash, or nil if it is not
+// there
+func (s *SQLiteStore) GetDeletedShaderByID(id int) *models.Shader {
+	shaders, err := queryTrashTx(s.db, "WHERE id = ?", id)
+	logReadError("deleted shader", err)
+	if len(shaders) == 0 {
+		return nil
+	}
+	return &shaders[0]
+}
+
+// GetDeletedShaders returns every shader in the trash, most recently
+// deleted first
+func (s *SQLiteStore) GetDeletedShaders() []models.Shader {
+	shaders, err := queryTrashTx(s.db, "ORDER BY deleted_at DESC, id DESC")
+	logReadError("deleted shaders", err)
+	if shaders == nil {
+		shaders = []models.Shader{}
+	}
+	return shaders
+}
+
+// RestoreShader takes a shader out of the trash. Tags and collaborators
+// deleted in the meantime are left off it.
+func (s *SQLiteStore) RestoreShader(id int) (*models.Shader, error) {
+	var restored *models.Shader
+	err := s.withTx(func(tx *sql.Tx) error {
+		shaders, err := queryTrashTx(tx, "WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		if len(shaders) == 0 {
+			return fmt.Errorf("shader not found in trash")
+		}
+		shader := shaders[0]
+		shader.DeletedAt = nil
+
+		tags := []models.Tag{}
+		for _, tag := range shader.Tags {
+			var name string
+			err := tx.QueryRow("SELECT name FROM tags WHERE id = ?", tag.ID).Scan(&name)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			tags = append(tags, models.Tag{ID: tag.ID, Name: name})
+		}
+		shader.Tags = tags
+
+		collaborators := []models.Collaborator{}
+		for _, collaborator := range shader.Collaborators {
+			_, err := getUserTx(tx, "id = ?", collaborator.UserID)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			collaborators = append(collaborators, collaborator)
+		}
+		shader.Collaborators = collaborators
+
+		if restored, err = insertShaderTx(tx, shader); err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM shader_trash WHERE id = ?", id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+// PurgeDeletedShaders permanently deletes the shaders, and their revisions,
+// that were moved to the trash before the given time, and returns how many
+// there were
+func (s *SQLiteStore) PurgeDeletedShaders(before time.Time) (int, error) {
+	var purged int64
+	err := s.withTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM shader_trash WHERE deleted_at < ?", formatTime(before))
+		if err != nil {
+			return err
+		}
+		if purged, err = result.RowsAffected(); err != nil || purged == 0 {
+			return err
+		}
+		return pruneRevisionsTx(tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(purged), nil
+}
+
+// trashShaderTx stores a copy of shader in the trash
+func trashShaderTx(tx *sql.Tx, shader models.Shader, deletedAt time.Time) error {
+	deletedAt = deletedAt.UTC()
+	shader.DeletedAt = &deletedAt
+	shader.Author = ""
+	data, err := json.Marshal(shader)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO shader_trash (id, user_id, team_id, deleted_at, shader) VALUES (?, ?, ?, ?, ?)",
+		shader.ID, shader.UserID, shader.TeamID, formatTime(deletedAt), string(data))
+	return err
+}
+
+// queryTrashTx returns the shaders in the trash selected by the rest of a
+// query, with their current owner and team
+func queryTrashTx(q querier, rest string, args ...interface{}) ([]models.Shader, error) {
+	rows, err := q.Query("SELECT user_id, team_id, shader FROM shader_trash "+rest, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shaders []models.Shader
+	for rows.Next() {
+		var shader models.Shader
+		var userID, teamID int
+		var data string
+		if err := rows.Scan(&userID, &teamID, &data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &shader); err != nil {
+			return nil, err
+		}
+		shader.UserID = userID
+		shader.TeamID = teamID
+		shaders = append(shaders, shader)
+	}
+	return shaders, rows.Err()
+}
@@ -0,0 +1,96 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+
+	"go-server/internal/models"
+)
+
+// StartTOTPEnrollment stores a new, not yet enabled, TOTP secret for a user
+func (s *SQLiteStore) StartTOTPEnrollment(userID int, secret string) error {
+	return s.updateUser(userID, func(user *models.User) {
+		user.TOTPSecret = secret
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+	})
+}
+
+// EnableTOTP turns on two-factor authentication once the first code, from
+// step, has been verified, storing the hashes of the user's recovery codes
+func (s *SQLiteStore) EnableTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	return s.updateUser(userID, func(user *models.User) {
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = recoveryCodeHashes
+	})
+}
+
+// DisableTOTP turns off two-factor authentication and forgets the secret and
+// recovery codes
+func (s *SQLiteStore) DisableTOTP(userID int) error {
+	return s.updateUser(userID, func(user *models.User) {
+		user.TOTPSecret = ""
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+	})
+}
+
+// SetRecoveryCodes replaces a user's recovery codes
+func (s *SQLiteStore) SetRecoveryCodes(userID int, recoveryCodeHashes []string) error {
+	return s.updateUser(userID, func(user *models.User) {
+		user.RecoveryCodes = recoveryCodeHashes
+	})
+}
+
+// UseTOTPStep records that a code from step has been accepted, returning
+// ErrCodeReused if that step, or a later one, was already used
+func (s *SQLiteStore) UseTOTPStep(userID int, step int64) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		var lastStep int64
+		err := tx.QueryRow("SELECT totp_last_step FROM users WHERE id = ?", userID).Scan(&lastStep)
+		if err != nil {
+			return notFound(err, "user not found")
+		}
+		if step <= lastStep {
+			return ErrCodeReused
+		}
+
+		if _, err := tx.Exec("UPDATE users SET totp_last_step = ? WHERE id = ?", step, userID); err != nil {
+			return fmt.Errorf("failed to save users: %w", err)
+		}
+		return nil
+	})
+}
+
+// UseRecoveryCode removes a recovery code from the user by its hash and
+// reports whether it was one of theirs
+func (s *SQLiteStore) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	used := false
+	err := s.withTx(func(tx *sql.Tx) error {
+		user, err := getUserTx(tx, "id = ?", userID)
+		if err != nil {
+			return notFound(err, "user not found")
+		}
+
+		remaining := make([]string, 0, len(user.RecoveryCodes))
+		for _, hash := range user.RecoveryCodes {
+			if hash != codeHash {
+				remaining = append(remaining, hash)
+			}
+		}
+		if len(remaining) == len(user.RecoveryCodes) {
+			return nil
+		}
+
+		used = true
+		user.RecoveryCodes = remaining
+		return saveUserTx(tx, *user)
+	})
+	if err != nil {
+		return false, err
+	}
+	return used, nil
+}
@@ -0,0 +1,102 @@
+package data
+
+import (
+	"time"
+
+	"go-server/internal/auth"
+	"go-server/internal/models"
+)
+
+// Store is everything the server persists. Repository keeps it in JSON
+// files and SQLiteStore in an embedded database; both report the same
+// errors, so callers do not need to know which one they have.
+type Store interface {
+	// Users
+	GetUserByID(id int) *models.User
+	GetUserByUsername(username string) *models.User
+	GetUsersByEmail(email string) []models.User
+	CreateUser(user models.User) (*models.User, error)
+	CreateUserWithInvite(user models.User, codeHash string) (*models.User, error)
+	ChangeUsername(userID int, username string) error
+	SetPasswordHash(userID int, hash string) error
+	MigrateLegacyPasswords() (int, error)
+	SetEmail(userID int, email string) error
+	VerifyEmail(userID int, email string) error
+	SetRole(userID int, role string) error
+	SetBanned(userID int, banned bool) error
+	DeleteUser(userID int, disposition ShaderDisposition, transferTo int) error
+	GetUserByIdentity(identity models.ExternalIdentity) *models.User
+	LinkIdentity(userID int, identity models.ExternalIdentity) error
+
+	// Two-factor authentication
+	StartTOTPEnrollment(userID int, secret string) error
+	EnableTOTP(userID int, step int64, recoveryCodeHashes []string) error
+	DisableTOTP(userID int) error
+	SetRecoveryCodes(userID int, recoveryCodeHashes []string) error
+	UseTOTPStep(userID int, step int64) error
+	UseRecoveryCode(userID int, codeHash string) (bool, error)
+
+	// Shaders and their collaborators
+	GetShaderByID(id int) *models.Shader
+	SearchShaders(params models.SearchParams) []models.Shader
+	CreateShader(shader models.Shader, revision models.ShaderRevision) (*models.Shader, error)
+	UpdateShader(id int, shader models.Shader, revision *models.ShaderRevision) (*models.Shader, error)
+	DeleteShader(id int) error
+	SetCollaborator(shaderID, userID int, role string) (*models.Shader, error)
+	RemoveCollaborator(shaderID, userID int) error
+
+	// Revisions, recorded by CreateShader and UpdateShader
+	GetShaderRevisions(shaderID int) []models.ShaderRevision
+	GetShaderRevision(shaderID, number int) *models.ShaderRevision
+
+	// Trash
+	GetDeletedShaderByID(id int) *models.Shader
+	GetDeletedShaders() []models.Shader
+	RestoreShader(id int) (*models.Shader, error)
+	PurgeDeletedShaders(before time.Time) (int, error)
+
+	// Tags
+	GetAllTags() []models.Tag
+	GetTagByID(id int) *models.Tag
+	RenameTag(id int, name string) (*models.Tag, error)
+	DeleteTag(id int) error
+
+	// Teams
+	GetTeamByID(id int) *models.Team
+	GetTeams(userID int) []models.Team
+	CreateTeam(name string, ownerID int, createdAt time.Time) (*models.Team, error)
+	RenameTeam(id int, name string) (*models.Team, error)
+	DeleteTeam(id int) error
+	SetTeamMember(teamID, userID int, role string) (*models.Team, error)
+	RemoveTeamMember(teamID, userID int) error
+	SetShaderTeam(shaderID, teamID, userID int) (*models.Shader, error)
+
+	// API tokens, account tokens and invites
+	CreateAPIToken(token models.APIToken) (*models.APIToken, error)
+	GetAPITokenByHash(hash string) *models.APIToken
+	GetAPITokensByUser(userID int) []models.APIToken
+	DeleteAPIToken(userID, id int) error
+	TouchAPIToken(id int) error
+	CreateAccountToken(token models.AccountToken) error
+	GetAccountToken(hash, purpose string) *models.AccountToken
+	ConsumeAccountToken(hash, purpose string) (*models.AccountToken, error)
+	CreateInvite(invite models.Invite) (*models.Invite, error)
+	GetInvites() []models.Invite
+	DeleteInvite(id int) error
+
+	// Snapshot returns a consistent copy of users, shaders, tags and teams,
+	// as the files the JSON storage keeps them in
+	Snapshot() (map[string][]byte, error)
+
+	// Sessions returns a session store kept in the same place as everything
+	// else
+	Sessions(config auth.SessionConfig) (auth.SessionStore, error)
+
+	// Close releases the store's resources once the server is done with it
+	Close() error
+}
+
+var (
+	_ Store = (*Repository)(nil)
+	_ Store = (*SQLiteStore)(nil)
+)
@@ -0,0 +1,318 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// Team operations
+func (r *Repository) loadTeams() error {
+	var teams []models.Team
+	if err := r.readJSON(teamsFile, &teams); err != nil {
+		return err
+	}
+
+	for _, team := range teams {
+		r.teams[team.ID] = team
+		if team.ID >= r.nextTeamID {
+			r.nextTeamID = team.ID + 1
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository) saveTeams() error {
+	teams := make([]models.Team, 0, len(r.teams))
+	for _, team := range r.teams {
+		teams = append(teams, team)
+	}
+
+	return r.writeJSON(teamsFile, teams, 0644)
+}
+
+// GetTeamByID returns a team, or nil if it does not exist
+func (r *Repository) GetTeamByID(id int) *models.Team {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if team, exists := r.teams[id]; exists {
+		return &team
+	}
+	return nil
+}
+
+// GetTeams returns all teams, or only those userID belongs to if it is not 0,
+// sorted by name
+func (r *Repository) GetTeams(userID int) []models.Team {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	teams := []models.Team{}
+	for _, team := range r.teams {
+		if userID == 0 || teamRoleOf(team, userID) != "" {
+			teams = append(teams, team)
+		}
+	}
+
+	sort.Slice(teams, func(i, j int) bool {
+		return strings.ToLower(teams[i].Name) < strings.ToLower(teams[j].Name)
+	})
+
+	return teams
+}
+
+// CreateTeam stores a new team with ownerID as its only member
+func (r *Repository) CreateTeam(name string, ownerID int, createdAt time.Time) (*models.Team, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.teamNameTakenLockFree(name, 0) {
+		return nil, fmt.Errorf("team name already exists: %s", name)
+	}
+	if _, exists := r.users[ownerID]; !exists {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	team := models.Team{
+		ID:        r.nextTeamID,
+		Name:      name,
+		Members:   []models.TeamMember{{UserID: ownerID, Role: models.TeamRoleOwner}},
+		CreatedAt: createdAt,
+	}
+	r.nextTeamID++
+	r.teams[team.ID] = team
+
+	if err := r.saveTeams(); err != nil {
+		// Attempt to roll back
+		delete(r.teams, team.ID)
+		r.nextTeamID--
+		return nil, fmt.Errorf("failed to save teams: %w", err)
+	}
+
+	return &team, nil
+}
+
+// RenameTeam changes a team's name
+func (r *Repository) RenameTeam(id int, name string) (*models.Team, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	team, exists := r.teams[id]
+	if !exists {
+		return nil, fmt.Errorf("team not found")
+	}
+	if r.teamNameTakenLockFree(name, id) {
+		return nil, fmt.Errorf("team name already exists: %s", name)
+	}
+
+	previous := team
+	team.Name = name
+	if err := r.saveTeamChangeLockFree(previous, team); err != nil {
+		return nil, err
+	}
+	return &team, nil
+}
+
+// DeleteTeam removes a team, emptying its trash. Teams that still own
+// shaders cannot be deleted.
+func (r *Repository) DeleteTeam(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	team, exists := r.teams[id]
+	if !exists {
+		return fmt.Errorf("team not found")
+	}
+	if len(r.shadersByTeam[id]) > 0 {
+		return fmt.Errorf("team still owns shaders")
+	}
+
+	// The team's trash goes with it
+	trashed := make(map[int]models.Shader)
+	for shaderID, shader := range r.shaders {
+		if shader.TeamID == id {
+			trashed[shaderID] = shader
+			delete(r.shaders, shaderID)
+		}
+	}
+
+	delete(r.teams, id)
+	err := r.saveShaderChanges(shaderIDs(trashed)...)
+	if err == nil {
+		err = r.saveTeams()
+	}
+	if err != nil {
+		// Attempt to roll back
+		r.teams[id] = team
+		for shaderID, shader := range trashed {
+			r.shaders[shaderID] = shader
+		}
+		r.saveShaderChanges(shaderIDs(trashed)...)
+		return fmt.Errorf("failed to save teams: %w", err)
+	}
+	r.pruneRevisionsLockFree()
+
+	return nil
+}
+
+// SetTeamMember adds a user to a team or changes their role. A team always
+// keeps at least one owner.
+func (r *Repository) SetTeamMember(teamID, userID int, role string) (*models.Team, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	team, exists := r.teams[teamID]
+	if !exists {
+		return nil, fmt.Errorf("team not found")
+	}
+	if _, exists := r.users[userID]; !exists {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	previous := team
+	members := make([]models.TeamMember, 0, len(team.Members)+1)
+	found := false
+	for _, member := range team.Members {
+		if member.UserID == userID {
+			member.Role = role
+			found = true
+		}
+		members = append(members, member)
+	}
+	if !found {
+		members = append(members, models.TeamMember{UserID: userID, Role: role})
+	}
+	team.Members = members
+
+	if !hasTeamOwner(team) {
+		return nil, fmt.Errorf("team must keep at least one owner")
+	}
+
+	if err := r.saveTeamChangeLockFree(previous, team); err != nil {
+		return nil, err
+	}
+	return &team, nil
+}
+
+// RemoveTeamMember takes a user out of a team. The last owner cannot leave
+// while there are other members.
+func (r *Repository) RemoveTeamMember(teamID, userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	team, exists := r.teams[teamID]
+	if !exists {
+		return fmt.Errorf("team not found")
+	}
+
+	previous := team
+	if teamRoleOf(team, userID) == "" {
+		return fmt.Errorf("member not found")
+	}
+	team.Members = withoutTeamMember(team.Members, userID)
+	if len(team.Members) > 0 && !hasTeamOwner(team) {
+		return fmt.Errorf("team must keep at least one owner")
+	}
+
+	return r.saveTeamChangeLockFree(previous, team)
+}
+
+// SetShaderTeam moves a shader into a team, or out of it to userID when
+// teamID is 0
+func (r *Repository) SetShaderTeam(shaderID, teamID, userID int) (*models.Shader, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	shader, exists := r.liveShaderLockFree(shaderID)
+	if !exists {
+		return nil, fmt.Errorf("shader not found")
+	}
+	if teamID != 0 {
+		if _, exists := r.teams[teamID]; !exists {
+			return nil, fmt.Errorf("team not found")
+		}
+	} else if _, exists := r.users[userID]; !exists {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	previous := shader
+	shader.TeamID = teamID
+	if teamID == 0 {
+		shader.UserID = userID
+		removeCollaborator(&shader, userID)
+	}
+
+	if err := r.saveShaderChangeLockFree(previous, shader); err != nil {
+		return nil, err
+	}
+	return &shader, nil
+}
+
+// Lock-free version for internal use when mutex is already held
+func (r *Repository) teamNameTakenLockFree(name string, exceptID int) bool {
+	for _, team := range r.teams {
+		if team.ID != exceptID && strings.EqualFold(team.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lock-free version for internal use when mutex is already held. Stores
+// team, restoring previous if it cannot be saved.
+func (r *Repository) saveTeamChangeLockFree(previous, team models.Team) error {
+	r.teams[team.ID] = team
+	if err := r.saveTeams(); err != nil {
+		// Attempt to roll back
+		r.teams[previous.ID] = previous
+		return fmt.Errorf("failed to save teams: %w", err)
+	}
+	return nil
+}
+
+// teamRoleOf returns userID's role in team, or "" if they are not a member
+func teamRoleOf(team models.Team, userID int) string {
+	for _, member := range team.Members {
+		if member.UserID == userID {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+func hasTeamOwner(team models.Team) bool {
+	for _, member := range team.Members {
+		if member.Role == models.TeamRoleOwner {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutTeamMember(members []models.TeamMember, userID int) []models.TeamMember {
+	remaining := make([]models.TeamMember, 0, len(members))
+	for _, member := range members {
+		if member.UserID != userID {
+			remaining = append(remaining, member)
+		}
+	}
+	return remaining
+}
+
+// removeTeamMember drops userID from team, promoting the longest standing
+// remaining member if the team would otherwise be left without an owner, and
+// reports whether they were a member
+func removeTeamMember(team *models.Team, userID int) bool {
+	if teamRoleOf(*team, userID) == "" {
+		return false
+	}
+	team.Members = withoutTeamMember(team.Members, userID)
+	if len(team.Members) > 0 && !hasTeamOwner(*team) {
+		team.Members[0].Role = models.TeamRoleOwner
+	}
+	return true
+}
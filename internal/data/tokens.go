@@ -0,0 +1,131 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// tokenTouchInterval limits how often LastUsedAt is written for a token
+const tokenTouchInterval = time.Minute
+
+// API token operations
+func (r *Repository) loadTokens() error {
+	var tokens []models.APIToken
+	if err := r.readJSON(tokensFile, &tokens); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		r.tokens[token.ID] = token
+		if token.ID >= r.nextTokenID {
+			r.nextTokenID = token.ID + 1
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository) saveTokens() error {
+	tokens := make([]models.APIToken, 0, len(r.tokens))
+	for _, token := range r.tokens {
+		tokens = append(tokens, token)
+	}
+
+	return r.writeJSON(tokensFile, tokens, 0600)
+}
+
+// CreateAPIToken stores a new token. The caller is responsible for hashing it.
+func (r *Repository) CreateAPIToken(token models.APIToken) (*models.APIToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.tokensByHash[token.TokenHash]; exists {
+		return nil, fmt.Errorf("token already exists")
+	}
+
+	token.ID = r.nextTokenID
+	r.nextTokenID++
+
+	r.tokens[token.ID] = token
+	r.tokensByHash[token.TokenHash] = token.ID
+
+	if err := r.saveTokens(); err != nil {
+		// Attempt to roll back
+		delete(r.tokens, token.ID)
+		delete(r.tokensByHash, token.TokenHash)
+		r.nextTokenID--
+		return nil, fmt.Errorf("failed to save tokens: %w", err)
+	}
+
+	return &token, nil
+}
+
+// GetAPITokenByHash returns the token with the given hash, expired or not
+func (r *Repository) GetAPITokenByHash(hash string) *models.APIToken {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id, exists := r.tokensByHash[hash]; exists {
+		token := r.tokens[id]
+		return &token
+	}
+	return nil
+}
+
+// GetAPITokensByUser returns a user's tokens, newest first
+func (r *Repository) GetAPITokensByUser(userID int) []models.APIToken {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tokens := []models.APIToken{}
+	for _, token := range r.tokens {
+		if token.UserID == userID {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+
+	return tokens
+}
+
+// DeleteAPIToken revokes one of a user's tokens
+func (r *Repository) DeleteAPIToken(userID, id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token, exists := r.tokens[id]
+	if !exists || token.UserID != userID {
+		return fmt.Errorf("token not found")
+	}
+
+	delete(r.tokens, id)
+	delete(r.tokensByHash, token.TokenHash)
+
+	return r.saveTokens()
+}
+
+// TouchAPIToken records that a token was just used
+func (r *Repository) TouchAPIToken(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token, exists := r.tokens[id]
+	if !exists {
+		return fmt.Errorf("token not found")
+	}
+
+	now := time.Now()
+	if token.LastUsedAt != nil && now.Sub(*token.LastUsedAt) < tokenTouchInterval {
+		return nil
+	}
+	token.LastUsedAt = &now
+	r.tokens[id] = token
+
+	return r.saveTokens()
+}
@@ -0,0 +1,107 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go-server/internal/models"
+)
+
+// Deleted shaders stay in r.shaders with DeletedAt set, but out of every
+// index, until they are restored or purged. Lookups by ID go through
+// liveShaderLockFree so that they do not find them.
+
+// Lock-free version for internal use when mutex is already held. Returns the
+// shader with the given ID unless there is none or it is in the trash.
+func (r *Repository) liveShaderLockFree(id int) (models.Shader, bool) {
+	shader, exists := r.shaders[id]
+	if !exists || shader.DeletedAt != nil {
+		return models.Shader{}, false
+	}
+	return shader, true
+}
+
+// GetDeletedShaderByID returns a shader in the trash, or nil if it is not
+// there
+func (r *Repository) GetDeletedShaderByID(id int) *models.Shader {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if shader, exists := r.shaders[id]; exists && shader.DeletedAt != nil {
+		return &shader
+	}
+	return nil
+}
+
+// GetDeletedShaders returns every shader in the trash, most recently
+// deleted first
+func (r *Repository) GetDeletedShaders() []models.Shader {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	shaders := []models.Shader{}
+	for _, shader := range r.shaders {
+		if shader.DeletedAt != nil {
+			shaders = append(shaders, shader)
+		}
+	}
+	sortDeletedShaders(shaders)
+	return shaders
+}
+
+// RestoreShader takes a shader out of the trash
+func (r *Repository) RestoreShader(id int) (*models.Shader, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	shader, exists := r.shaders[id]
+	if !exists || shader.DeletedAt == nil {
+		return nil, fmt.Errorf("shader not found in trash")
+	}
+
+	previous := shader
+	shader.DeletedAt = nil
+	if err := r.saveShaderChangeLockFree(previous, shader); err != nil {
+		return nil, err
+	}
+	return &shader, nil
+}
+
+// PurgeDeletedShaders permanently deletes the shaders, and their revisions,
+// that were moved to the trash before the given time, and returns how many
+// there were
+func (r *Repository) PurgeDeletedShaders(before time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	purged := make(map[int]models.Shader)
+	for id, shader := range r.shaders {
+		if shader.DeletedAt != nil && shader.DeletedAt.Before(before) {
+			purged[id] = shader
+			delete(r.shaders, id)
+		}
+	}
+	if len(purged) == 0 {
+		return 0, nil
+	}
+
+	if err := r.saveShaderChanges(shaderIDs(purged)...); err != nil {
+		// Attempt to roll back
+		for id, shader := range purged {
+			r.shaders[id] = shader
+		}
+		return 0, fmt.Errorf("failed to save shaders: %w", err)
+	}
+	r.pruneRevisionsLockFree()
+	return len(purged), nil
+}
+
+// sortDeletedShaders orders shaders in the trash most recently deleted first
+func sortDeletedShaders(shaders []models.Shader) {
+	sort.Slice(shaders, func(i, j int) bool {
+		if !shaders[i].DeletedAt.Equal(*shaders[j].DeletedAt) {
+			return shaders[i].DeletedAt.After(*shaders[j].DeletedAt)
+		}
+		return shaders[i].ID > shaders[j].ID
+	})
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+
+	"go-server/internal/models"
+)
+
+// ErrCodeReused is returned when a TOTP code's time step has already been used
+var ErrCodeReused = errors.New("code already used")
+
+// StartTOTPEnrollment stores a new, not yet enabled, TOTP secret for a user
+func (r *Repository) StartTOTPEnrollment(userID int, secret string) error {
+	return r.updateUser(userID, func(user *models.User) {
+		user.TOTPSecret = secret
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+	})
+}
+
+// EnableTOTP turns on two-factor authentication once the first code, from
+// step, has been verified, storing the hashes of the user's recovery codes
+func (r *Repository) EnableTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	return r.updateUser(userID, func(user *models.User) {
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = recoveryCodeHashes
+	})
+}
+
+// DisableTOTP turns off two-factor authentication and forgets the secret and
+// recovery codes
+func (r *Repository) DisableTOTP(userID int) error {
+	return r.updateUser(userID, func(user *models.User) {
+		user.TOTPSecret = ""
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+	})
+}
+
+// SetRecoveryCodes replaces a user's recovery codes
+func (r *Repository) SetRecoveryCodes(userID int, recoveryCodeHashes []string) error {
+	return r.updateUser(userID, func(user *models.User) {
+		user.RecoveryCodes = recoveryCodeHashes
+	})
+}
+
+// UseTOTPStep records that a code from step has been accepted, returning
+// ErrCodeReused if that step, or a later one, was already used. This keeps a
+// code that is intercepted from being replayed while it is still valid.
+func (r *Repository) UseTOTPStep(userID int, step int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, exists := r.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	if step <= user.TOTPLastStep {
+		return ErrCodeReused
+	}
+
+	previous := user
+	user.TOTPLastStep = step
+	r.setUserLockFree(user)
+
+	if err := r.saveUsers(); err != nil {
+		// Attempt to roll back
+		r.setUserLockFree(previous)
+		return fmt.Errorf("failed to save users: %w", err)
+	}
+
+	return nil
+}
+
+// UseRecoveryCode removes a recovery code from the user by its hash and
+// reports whether it was one of theirs
+func (r *Repository) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, exists := r.users[userID]
+	if !exists {
+		return false, fmt.Errorf("user not found")
+	}
+
+	remaining := make([]string, 0, len(user.RecoveryCodes))
+	for _, hash := range user.RecoveryCodes {
+		if hash != codeHash {
+			remaining = append(remaining, hash)
+		}
+	}
+	if len(remaining) == len(user.RecoveryCodes) {
+		return false, nil
+	}
+
+	previous := user
+	user.RecoveryCodes = remaining
+	r.setUserLockFree(user)
+
+	if err := r.saveUsers(); err != nil {
+		// Attempt to roll back
+		r.setUserLockFree(previous)
+		return false, fmt.Errorf("failed to save users: %w", err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,231 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxEdits bounds the work spent looking for the shortest edit script.
+// Texts that differ by more are shown as removed whole and added whole.
+const maxEdits = 1000
+
+// Unified returns the differences between a and b as a unified diff, with
+// context unchanged lines around each change, or "" if they are the same.
+// fromName and toName label the two sides in the header.
+func Unified(fromName, toName, a, b string, context int) string {
+	if a == b {
+		return ""
+	}
+	from, to := splitLines(a), splitLines(b)
+	script := edits(from, to)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for _, h := range hunks(script, context) {
+		writeHunk(&out, script[h.start:h.end], from, to)
+	}
+	return out.String()
+}
+
+// splitLines splits s after each newline. A last line without one is kept
+// as it is.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// edit is one step of an edit script: keeping, deleting or inserting a line.
+// a and b are the lines of each side the step starts at.
+type edit struct {
+	kind byte // ' ', '-' or '+'
+	a, b int
+}
+
+// edits returns the shortest edit script turning a into b, found with
+// Myers' O(ND) algorithm after the common prefix and suffix are set aside
+func edits(a, b []string) []edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	script := make([]edit, 0, len(a)+len(b))
+	for i := 0; i < prefix; i++ {
+		script = append(script, edit{' ', i, i})
+	}
+	for _, e := range middle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		script = append(script, edit{e.kind, e.a + prefix, e.b + prefix})
+	}
+	for i := 0; i < suffix; i++ {
+		script = append(script, edit{' ', len(a) - suffix + i, len(b) - suffix + i})
+	}
+	return script
+}
+
+// middle finds the edit script of a and b, which differ at both ends
+func middle(a, b []string) []edit {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+
+	// trace[d] is v for diagonals -d to d before step d
+	var trace [][]int
+	found := false
+	for d := 0; d <= n+m && d <= maxEdits && !found; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return replaceAll(n, m)
+	}
+
+	// Walk back from the end, collecting the steps in reverse
+	var reversed []edit
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d] < prev[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, edit{' ', x, y})
+		}
+		if x == prevX {
+			reversed = append(reversed, edit{'+', x, prevY})
+		} else {
+			reversed = append(reversed, edit{'-', prevX, y})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		reversed = append(reversed, edit{' ', x, y})
+	}
+
+	script := make([]edit, len(reversed))
+	for i, e := range reversed {
+		script[len(reversed)-1-i] = e
+	}
+	return script
+}
+
+// replaceAll deletes all n lines and inserts all m
+func replaceAll(n, m int) []edit {
+	script := make([]edit, 0, n+m)
+	for i := 0; i < n; i++ {
+		script = append(script, edit{'-', i, 0})
+	}
+	for i := 0; i < m; i++ {
+		script = append(script, edit{'+', n, i})
+	}
+	return script
+}
+
+// hunk is a range of an edit script shown together
+type hunk struct {
+	start, end int
+}
+
+// hunks groups the changes of script with up to context unchanged lines
+// around them, merging groups whose context would overlap
+func hunks(script []edit, context int) []hunk {
+	var result []hunk
+	for i := 0; i < len(script); i++ {
+		if script[i].kind == ' ' {
+			continue
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		if n := len(result); n > 0 && start <= result[n-1].end {
+			start = result[n-1].start
+			result = result[:n-1]
+		}
+
+		// Take in the rest of this run of changes
+		for i+1 < len(script) && script[i+1].kind != ' ' {
+			i++
+		}
+		end := i + 1 + context
+		if end > len(script) {
+			end = len(script)
+		}
+		result = append(result, hunk{start, end})
+	}
+	return result
+}
+
+func writeHunk(out *strings.Builder, script []edit, a, b []string) {
+	fromLines, toLines := 0, 0
+	for _, e := range script {
+		if e.kind != '+' {
+			fromLines++
+		}
+		if e.kind != '-' {
+			toLines++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(script[0].a, fromLines), hunkRange(script[0].b, toLines))
+
+	for _, e := range script {
+		line := ""
+		switch e.kind {
+		case '+':
+			line = b[e.b]
+		default:
+			line = a[e.a]
+		}
+		out.WriteByte(e.kind)
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats the lines of one side of a hunk, which start after
+// start lines of the text, as a unified diff does
+func hunkRange(start, lines int) string {
+	switch lines {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, lines)
+}
@@ -0,0 +1,117 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    string
+	}{
+		{
+			name: "same",
+			a:    "one\ntwo\n",
+			b:    "one\ntwo\n",
+			want: "",
+		},
+		{
+			name: "both empty",
+			want: "",
+		},
+		{
+			name: "from empty",
+			b:    "one\ntwo\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+one\n+two\n",
+		},
+		{
+			name: "to empty",
+			a:    "one\ntwo\n",
+			want: "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-one\n-two\n",
+		},
+		{
+			name:    "insert only",
+			a:       "1\n2\n3\n4\n",
+			b:       "1\n2\nnew\n3\n4\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -2,2 +2,3 @@\n 2\n+new\n 3\n",
+		},
+		{
+			name:    "delete only",
+			a:       "1\n2\n3\n4\n",
+			b:       "1\n2\n4\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -2,3 +2,2 @@\n 2\n-3\n 4\n",
+		},
+		{
+			name:    "separate hunks",
+			a:       "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:       "1\nb\n3\n4\n5\nf\n7\n8\n",
+			context: 1,
+			want: "--- a\n+++ b\n" +
+				"@@ -1,3 +1,3 @@\n 1\n-2\n+b\n 3\n" +
+				"@@ -5,3 +5,3 @@\n 5\n-6\n+f\n 7\n",
+		},
+		{
+			name:    "overlapping context merges hunks",
+			a:       "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:       "1\nb\n3\n4\n5\nf\n7\n8\n",
+			context: 2,
+			want:    "--- a\n+++ b\n@@ -1,8 +1,8 @@\n 1\n-2\n+b\n 3\n 4\n 5\n-6\n+f\n 7\n 8\n",
+		},
+		{
+			name:    "adjacent context merges hunks",
+			a:       "1\n2\n3\n4\n5\n6\n",
+			b:       "1\nb\n3\n4\ne\n6\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,6 +1,6 @@\n 1\n-2\n+b\n 3\n 4\n-5\n+e\n 6\n",
+		},
+		{
+			name:    "no trailing newline",
+			a:       "1\n2",
+			b:       "1\n3",
+			context: 3,
+			want: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n 1\n" +
+				"-2\n\\ No newline at end of file\n" +
+				"+3\n\\ No newline at end of file\n",
+		},
+		{
+			name: "trailing newline added",
+			a:    "1",
+			b:    "1\n",
+			want: "--- a\n+++ b\n@@ -1 +1 @@\n-1\n\\ No newline at end of file\n+1\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Unified("a", "b", test.a, test.b, test.context); got != test.want {
+				t.Errorf("Unified(%q, %q) =\n%s\nwant\n%s", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedTooManyEdits(t *testing.T) {
+	// The shortest edit script keeps every "same" line, but needs more than
+	// maxEdits steps, so all but the common first line are replaced whole
+	lines := maxEdits/2 + 1
+	var a, b strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&a, "same\na%d\n", i)
+		fmt.Fprintf(&b, "same\nb%d\n", i)
+	}
+
+	got := Unified("a", "b", a.String(), b.String(), 0)
+	header := fmt.Sprintf("--- a\n+++ b\n@@ -2,%d +2,%d @@\n", 2*lines-1, 2*lines-1)
+	if !strings.HasPrefix(got, header) || strings.Count(got, "@@ -") != 1 {
+		t.Errorf("Unified = %.80q..., want a single hunk starting %q", got, header)
+	}
+	if strings.Contains(got, "\n same\n") {
+		t.Error("Unified kept unchanged lines, want the texts replaced whole")
+	}
+}
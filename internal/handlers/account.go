@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go-server/internal/audit"
+	"go-server/internal/auth"
+	"go-server/internal/data"
+	"go-server/internal/models"
+)
+
+// ChangePassword replaces the current user's password. The current password
+// is required, and every other session of the user is signed out.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var passwordReq struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&passwordReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user := store.GetUserByID(userID)
+	if user == nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkCurrentPassword(w, user, passwordReq.CurrentPassword, "Current password is incorrect") {
+		return
+	}
+	if err := registrationPolicy.ValidatePassword(passwordReq.NewPassword, user.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := auth.HashPassword(passwordReq.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	if err := store.SetPasswordHash(userID, hash); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, audit.ActionPasswordChange, audit.TargetUser, userID, "", "")
+
+	revoked, err := sessionStore.DeleteByUser(userID, currentSessionID(r))
+	if err != nil {
+		http.Error(w, "Password changed but other sessions could not be signed out", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revoked_sessions": revoked,
+		"message":          "Password changed successfully",
+	})
+}
+
+// checkCurrentPassword confirms the password of the signed in user before a
+// sensitive change, writing message if it is wrong. Wrong passwords count
+// against the account like failed logins. Accounts created through single
+// sign-on have no password to confirm.
+func checkCurrentPassword(w http.ResponseWriter, user *models.User, password, message string) bool {
+	if user.PasswordHash == "" && user.Password == "" {
+		return true
+	}
+
+	accountKey := accountThrottleKey(user.Username)
+	wait, err := loginAccountThrottle.Attempt(accountKey)
+	if err != nil {
+		fmt.Printf("checkCurrentPassword: %v\n", err)
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return false
+	}
+
+	if !checkPassword(user, password) {
+		http.Error(w, message, http.StatusForbidden)
+		return false
+	}
+
+	// Only this attempt is given back, so that the right password cannot
+	// clear failed second factor codes checked after it
+	if err := loginAccountThrottle.Release(accountKey); err != nil {
+		fmt.Printf("checkCurrentPassword: %v\n", err)
+	}
+	return true
+}
+
+// ChangeUsername renames the current user
+func ChangeUsername(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var usernameReq struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&usernameReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	username, err := registrationPolicy.ValidateUsername(usernameReq.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := store.ChangeUsername(userID, username); err != nil {
+		if strings.Contains(err.Error(), "username already exists") {
+			http.Error(w, "Username already taken", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":  userID,
+		"username": username,
+		"message":  "Username changed successfully",
+	})
+}
+
+// DeleteAccount deletes the current user after confirming their password.
+// Their shaders are deleted, orphaned or transferred to another user.
+func DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var deleteReq struct {
+		Password   string `json:"password"`
+		Shaders    string `json:"shaders"` // "delete", "orphan" or "transfer"
+		TransferTo string `json:"transfer_to,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&deleteReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user := store.GetUserByID(userID)
+	if user == nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkCurrentPassword(w, user, deleteReq.Password, "Password is incorrect") {
+		return
+	}
+
+	disposition := data.ShaderDisposition(deleteReq.Shaders)
+	transferTo := 0
+	switch disposition {
+	case data.DeleteShaders, data.OrphanShaders:
+	case data.TransferShaders:
+		recipient := store.GetUserByUsername(deleteReq.TransferTo)
+		if recipient == nil || recipient.ID == userID {
+			http.Error(w, "Transfer recipient not found", http.StatusBadRequest)
+			return
+		}
+		transferTo = recipient.ID
+	default:
+		http.Error(w, `shaders must be "delete", "orphan" or "transfer"`, http.StatusBadRequest)
+		return
+	}
+
+	if err := store.DeleteUser(userID, disposition, transferTo); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, audit.ActionAccountDelete, audit.TargetUser, userID,
+		fmt.Sprintf("username=%q", user.Username), "shaders="+string(disposition))
+
+	if _, err := sessionStore.DeleteByUser(userID, ""); err != nil {
+		http.Error(w, "Account deleted but sessions could not be signed out", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account deleted successfully"})
+}
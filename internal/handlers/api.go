@@ -1,33 +1,74 @@
 package handlers
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"go-server/internal/audit"
+	"go-server/internal/auth"
+	"go-server/internal/authz"
 	"go-server/internal/data"
 	"go-server/internal/models"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
+const sessionCookieName = "session_token"
+
 var (
-	// Session storage
-	sessions   = make(map[string]models.Session)
-	sessionsMu sync.Mutex
+	// Users, shaders, tags and everything else the server persists, set at
+	// startup via SetStore
+	store data.Store
+
+	// Session storage, replaced at startup via SetSessionStore
+	sessionStore auth.SessionStore = auth.NewMemorySessionStore(auth.DefaultSessionConfig())
 )
 
+// SetStore sets the store every handler reads and writes. It must be called
+// before the server starts handling requests.
+func SetStore(s data.Store) {
+	store = s
+}
+
+// SetSessionStore sets the store used for all session lookups. It must be
+// called before the server starts handling requests.
+func SetSessionStore(store auth.SessionStore) {
+	sessionStore = store
+}
+
 // Helper function to get session by token (used by web.go)
 func getSessionByToken(token string) (models.Session, bool) {
-	sessionsMu.Lock()
-	defer sessionsMu.Unlock()
-	session, exists := sessions[token]
-	return session, exists
+	return sessionStore.Get(token)
+}
+
+// startSession creates a new session for userID and sets its cookie. Any
+// session presented with the request is ended first, so a token planted in
+// the browser before login is never promoted to an authenticated session.
+func startSession(w http.ResponseWriter, r *http.Request, userID int) (models.Session, error) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := sessionStore.Delete(cookie.Value); err != nil {
+			return models.Session{}, err
+		}
+	}
+
+	session, err := sessionStore.Create(userID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		Expires:  session.ExpiresAt,
+	})
+	return session, nil
 }
 
 // Login handles POST requests for user authentication
@@ -38,114 +79,254 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The attempt counts as failed until the password checks out
+	accountKey := accountThrottleKey(loginReq.Username)
+	ip := clientIP(r)
+	wait, err := loginAccountThrottle.Attempt(accountKey)
+	if err != nil {
+		fmt.Printf("Login: %v\n", err)
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+	if wait, err = loginIPThrottle.Attempt(ip); err != nil {
+		fmt.Printf("Login: %v\n", err)
+	}
+	if wait > 0 {
+		if err := loginAccountThrottle.Release(accountKey); err != nil {
+			fmt.Printf("Login: %v\n", err)
+		}
+		tooManyAttempts(w, wait)
+		return
+	}
+
 	// Find user using repository
-	user := data.GetRepository().GetUserByUsername(loginReq.Username)
-	if user == nil || user.Password != loginReq.Password {
+	user := store.GetUserByUsername(loginReq.Username)
+	if user == nil || !checkPassword(user, loginReq.Password) {
+		targetID := 0
+		if user != nil {
+			targetID = user.ID
+		}
+		recordAudit(r, nil, audit.ActionLoginFailed, audit.TargetUser, targetID, "", fmt.Sprintf("username=%q", loginReq.Username))
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	// Generate session token
-	token := generateToken()
-	session := models.Session{
-		Token:  token,
-		UserID: user.ID,
+	// Only this attempt is taken off the IP counter, a single valid account
+	// must not be usable to reset it while guessing other accounts' passwords
+	if err := loginAccountThrottle.Reset(accountKey); err != nil {
+		fmt.Printf("Login: %v\n", err)
+	}
+	if err := loginIPThrottle.Release(ip); err != nil {
+		fmt.Printf("Login: %v\n", err)
 	}
 
-	sessionsMu.Lock()
-	sessions[token] = session
-	sessionsMu.Unlock()
+	if requireVerifiedEmail && !user.EmailVerified {
+		http.Error(w, "Email address not verified", http.StatusForbidden)
+		return
+	}
+	if user.Banned {
+		http.Error(w, "Account is suspended", http.StatusForbidden)
+		return
+	}
 
-	// Set cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
-		Value:    token,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: http.SameSiteLaxMode,
-		Expires:  time.Now().Add(24 * time.Hour),
-	})
+	// With two-factor authentication the session is only issued by
+	// LoginTwoFactor, in exchange for this token and a code
+	if user.TOTPEnabled {
+		token, err := pendingLogins.Create(user.ID)
+		if err != nil {
+			http.Error(w, "Failed to start login", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(models.AuthenticationInfo{
+			IsAuthenticated:   false,
+			TwoFactorRequired: true,
+			TwoFactorToken:    token,
+		})
+		return
+	}
+
+	session, err := startSession(w, r, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, audit.ActionLogin, audit.TargetUser, user.ID, "", "method=password")
 
 	w.Header().Set("Content-Type", "application/json")
 	response := models.AuthenticationInfo{
 		IsAuthenticated: true,
 		UserID:          user.ID,
 		Username:        user.Username,
+		CSRFToken:       csrfToken(session.Token),
+		Role:            authz.RoleOf(user),
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
+// checkPassword verifies password against the user's stored credentials,
+// upgrading a legacy plaintext password to a hash on first successful use
+func checkPassword(user *models.User, password string) bool {
+	if user.PasswordHash != "" {
+		ok, err := auth.VerifyPassword(user.PasswordHash, password)
+		if err != nil {
+			fmt.Printf("Login: could not verify password for user %d: %v\n", user.ID, err)
+		}
+		return ok
+	}
+
+	if user.Password == "" || !auth.VerifyLegacyPassword(user.Password, password) {
+		return false
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err == nil {
+		err = store.SetPasswordHash(user.ID, hash)
+	}
+	if err != nil {
+		// The login itself is still valid, the upgrade is retried next time
+		fmt.Printf("Login: could not upgrade legacy password for user %d: %v\n", user.ID, err)
+	}
+	return true
+}
+
 // Register handles POST requests for registration
 func Register(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	wait, err := registerThrottle.Attempt(ip)
+	if err != nil {
+		fmt.Printf("Register: %v\n", err)
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+	// Only registrations and bad invite codes count, any other failure
+	// gives the attempt back
+	counted := false
+	defer func() {
+		if counted {
+			return
+		}
+		if err := registerThrottle.Release(ip); err != nil {
+			fmt.Printf("Register: %v\n", err)
+		}
+	}()
+
 	var registration models.LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
+	username, err := registrationPolicy.ValidateUsername(registration.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := registrationPolicy.ValidatePassword(registration.Password, username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if registrationPolicy.InviteOnly && registration.InviteCode == "" {
+		http.Error(w, "An invite code is required to register", http.StatusForbidden)
+		return
+	}
+
 	// Create new user
 	user := models.User{
-		Username: registration.Username,
+		Username: username,
 		Password: registration.Password,
 	}
-	createdUser, err := data.GetRepository().CreateUser(user)
+	if registration.Email != "" {
+		email, err := parseEmail(registration.Email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user.Email = email
+	} else if requireVerifiedEmail {
+		http.Error(w, "Email address is required", http.StatusBadRequest)
+		return
+	}
+	var createdUser *models.User
+	if registrationPolicy.InviteOnly {
+		createdUser, err = store.CreateUserWithInvite(user, auth.HashToken(registration.InviteCode))
+	} else {
+		createdUser, err = store.CreateUser(user)
+	}
 	if err != nil {
 		// Check if the error is due to a duplicate username
 		if strings.Contains(err.Error(), "username already exists") {
 			http.Error(w, "Username already taken", http.StatusConflict)
+		} else if err == data.ErrInvalidInvite {
+			// Count bad codes against the throttle so they cannot be guessed
+			counted = true
+			http.Error(w, "Invalid or expired invite code", http.StatusForbidden)
 		} else {
 			http.Error(w, "Failed to create user: "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
 
-	// Automatically log in the new user
-	token := generateToken()
-	session := models.Session{
-		Token:  token,
-		UserID: createdUser.ID,
+	counted = true
+	recordAudit(r, createdUser, audit.ActionRegister, audit.TargetUser, createdUser.ID, "", fmt.Sprintf("username=%q", createdUser.Username))
+
+	if createdUser.Email != "" {
+		if err := sendVerificationEmail(createdUser, createdUser.Email); err != nil {
+			fmt.Printf("Register: could not send verification email to user %d: %v\n", createdUser.ID, err)
+		}
 	}
 
-	sessionsMu.Lock()
-	sessions[token] = session
-	sessionsMu.Unlock()
+	// Users who must verify their email first log in once they have
+	if requireVerifiedEmail {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(models.AuthenticationInfo{IsAuthenticated: false})
+		return
+	}
 
-	// Set cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
-		Value:    token,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: http.SameSiteLaxMode,
-		Expires:  time.Now().Add(24 * time.Hour),
-	})
+	// Automatically log in the new user
+	session, err := startSession(w, r, createdUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	response := models.AuthenticationInfo{
 		IsAuthenticated: true,
-		UserID:          user.ID,
-		Username:        user.Username,
+		UserID:          createdUser.ID,
+		Username:        createdUser.Username,
+		CSRFToken:       csrfToken(session.Token),
+		Role:            authz.RoleOf(createdUser),
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
 // Logout handles POST requests for user logout
 func Logout(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_token")
+	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	sessionsMu.Lock()
-	delete(sessions, cookie.Value)
-	sessionsMu.Unlock()
+	session, exists := sessionStore.Get(cookie.Value)
+	if err := sessionStore.Delete(cookie.Value); err != nil {
+		http.Error(w, "Failed to end session", http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		user := store.GetUserByID(session.UserID)
+		recordAudit(r, user, audit.ActionLogout, audit.TargetUser, session.UserID, "", "")
+	}
 
 	// Clear cookie
 	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
+		Name:     sessionCookieName,
 		Value:    "",
 		Path:     "/",
 		HttpOnly: true,
@@ -153,44 +334,110 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// AuthMiddleware checks if user is authenticated
-func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// AuthMiddleware checks if user is authenticated, either by session cookie
+// or by an "Authorization: Bearer" personal API token, and stores the
+// resulting auth.Principal in the request context. Tokens are only accepted
+// on routes that list the scopes they require, and must carry all of them.
+func AuthMiddleware(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_token")
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		principal, status, message := authenticate(r, scopes...)
+		if principal == nil {
+			http.Error(w, message, status)
 			return
 		}
+		next(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	}
+}
 
-		// print request to console for debugging
-		fmt.Printf("AuthMiddleware: Checking session token %s\n", cookie.Value)
+// OptionalAuthMiddleware is AuthMiddleware for public routes. Requests with
+// missing or invalid credentials are passed on anonymously, without a
+// principal, instead of being rejected.
+func OptionalAuthMiddleware(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principal, _, _ := authenticate(r, scopes...); principal != nil {
+			r = r.WithContext(auth.WithPrincipal(r.Context(), principal))
+		}
+		next(w, r)
+	}
+}
 
-		sessionsMu.Lock()
-		session, exists := sessions[cookie.Value]
-		sessionsMu.Unlock()
+// authenticate identifies the caller from their bearer token or session
+// cookie. If they cannot be identified it returns nil with the status and
+// message to reject the request with.
+func authenticate(r *http.Request, scopes ...string) (*auth.Principal, int, string) {
+	if bearer, ok := bearerToken(r); ok {
+		if len(scopes) == 0 {
+			return nil, http.StatusForbidden, "API tokens are not accepted for this route"
+		}
 
-		if !exists {
-			http.Error(w, "Invalid session", http.StatusUnauthorized)
-			return
+		token := store.GetAPITokenByHash(auth.HashToken(bearer))
+		if token == nil || (token.ExpiresAt != nil && !time.Now().Before(*token.ExpiresAt)) {
+			return nil, http.StatusUnauthorized, "Invalid token"
+		}
+		if !auth.HasScopes(token.Scopes, scopes...) {
+			return nil, http.StatusForbidden, "Forbidden: token is missing a required scope"
 		}
 
-		// Find the user to get username
-		user := data.GetRepository().GetUserByID(session.UserID)
+		user := store.GetUserByID(token.UserID)
 		if user == nil {
-			http.Error(w, "User not found", http.StatusUnauthorized)
-			return
+			return nil, http.StatusUnauthorized, "User not found"
+		}
+		if user.Banned {
+			return nil, http.StatusForbidden, "Account is suspended"
 		}
 
-		// Add user information to request headers
-		r.Header.Set("X-User-ID", fmt.Sprintf("%d", session.UserID))
-		r.Header.Set("X-Username", user.Username)
-		next(w, r)
+		if err := store.TouchAPIToken(token.ID); err != nil {
+			fmt.Printf("AuthMiddleware: could not record use of token %d: %v\n", token.ID, err)
+		}
+
+		return &auth.Principal{
+			User:    user,
+			Role:    authz.RoleOf(user),
+			Method:  auth.MethodAPIToken,
+			Scopes:  token.Scopes,
+			TokenID: token.ID,
+		}, 0, ""
 	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, http.StatusUnauthorized, "Unauthorized"
+	}
+
+	session, exists := sessionStore.Get(cookie.Value)
+	if !exists {
+		return nil, http.StatusUnauthorized, "Invalid session"
+	}
+
+	user := store.GetUserByID(session.UserID)
+	if user == nil {
+		return nil, http.StatusUnauthorized, "User not found"
+	}
+	if user.Banned {
+		return nil, http.StatusForbidden, "Account is suspended"
+	}
+
+	return &auth.Principal{
+		User:      user,
+		Role:      authz.RoleOf(user),
+		Method:    auth.MethodSession,
+		SessionID: session.ID,
+	}, 0, ""
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
 }
 
 // GetAuthInfo returns authentication information for the current user
 func GetAuthInfo(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_token")
+	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil {
 		// Not authenticated
 		w.Header().Set("Content-Type", "application/json")
@@ -201,12 +448,9 @@ func GetAuthInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionsMu.Lock()
-	session, exists := sessions[cookie.Value]
-	sessionsMu.Unlock()
-
+	session, exists := sessionStore.Get(cookie.Value)
 	if !exists {
-		// Invalid session
+		// Invalid or expired session
 		w.Header().Set("Content-Type", "application/json")
 		response := models.AuthenticationInfo{
 			IsAuthenticated: false,
@@ -216,7 +460,7 @@ func GetAuthInfo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Find the user to get username
-	user := data.GetRepository().GetUserByID(session.UserID)
+	user := store.GetUserByID(session.UserID)
 	if user == nil {
 		// User not found
 		w.Header().Set("Content-Type", "application/json")
@@ -233,21 +477,14 @@ func GetAuthInfo(w http.ResponseWriter, r *http.Request) {
 		IsAuthenticated: true,
 		Username:        user.Username,
 		UserID:          user.ID,
+		CSRFToken:       csrfToken(cookie.Value),
+		Role:            authz.RoleOf(user),
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
-// generateToken creates a random session token
-func generateToken() string {
-	bytes := make([]byte, 32)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)
-}
-
 // Shader API handlers
 func GetShaders(w http.ResponseWriter, r *http.Request) {
-	repo := data.GetRepository()
-
 	query := r.URL.Query()
 
 	var tag_query = query.Get("tags")
@@ -265,6 +502,12 @@ func GetShaders(w http.ResponseWriter, r *http.Request) {
 			}
 			return 0
 		}(),
+		TeamID: func() int {
+			if teamID, err := strconv.Atoi(query.Get("team_id")); err == nil {
+				return teamID
+			}
+			return 0
+		}(),
 		Limit: func() int {
 			if limit, err := strconv.Atoi(query.Get("limit")); err == nil {
 				return limit
@@ -279,15 +522,24 @@ func GetShaders(w http.ResponseWriter, r *http.Request) {
 		}(),
 	}
 
-	shaders := repo.SearchShaders(params)
+	// "Shared with me" needs to know who is asking
+	if shared, _ := strconv.ParseBool(query.Get("shared")); shared {
+		user := currentUser(r)
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		params.SharedWith = user.ID
+	}
+
+	shaders := store.SearchShaders(params)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(shaders)
 }
 
 func GetTags(w http.ResponseWriter, r *http.Request) {
-	repo := data.GetRepository()
-	tags := repo.GetAllTags()
+	tags := store.GetAllTags()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(tags)
@@ -301,7 +553,7 @@ func GetShader(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	shader := data.GetRepository().GetShaderByID(id)
+	shader := store.GetShaderByID(id)
 	if shader == nil {
 		http.Error(w, "Shader not found", http.StatusNotFound)
 		return
@@ -320,41 +572,51 @@ func UpdateShader(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user ID from authentication middleware
-	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
-	if err != nil {
+	userID, ok := currentUserID(r)
+	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// Get the existing shader to check ownership
-	existingShader := data.GetRepository().GetShaderByID(id)
+	existingShader := store.GetShaderByID(id)
 	if existingShader == nil {
 		http.Error(w, "Shader not found", http.StatusNotFound)
 		return
 	}
 
-	// Check if user owns the shader
-	if existingShader.UserID != userID {
-		http.Error(w, "Forbidden: You can only edit your own shaders", http.StatusForbidden)
+	// Owners, editors and moderators may edit the shader
+	if !canEditShader(store.GetUserByID(userID), existingShader) {
+		http.Error(w, "Forbidden: You can only edit shaders you own or collaborate on", http.StatusForbidden)
 		return
 	}
 
-	// Use the existing Shader model directly
-	var shader models.Shader
-	if err := json.NewDecoder(r.Body).Decode(&shader); err != nil {
+	// The shader, with a message describing the revision the save records
+	var body struct {
+		models.Shader
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	shader := body.Shader
 
-	// Set the ID and UserID from the request
+	// Keep the ID, owner and collaborators, an edit by someone else must not
+	// take the shader over. Collaborators have their own endpoints.
 	shader.ID = id
-	shader.UserID = userID
+	shader.UserID = existingShader.UserID
+	shader.TeamID = existingShader.TeamID
+	shader.Collaborators = existingShader.Collaborators
+	normalizeShader(&shader)
 
-	updatedShader, err := data.GetRepository().UpdateShader(id, shader)
+	revision := newRevision(userID, body.Message)
+	updatedShader, err := store.UpdateShader(id, shader, &revision)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, currentUser(r), audit.ActionShaderUpdate, audit.TargetShader, id, audit.SummarizeShader(existingShader), audit.SummarizeShader(updatedShader))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -372,57 +634,74 @@ func DeleteShader(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user ID from authentication middleware
-	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
-	if err != nil {
+	userID, ok := currentUserID(r)
+	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	// Get the existing shader to check ownership
-	existingShader := data.GetRepository().GetShaderByID(id)
+	existingShader := store.GetShaderByID(id)
 	if existingShader == nil {
 		http.Error(w, "Shader not found", http.StatusNotFound)
 		return
 	}
 
-	// Check if user owns the shader
-	if existingShader.UserID != userID {
+	// Only owners, and moderators, may delete the shader
+	if !canManageShader(store.GetUserByID(userID), existingShader) {
 		http.Error(w, "Forbidden: You can only delete your own shaders", http.StatusForbidden)
 		return
 	}
 
-	if err := data.GetRepository().DeleteShader(id); err != nil {
+	if err := store.DeleteShader(id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, currentUser(r), audit.ActionShaderDelete, audit.TargetShader, id, audit.SummarizeShader(existingShader), "")
 
 	w.Header().Set("Content-Type", "application/json")
-	response := map[string]string{"message": "Shader deleted successfully"}
+	response := map[string]string{"message": "Shader moved to the trash"}
 	json.NewEncoder(w).Encode(response)
 }
 
 func CreateShaderAPI(w http.ResponseWriter, r *http.Request) {
-	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
-	if err != nil {
+	userID, ok := currentUserID(r)
+	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Use the existing Shader model directly
-	var shader models.Shader
-	if err := json.NewDecoder(r.Body).Decode(&shader); err != nil {
+	// The shader, with a message describing its first revision
+	var body struct {
+		models.Shader
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	shader := body.Shader
 
-	// Set the UserID from authentication
+	// Set the UserID from authentication, collaborators are added afterwards
 	shader.UserID = userID
+	shader.Collaborators = nil
+	normalizeShader(&shader)
+
+	// Members may create shaders directly in their team
+	if shader.TeamID != 0 {
+		team := store.GetTeamByID(shader.TeamID)
+		if authz.TeamRole(store.GetUserByID(userID), team) == "" {
+			http.Error(w, "Forbidden: You can only create shaders in your own teams", http.StatusForbidden)
+			return
+		}
+	}
 
-	createdShader, err := data.GetRepository().CreateShader(shader)
+	createdShader, err := store.CreateShader(shader, newRevision(userID, body.Message))
 	if err != nil {
 		http.Error(w, "Failed to create shader: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, currentUser(r), audit.ActionShaderCreate, audit.TargetShader, createdShader.ID, "", audit.SummarizeShader(createdShader))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -432,6 +711,18 @@ func CreateShaderAPI(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// normalizeShader brings a shader sent by a client in line with what is
+// stored: scripts have a kind, and the author is looked up from the owner
+// rather than stored
+func normalizeShader(shader *models.Shader) {
+	shader.Author = ""
+	for i := range shader.ShaderScripts {
+		if shader.ShaderScripts[i].Kind == "" {
+			shader.ShaderScripts[i].Kind = "fragment"
+		}
+	}
+}
+
 // UpdateShaderProperties handles PUT requests for updating shader properties only
 func UpdateShaderProperties(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -442,8 +733,8 @@ func UpdateShaderProperties(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user ID from authentication middleware
-	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
-	if err != nil {
+	userID, ok := currentUserID(r)
+	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -460,27 +751,30 @@ func UpdateShaderProperties(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the existing shader first
-	existingShader := data.GetRepository().GetShaderByID(id)
+	existingShader := store.GetShaderByID(id)
 	if existingShader == nil {
 		http.Error(w, "Shader not found", http.StatusNotFound)
 		return
 	}
 
-	// Check if user owns the shader
-	if existingShader.UserID != userID {
-		http.Error(w, "Forbidden: You can only edit your own shaders", http.StatusForbidden)
+	// Owners, editors and moderators may edit the shader
+	if !canEditShader(store.GetUserByID(userID), existingShader) {
+		http.Error(w, "Forbidden: You can only edit shaders you own or collaborate on", http.StatusForbidden)
 		return
 	}
 
 	// Update only the properties
+	before := audit.SummarizeShader(existingShader)
 	existingShader.Name = updateData.Name
 	existingShader.Tags = updateData.Tags
 
-	updatedShader, err := data.GetRepository().UpdateShader(id, *existingShader)
+	// The code is unchanged, so there is no revision to record
+	updatedShader, err := store.UpdateShader(id, *existingShader, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, currentUser(r), audit.ActionShaderProps, audit.TargetShader, id, before, audit.SummarizeShader(updatedShader))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
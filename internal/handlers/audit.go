@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-server/internal/audit"
+	"go-server/internal/authz"
+	"go-server/internal/models"
+)
+
+var (
+	// Audit log, replaced at startup via SetAuditLog
+	auditLog audit.Log = audit.NewMemoryLog()
+)
+
+// SetAuditLog sets where audit entries are recorded. It must be called
+// before the server starts handling requests.
+func SetAuditLog(log audit.Log) {
+	auditLog = log
+}
+
+// recordAudit adds an entry for actor, which may be nil for anonymous
+// requests. A failure to record is logged but does not fail the request,
+// which has already taken effect.
+func recordAudit(r *http.Request, actor *models.User, action, targetType string, targetID int, before, after string) {
+	entry := models.AuditEntry{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         clientIP(r),
+		Before:     before,
+		After:      after,
+	}
+	if actor != nil {
+		entry.ActorID = actor.ID
+		entry.ActorName = actor.Username
+	}
+	if err := auditLog.Record(entry); err != nil {
+		fmt.Printf("Audit: could not record %s by user %d: %v\n", action, entry.ActorID, err)
+	}
+}
+
+// ListAuditLog returns audit entries, newest first, filtered by the actor_id,
+// action, since and until (RFC 3339) and limit query parameters
+func ListAuditLog(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, authz.ViewAuditLog); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := audit.Filter{
+		Action: query.Get("action"),
+		Limit:  100,
+	}
+
+	var err error
+	if value := query.Get("actor_id"); value != "" {
+		if filter.ActorID, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid actor_id", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid since, expected an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid until, expected an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
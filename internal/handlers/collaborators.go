@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go-server/internal/authz"
+	"go-server/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// collaboratorsWithNames fills in each collaborator's current username
+func collaboratorsWithNames(shader *models.Shader) []models.Collaborator {
+	collaborators := make([]models.Collaborator, 0, len(shader.Collaborators))
+	for _, collaborator := range shader.Collaborators {
+		if user := store.GetUserByID(collaborator.UserID); user != nil {
+			collaborator.Username = user.Username
+		}
+		collaborators = append(collaborators, collaborator)
+	}
+	return collaborators
+}
+
+// ListCollaborators returns the users a shader is shared with
+func ListCollaborators(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid shader ID", http.StatusBadRequest)
+		return
+	}
+
+	shader := store.GetShaderByID(id)
+	if shader == nil {
+		http.Error(w, "Shader not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collaboratorsWithNames(shader))
+}
+
+// SetCollaborator shares a shader with a user by username, or changes the
+// role they already have
+func SetCollaborator(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid shader ID", http.StatusBadRequest)
+		return
+	}
+
+	var collaboratorReq struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&collaboratorReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !authz.ValidShaderRole(collaboratorReq.Role) {
+		http.Error(w, "Unknown role: "+collaboratorReq.Role, http.StatusBadRequest)
+		return
+	}
+
+	shader := store.GetShaderByID(id)
+	if shader == nil {
+		http.Error(w, "Shader not found", http.StatusNotFound)
+		return
+	}
+	if !canManageShader(currentUser(r), shader) {
+		http.Error(w, "Forbidden: Only the shader's owners can share it", http.StatusForbidden)
+		return
+	}
+
+	collaborator := store.GetUserByUsername(collaboratorReq.Username)
+	if collaborator == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	updated, err := store.SetCollaborator(id, collaborator.ID, collaboratorReq.Role)
+	if err != nil {
+		if strings.Contains(err.Error(), "owner cannot be a collaborator") {
+			http.Error(w, "The shader's owner cannot be added as a collaborator", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"collaborators": collaboratorsWithNames(updated),
+		"message":       "Collaborator saved successfully",
+	})
+}
+
+// RemoveCollaborator stops sharing a shader with a user. Collaborators may
+// also remove themselves.
+func RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid shader ID", http.StatusBadRequest)
+		return
+	}
+	collaboratorID, err := strconv.Atoi(vars["user_id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	shader := store.GetShaderByID(id)
+	if shader == nil {
+		http.Error(w, "Shader not found", http.StatusNotFound)
+		return
+	}
+	user := currentUser(r)
+	if user == nil || (user.ID != collaboratorID && !canManageShader(user, shader)) {
+		http.Error(w, "Forbidden: Only the shader's owners can change who it is shared with", http.StatusForbidden)
+		return
+	}
+
+	if err := store.RemoveCollaborator(id, collaboratorID); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Collaborator not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Collaborator removed successfully"})
+}
@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"go-server/internal/auth"
+	"go-server/internal/mail"
+	"go-server/internal/models"
+)
+
+const (
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+)
+
+var (
+	// Mail delivery for account emails, nil disables sending
+	mailer mail.Mailer
+	// Base URL of the site, used to build links in emails
+	publicURL = "http://localhost:8080"
+	// Whether Login refuses users whose email address is not verified
+	requireVerifiedEmail bool
+)
+
+// SetMailer sets how account emails are delivered and the base URL used for
+// links in them
+func SetMailer(m mail.Mailer, baseURL string) {
+	mailer = m
+	publicURL = strings.TrimSuffix(baseURL, "/")
+}
+
+// SetRequireVerifiedEmail controls whether users must verify their email
+// address before they can log in
+func SetRequireVerifiedEmail(required bool) {
+	requireVerifiedEmail = required
+}
+
+// parseEmail validates an email address and returns it without any display name
+func parseEmail(email string) (string, error) {
+	address, err := netmail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return "", fmt.Errorf("invalid email address")
+	}
+	return address.Address, nil
+}
+
+// issueAccountToken creates and stores a single-use token, returning the raw
+// token to be mailed
+func issueAccountToken(userID int, purpose, email string, ttl time.Duration) (string, error) {
+	raw, err := auth.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = store.CreateAccountToken(models.AccountToken{
+		TokenHash: auth.HashToken(raw),
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+func sendMail(msg mail.Message) error {
+	if mailer == nil {
+		return fmt.Errorf("email is not configured")
+	}
+	return mailer.Send(msg)
+}
+
+// sendVerificationEmail mails a link that verifies email for user
+func sendVerificationEmail(user *models.User, email string) error {
+	token, err := issueAccountToken(user.ID, models.TokenPurposeEmailVerification, email, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	return sendMail(mail.Message{
+		To:      email,
+		Subject: "Verify your ShaderStack email address",
+		Body: fmt.Sprintf("Hi %s,\r\n\r\nConfirm this email address for your ShaderStack account by opening:\r\n\r\n%s/?verify_token=%s\r\n\r\nThe link expires in %s.\r\n",
+			user.Username, publicURL, url.QueryEscape(token), emailVerificationTTL),
+	})
+}
+
+// sendPasswordResetEmail mails a password reset link for user
+func sendPasswordResetEmail(user *models.User) error {
+	token, err := issueAccountToken(user.ID, models.TokenPurposePasswordReset, user.Email, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	return sendMail(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your ShaderStack password",
+		Body: fmt.Sprintf("Hi %s,\r\n\r\nA password reset was requested for your ShaderStack account. To choose a new password open:\r\n\r\n%s/?reset_token=%s\r\n\r\nThe link expires in %s. If you did not ask for this you can ignore this email.\r\n",
+			user.Username, publicURL, url.QueryEscape(token), passwordResetTTL),
+	})
+}
+
+// UpdateEmail sets the current user's email address and mails a
+// verification link to it. The current password is required, as the address
+// is where password resets are sent.
+func UpdateEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var emailReq struct {
+		Email           string `json:"email"`
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&emailReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user := store.GetUserByID(userID)
+	if user == nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkCurrentPassword(w, user, emailReq.CurrentPassword, "Current password is incorrect") {
+		return
+	}
+
+	email, err := parseEmail(emailReq.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := store.SetEmail(userID, email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if user = store.GetUserByID(userID); user == nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+
+	if !user.EmailVerified {
+		if err := sendVerificationEmail(user, email); err != nil {
+			http.Error(w, "Email updated but the verification email could not be sent: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"message":        "Email updated successfully",
+	})
+}
+
+// ResendVerification mails a new verification link for the current user's
+// email address
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user := store.GetUserByID(userID)
+	if user == nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if user.Email == "" {
+		http.Error(w, "No email address set", http.StatusBadRequest)
+		return
+	}
+	if user.EmailVerified {
+		http.Error(w, "Email address is already verified", http.StatusConflict)
+		return
+	}
+
+	if err := sendVerificationEmail(user, user.Email); err != nil {
+		http.Error(w, "Failed to send verification email: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent"})
+}
+
+// VerifyEmail redeems an email verification token
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var verifyReq struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&verifyReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	token, err := store.ConsumeAccountToken(auth.HashToken(verifyReq.Token), models.TokenPurposeEmailVerification)
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.VerifyEmail(token.UserID, token.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified successfully"})
+}
+
+// ForgotPassword mails a reset link to every account with the given email
+// address. It always reports success so it cannot be used to discover
+// which addresses have accounts. Every request counts against the client's
+// IP, so it cannot be used to flood mailboxes either.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	wait, err := passwordResetThrottle.Attempt(clientIP(r))
+	if err != nil {
+		fmt.Printf("ForgotPassword: %v\n", err)
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+
+	var forgotReq struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&forgotReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if email, err := parseEmail(forgotReq.Email); err == nil {
+		users := store.GetUsersByEmail(email)
+		// Send in the background so response time does not reveal a match
+		go func() {
+			for i := range users {
+				if err := sendPasswordResetEmail(&users[i]); err != nil {
+					fmt.Printf("ForgotPassword: could not send reset email to user %d: %v\n", users[i].ID, err)
+				}
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If an account uses that address, a reset link has been sent",
+	})
+}
+
+// ResetPassword redeems a password reset token, setting a new password and
+// signing the user out everywhere
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var resetReq struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resetReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tokenHash := auth.HashToken(resetReq.Token)
+
+	// Check the new password before using up the token, so the user can retry
+	// with a stronger one
+	if pending := store.GetAccountToken(tokenHash, models.TokenPurposePasswordReset); pending != nil {
+		username := ""
+		if user := store.GetUserByID(pending.UserID); user != nil {
+			username = user.Username
+		}
+		if err := registrationPolicy.ValidatePassword(resetReq.NewPassword, username); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, err := store.ConsumeAccountToken(tokenHash, models.TokenPurposePasswordReset)
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := auth.HashPassword(resetReq.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	if err := store.SetPasswordHash(token.UserID, hash); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The reset link reached the user's inbox, so the address is verified
+	if user := store.GetUserByID(token.UserID); user != nil && !user.EmailVerified {
+		if err := store.VerifyEmail(token.UserID, token.Email); err != nil {
+			fmt.Printf("ResetPassword: could not mark email verified for user %d: %v\n", token.UserID, err)
+		}
+	}
+
+	if _, err := sessionStore.DeleteByUser(token.UserID, ""); err != nil {
+		http.Error(w, "Password reset but existing sessions could not be signed out", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully"})
+}
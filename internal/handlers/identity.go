@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+
+	"go-server/internal/auth"
+	"go-server/internal/models"
+)
+
+// Headers that once carried the authenticated identity. Clients must not be
+// able to set them, in case anything still trusts them.
+var identityHeaders = []string{"X-User-ID", "X-Username", "X-Session-ID"}
+
+// StripIdentityHeaders removes client-supplied identity headers from every
+// request. Handlers read the caller from the request context instead.
+func StripIdentityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range identityHeaders {
+			r.Header.Del(header)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// currentPrincipal returns the principal set by AuthMiddleware or
+// OptionalAuthMiddleware, or nil for anonymous requests
+func currentPrincipal(r *http.Request) *auth.Principal {
+	return auth.PrincipalFromContext(r.Context())
+}
+
+// currentUser returns the authenticated user, or nil
+func currentUser(r *http.Request) *models.User {
+	if principal := currentPrincipal(r); principal != nil {
+		return principal.User
+	}
+	return nil
+}
+
+// currentUserID returns the authenticated user's ID, and false for anonymous
+// requests
+func currentUserID(r *http.Request) (int, bool) {
+	userID := currentPrincipal(r).UserID()
+	return userID, userID != 0
+}
+
+// currentSessionID returns the ID of the session making the request, or ""
+// if it was not made with a session
+func currentSessionID(r *http.Request) string {
+	if principal := currentPrincipal(r); principal != nil {
+		return principal.SessionID
+	}
+	return ""
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go-server/internal/audit"
+	"go-server/internal/models"
+	"go-server/internal/oidc"
+)
+
+const oidcStateCookieName = "oidc_state"
+
+// oidcLinkTTL is how long a user has to complete a link at the identity
+// provider, as long as the provider keeps the sign-on itself
+const oidcLinkTTL = 10 * time.Minute
+
+// errRegistrationClosed is returned when an unknown identity signs in while
+// registration is invite-only
+var errRegistrationClosed = errors.New("registration is by invite only")
+
+var (
+	// Identity provider for single sign-on, nil when it is not configured
+	oidcProvider *oidc.Provider
+
+	// Sign-ons started by OIDCLink, by state
+	oidcLinks   = make(map[string]pendingOIDCLink)
+	oidcLinksMu sync.Mutex
+)
+
+// pendingOIDCLink is a link of an identity to userID waiting for the
+// identity provider
+type pendingOIDCLink struct {
+	userID    int
+	expiresAt time.Time
+}
+
+// SetOIDCProvider enables single sign-on through provider
+func SetOIDCProvider(provider *oidc.Provider) {
+	oidcProvider = provider
+}
+
+// OIDCLogin starts a single sign-on by redirecting to the identity provider
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	if _, redirect, ok := startOIDC(w); ok {
+		http.Redirect(w, r, redirect, http.StatusFound)
+	}
+}
+
+// OIDCLink starts linking an identity at the identity provider to the
+// current user. The request is a POST, so the URL to send the browser to is
+// returned rather than redirected to.
+func OIDCLink(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	state, redirect, ok := startOIDC(w)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	oidcLinksMu.Lock()
+	for key, link := range oidcLinks {
+		if now.After(link.expiresAt) {
+			delete(oidcLinks, key)
+		}
+	}
+	oidcLinks[state] = pendingOIDCLink{userID: userID, expiresAt: now.Add(oidcLinkTTL)}
+	oidcLinksMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"redirect": redirect})
+}
+
+// startOIDC begins a sign-on at the identity provider and returns its state
+// and the URL to send the browser to. It writes the error itself on failure.
+func startOIDC(w http.ResponseWriter) (string, string, bool) {
+	state, redirect, err := oidcProvider.AuthCodeURL()
+	if err != nil {
+		fmt.Printf("startOIDC: %v\n", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return "", "", false
+	}
+
+	// Bind the login to this browser so a callback cannot be replayed in another
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/api/oidc",
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   600,
+	})
+	return state, redirect, true
+}
+
+// takeOIDCLink returns the user who started the link for state, if the
+// sign-on is one. The link can only be completed once.
+func takeOIDCLink(state string) (int, bool) {
+	oidcLinksMu.Lock()
+	defer oidcLinksMu.Unlock()
+	link, exists := oidcLinks[state]
+	delete(oidcLinks, state)
+	if !exists || time.Now().After(link.expiresAt) {
+		return 0, false
+	}
+	return link.userID, true
+}
+
+// OIDCCallback completes a single sign-on and issues the same session cookie
+// as Login, provisioning an account on first use. A sign-on started by
+// OIDCLink links the identity instead.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		http.Error(w, "Sign-in was denied by the identity provider: "+reason, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Invalid sign-in state", http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/api/oidc",
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+
+	identity, err := oidcProvider.Exchange(state, query.Get("code"))
+	if err != nil {
+		fmt.Printf("OIDCCallback: %v\n", err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+
+	if userID, linking := takeOIDCLink(state); linking {
+		linkOIDCIdentity(w, r, userID, identity)
+		return
+	}
+
+	user, err := resolveOIDCUser(identity)
+	if err == errRegistrationClosed {
+		http.Error(w, "This account is not registered and registration is by invite only", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to sign in: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if user.Banned {
+		http.Error(w, "Account is suspended", http.StatusForbidden)
+		return
+	}
+
+	// Accounts with two-factor authentication still need a code. The token
+	// goes in the fragment so it is never sent back to the server in a URL.
+	if user.TOTPEnabled {
+		token, err := pendingLogins.Create(user.ID)
+		if err != nil {
+			http.Error(w, "Failed to start login", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/#two_factor_token="+token, http.StatusSeeOther)
+		return
+	}
+
+	if _, err := startSession(w, r, user.ID); err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, audit.ActionLogin, audit.TargetUser, user.ID, "", "method=oidc")
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// linkOIDCIdentity completes a link started by OIDCLink. The browser must
+// still be signed in as the user who started it.
+func linkOIDCIdentity(w http.ResponseWriter, r *http.Request, userID int, identity *oidc.Identity) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		http.Error(w, "Sign in again to link this identity", http.StatusForbidden)
+		return
+	}
+	if session, exists := sessionStore.Get(cookie.Value); !exists || session.UserID != userID {
+		http.Error(w, "Sign in again to link this identity", http.StatusForbidden)
+		return
+	}
+
+	link := models.ExternalIdentity{Issuer: identity.Issuer, Subject: identity.Subject}
+	if err := store.LinkIdentity(userID, link); err != nil {
+		if strings.Contains(err.Error(), "already linked") {
+			http.Error(w, "This identity is already linked to another account", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to link identity: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, store.GetUserByID(userID), audit.ActionIdentityLink, audit.TargetUser, userID, "", "issuer="+identity.Issuer)
+
+	http.Redirect(w, r, "/#identity_linked", http.StatusSeeOther)
+}
+
+// resolveOIDCUser finds the user linked to identity, or provisions a new
+// user for it. Identities are only linked to existing users by OIDCLink.
+func resolveOIDCUser(identity *oidc.Identity) (*models.User, error) {
+	link := models.ExternalIdentity{Issuer: identity.Issuer, Subject: identity.Subject}
+
+	if user := store.GetUserByIdentity(link); user != nil {
+		return user, nil
+	}
+
+	// Single sign-on cannot bypass invite-only registration, but existing
+	// users can still link an identity with OIDCLink
+	if registrationPolicy.InviteOnly {
+		return nil, errRegistrationClosed
+	}
+
+	base := oidcUsername(identity)
+	for i := 1; i <= 100; i++ {
+		username := base
+		if i > 1 {
+			username = fmt.Sprintf("%s%d", base, i)
+		}
+		// Skip reserved or otherwise unacceptable names, a suffix may fix them
+		if _, err := registrationPolicy.ValidateUsername(username); err != nil {
+			continue
+		}
+
+		user, err := store.CreateUser(models.User{Username: username, Identities: []models.ExternalIdentity{link}})
+		if err == nil {
+			return user, nil
+		}
+		if !strings.Contains(err.Error(), "username already exists") {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free username for %s", base)
+}
+
+// oidcUsername picks a username for a provisioned account from the claims
+// the identity provider supplied
+func oidcUsername(identity *oidc.Identity) string {
+	email := identity.Email
+	if at := strings.Index(email, "@"); at >= 0 {
+		email = email[:at]
+	}
+
+	for _, candidate := range []string{identity.PreferredUsername, email, identity.Name} {
+		cleaned := strings.Map(func(c rune) rune {
+			if unicode.IsLetter(c) || unicode.IsDigit(c) || c == '-' || c == '_' || c == '.' {
+				return c
+			}
+			return -1
+		}, candidate)
+		// Usernames must start with a letter or digit, and leave room for a suffix
+		cleaned = strings.TrimLeft(cleaned, "-_.")
+		if runes := []rune(cleaned); len(runes) > registrationPolicy.MaxUsernameLength-3 && registrationPolicy.MaxUsernameLength > 3 {
+			cleaned = string(runes[:registrationPolicy.MaxUsernameLength-3])
+		}
+		if cleaned != "" {
+			return cleaned
+		}
+	}
+	return "user"
+}
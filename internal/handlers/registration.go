@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-server/internal/auth"
+	"go-server/internal/authz"
+	"go-server/internal/models"
+	"go-server/internal/policy"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	// Rules for usernames and passwords, and whether registration needs an invite
+	registrationPolicy = policy.DefaultRegistrationPolicy()
+)
+
+// SetRegistrationPolicy sets the rules applied when accounts are created or
+// their username or password changes
+func SetRegistrationPolicy(p policy.RegistrationPolicy) {
+	registrationPolicy = p
+}
+
+// ListInvites returns all invites, used or not
+func ListInvites(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, authz.ManageInvites); !ok {
+		return
+	}
+
+	invites := store.GetInvites()
+	for i := range invites {
+		invites[i].CodeHash = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+// CreateInvite issues a single-use invite code. The raw code is only ever
+// returned in this response.
+func CreateInvite(w http.ResponseWriter, r *http.Request) {
+	user, ok := requirePermission(w, r, authz.ManageInvites)
+	if !ok {
+		return
+	}
+
+	var inviteReq struct {
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}
+	// The body is optional
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&inviteReq); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if inviteReq.ExpiresAt != nil && !inviteReq.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	code, err := auth.GenerateToken()
+	if err != nil {
+		http.Error(w, "Failed to generate invite code", http.StatusInternalServerError)
+		return
+	}
+
+	created, err := store.CreateInvite(models.Invite{
+		CodeHash:  auth.HashToken(code),
+		CreatedBy: user.ID,
+		CreatedAt: time.Now(),
+		ExpiresAt: inviteReq.ExpiresAt,
+	})
+	if err != nil {
+		http.Error(w, "Failed to create invite: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	created.CodeHash = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    code,
+		"info":    created,
+		"message": "Invite created successfully, the code will not be shown again",
+	})
+}
+
+// DeleteInvite revokes an unused invite
+func DeleteInvite(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, authz.ManageInvites); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid invite ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.DeleteInvite(id); err != nil {
+		if strings.Contains(err.Error(), "already been used") {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Invite revoked successfully"})
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-server/internal/audit"
+	"go-server/internal/diff"
+	"go-server/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// newRevision describes the revision a save by userID records
+func newRevision(userID int, message string) models.ShaderRevision {
+	return models.ShaderRevision{UserID: userID, Message: strings.TrimSpace(message), CreatedAt: time.Now().UTC()}
+}
+
+// shaderFromRoute looks up the shader named in the route, writing the error
+// response if there is none
+func shaderFromRoute(w http.ResponseWriter, r *http.Request) (*models.Shader, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid shader ID", http.StatusBadRequest)
+		return nil, false
+	}
+	shader := store.GetShaderByID(id)
+	if shader == nil {
+		http.Error(w, "Shader not found", http.StatusNotFound)
+		return nil, false
+	}
+	return shader, true
+}
+
+// GetRevisions lists the revisions of a shader, newest first, without their
+// code
+func GetRevisions(w http.ResponseWriter, r *http.Request) {
+	shader, ok := shaderFromRoute(w, r)
+	if !ok {
+		return
+	}
+
+	revisions := store.GetShaderRevisions(shader.ID)
+	authors := make(map[int]string)
+	for i := range revisions {
+		userID := revisions[i].UserID
+		if _, found := authors[userID]; !found {
+			authors[userID] = "Unknown"
+			if user := store.GetUserByID(userID); user != nil {
+				authors[userID] = user.Username
+			}
+		}
+		revisions[i].Author = authors[userID]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// GetRevision returns one revision of a shader with its code
+func GetRevision(w http.ResponseWriter, r *http.Request) {
+	shader, ok := shaderFromRoute(w, r)
+	if !ok {
+		return
+	}
+	number, err := strconv.Atoi(mux.Vars(r)["number"])
+	if err != nil {
+		http.Error(w, "Invalid revision number", http.StatusBadRequest)
+		return
+	}
+
+	revision := store.GetShaderRevision(shader.ID, number)
+	if revision == nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	revision.Author = "Unknown"
+	if user := store.GetUserByID(revision.UserID); user != nil {
+		revision.Author = user.Username
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revision)
+}
+
+// scriptDiff is how one script differs between two revisions
+type scriptDiff struct {
+	ScriptID int    `json:"script_id"` // 0 for the common script
+	Name     string `json:"name"`
+	Status   string `json:"status"` // "added", "removed" or "modified"
+	Diff     string `json:"diff"`   // Unified diff of the code, "" if only the buffer or kind changed
+}
+
+// DiffRevisions compares two revisions of a shader, given as the from and to
+// query parameters, script by script. to defaults to the latest revision and
+// from to the one before to. Scripts that did not change are left out.
+func DiffRevisions(w http.ResponseWriter, r *http.Request) {
+	shader, ok := shaderFromRoute(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	to := 0
+	if value := query.Get("to"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid revision number", http.StatusBadRequest)
+			return
+		}
+		to = number
+	} else if revisions := store.GetShaderRevisions(shader.ID); len(revisions) > 0 {
+		to = revisions[0].Number
+	}
+	from := to - 1
+	if value := query.Get("from"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid revision number", http.StatusBadRequest)
+			return
+		}
+		from = number
+	}
+
+	fromRevision := store.GetShaderRevision(shader.ID, from)
+	toRevision := store.GetShaderRevision(shader.ID, to)
+	if fromRevision == nil || toRevision == nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"shader_id": shader.ID,
+		"from":      from,
+		"to":        to,
+		"scripts":   diffRevisions(fromRevision, toRevision),
+	})
+}
+
+// diffRevisions compares the common script and then each script of two
+// revisions, matching scripts by ID
+func diffRevisions(from, to *models.ShaderRevision) []scriptDiff {
+	label := func(revision *models.ShaderRevision, name string) string {
+		return fmt.Sprintf("r%d/%s", revision.Number, name)
+	}
+
+	diffs := []scriptDiff{}
+	if from.CommonScript != to.CommonScript {
+		name := "common"
+		diffs = append(diffs, scriptDiff{
+			Name:   name,
+			Status: "modified",
+			Diff:   diff.Unified(label(from, name), label(to, name), from.CommonScript, to.CommonScript, diffContext),
+		})
+	}
+
+	before := make(map[int]models.ShaderScript)
+	for _, script := range from.ShaderScripts {
+		before[script.ID] = script
+	}
+	after := make(map[int]bool)
+	for _, script := range to.ShaderScripts {
+		after[script.ID] = true
+		name := fmt.Sprintf("script-%d", script.ID)
+		previous, existed := before[script.ID]
+		switch {
+		case !existed:
+			diffs = append(diffs, scriptDiff{
+				ScriptID: script.ID,
+				Name:     name,
+				Status:   "added",
+				Diff:     diff.Unified("/dev/null", label(to, name), "", script.Code, diffContext),
+			})
+		case !reflect.DeepEqual(previous, script):
+			diffs = append(diffs, scriptDiff{
+				ScriptID: script.ID,
+				Name:     name,
+				Status:   "modified",
+				Diff:     diff.Unified(label(from, name), label(to, name), previous.Code, script.Code, diffContext),
+			})
+		}
+	}
+	for _, script := range from.ShaderScripts {
+		if after[script.ID] {
+			continue
+		}
+		name := fmt.Sprintf("script-%d", script.ID)
+		diffs = append(diffs, scriptDiff{
+			ScriptID: script.ID,
+			Name:     name,
+			Status:   "removed",
+			Diff:     diff.Unified(label(from, name), "/dev/null", script.Code, "", diffContext),
+		})
+	}
+	return diffs
+}
+
+// RevertShader brings back the code of an earlier revision, which is
+// recorded as a new revision. The name, tags and everything else stay as
+// they are.
+func RevertShader(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	existingShader, ok := shaderFromRoute(w, r)
+	if !ok {
+		return
+	}
+	number, err := strconv.Atoi(mux.Vars(r)["number"])
+	if err != nil {
+		http.Error(w, "Invalid revision number", http.StatusBadRequest)
+		return
+	}
+
+	// Owners, editors and moderators may edit the shader
+	if !canEditShader(user, existingShader) {
+		http.Error(w, "Forbidden: You can only edit shaders you own or collaborate on", http.StatusForbidden)
+		return
+	}
+
+	var revertReq struct {
+		Message string `json:"message"`
+	}
+	// The body is optional
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&revertReq); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	target := store.GetShaderRevision(existingShader.ID, number)
+	if target == nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	shader := *existingShader
+	shader.CommonScript = target.CommonScript
+	shader.ShaderScripts = target.ShaderScripts
+	normalizeShader(&shader)
+
+	revision := newRevision(user.ID, revertReq.Message)
+	if revision.Message == "" {
+		revision.Message = fmt.Sprintf("Revert to revision %d", number)
+	}
+	revision.RevertOf = number
+
+	updatedShader, err := store.UpdateShader(shader.ID, shader, &revision)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Shader not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, audit.ActionShaderRevert, audit.TargetShader, shader.ID, audit.SummarizeShader(existingShader), audit.SummarizeShader(updatedShader))
+
+	latest := 0
+	if revisions := store.GetShaderRevisions(shader.ID); len(revisions) > 0 {
+		latest = revisions[0].Number
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       updatedShader.ID,
+		"message":  fmt.Sprintf("Shader reverted to revision %d", number),
+		"revision": latest,
+		"shader":   updatedShader,
+	})
+}
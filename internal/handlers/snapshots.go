@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"go-server/internal/audit"
+	"go-server/internal/authz"
+	"go-server/internal/snapshot"
+)
+
+var (
+	// Snapshot archives, set at startup via SetSnapshotManager
+	snapshots *snapshot.Manager
+)
+
+// SetSnapshotManager sets where snapshots are taken and kept. It must be
+// called before the server starts handling requests.
+func SetSnapshotManager(manager *snapshot.Manager) {
+	snapshots = manager
+}
+
+// ListSnapshots returns the snapshot archives kept, newest first
+func ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, authz.ManageSnapshots); !ok {
+		return
+	}
+	if snapshots == nil {
+		http.Error(w, "Snapshots are not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	archives, err := snapshots.List()
+	if err != nil {
+		http.Error(w, "Failed to list snapshots", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(archives)
+}
+
+// CreateSnapshot takes a snapshot of users, shaders, tags and teams now
+func CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	actor, ok := requirePermission(w, r, authz.ManageSnapshots)
+	if !ok {
+		return
+	}
+	if snapshots == nil {
+		http.Error(w, "Snapshots are not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	info, err := snapshots.Create()
+	if err != nil {
+		fmt.Printf("Snapshot failed: %v\n", err)
+		http.Error(w, "Failed to create snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, actor, audit.ActionSnapshot, audit.TargetData, 0, "", fmt.Sprintf("name=%q", info.Name))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go-server/internal/audit"
+	"go-server/internal/authz"
+
+	"github.com/gorilla/mux"
+)
+
+// RenameTag changes a tag's name on every shader that uses it
+func RenameTag(w http.ResponseWriter, r *http.Request) {
+	actor, ok := requirePermission(w, r, authz.ManageTags)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+
+	var tagReq struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&tagReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(tagReq.Name)
+	if name == "" {
+		http.Error(w, "Tag name is required", http.StatusBadRequest)
+		return
+	}
+
+	before := ""
+	if existing := store.GetTagByID(id); existing != nil {
+		before = fmt.Sprintf("name=%q", existing.Name)
+	}
+
+	tag, err := store.RenameTag(id, name)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "tag not found"):
+			http.Error(w, "Tag not found", http.StatusNotFound)
+		case strings.Contains(err.Error(), "tag already exists"):
+			http.Error(w, "A tag with that name already exists", http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	recordAudit(r, actor, audit.ActionTagRename, audit.TargetTag, id, before, fmt.Sprintf("name=%q", tag.Name))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tag)
+}
+
+// DeleteTag removes a tag from the site and from every shader that uses it
+func DeleteTag(w http.ResponseWriter, r *http.Request) {
+	actor, ok := requirePermission(w, r, authz.ManageTags)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+
+	before := ""
+	if existing := store.GetTagByID(id); existing != nil {
+		before = fmt.Sprintf("name=%q", existing.Name)
+	}
+
+	if err := store.DeleteTag(id); err != nil {
+		if strings.Contains(err.Error(), "tag not found") {
+			http.Error(w, "Tag not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	recordAudit(r, actor, audit.ActionTagDelete, audit.TargetTag, id, before, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Tag deleted successfully"})
+}
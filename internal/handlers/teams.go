@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-server/internal/authz"
+	"go-server/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// shaderTeam returns the team that owns shader, or nil if a user owns it
+func shaderTeam(shader *models.Shader) *models.Team {
+	if shader == nil || shader.TeamID == 0 {
+		return nil
+	}
+	return store.GetTeamByID(shader.TeamID)
+}
+
+// canEditShader checks authz.CanEditShader against the shader's team
+func canEditShader(user *models.User, shader *models.Shader) bool {
+	return authz.CanEditShader(user, shader, shaderTeam(shader))
+}
+
+// canManageShader checks authz.CanManageShader against the shader's team
+func canManageShader(user *models.User, shader *models.Shader) bool {
+	return authz.CanManageShader(user, shader, shaderTeam(shader))
+}
+
+// teamWithNames fills in each member's current username
+func teamWithNames(team *models.Team) *models.Team {
+	members := make([]models.TeamMember, 0, len(team.Members))
+	for _, member := range team.Members {
+		if user := store.GetUserByID(member.UserID); user != nil {
+			member.Username = user.Username
+		}
+		members = append(members, member)
+	}
+	named := *team
+	named.Members = members
+	return &named
+}
+
+// teamFromRoute looks up the team named in the route, writing the error
+// response if there is none
+func teamFromRoute(w http.ResponseWriter, r *http.Request) (*models.Team, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid team ID", http.StatusBadRequest)
+		return nil, false
+	}
+	team := store.GetTeamByID(id)
+	if team == nil {
+		http.Error(w, "Team not found", http.StatusNotFound)
+		return nil, false
+	}
+	return team, true
+}
+
+// requireTeamOwner checks the current user owns team, writing the error
+// response if not
+func requireTeamOwner(w http.ResponseWriter, r *http.Request, team *models.Team) (*models.User, bool) {
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	if authz.TeamRole(user, team) != models.TeamRoleOwner {
+		http.Error(w, "Forbidden: Only team owners can do that", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// ListTeams returns all teams, or with ?mine=true only the current user's
+func ListTeams(w http.ResponseWriter, r *http.Request) {
+	userID := 0
+	if mine, _ := strconv.ParseBool(r.URL.Query().Get("mine")); mine {
+		user := currentUser(r)
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID = user.ID
+	}
+
+	teams := store.GetTeams(userID)
+	for i := range teams {
+		teams[i] = *teamWithNames(&teams[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(teams)
+}
+
+// GetTeam returns a team and its members
+func GetTeam(w http.ResponseWriter, r *http.Request) {
+	team, ok := teamFromRoute(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(teamWithNames(team))
+}
+
+// CreateTeam creates a team with the current user as its owner
+func CreateTeam(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var teamReq struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&teamReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(teamReq.Name)
+	if name == "" {
+		http.Error(w, "Team name is required", http.StatusBadRequest)
+		return
+	}
+
+	team, err := store.CreateTeam(name, userID, time.Now())
+	if err != nil {
+		if strings.Contains(err.Error(), "team name already exists") {
+			http.Error(w, "Team name already taken", http.StatusConflict)
+		} else {
+			http.Error(w, "Failed to create team: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(teamWithNames(team))
+}
+
+// RenameTeam changes the name of a team the current user owns
+func RenameTeam(w http.ResponseWriter, r *http.Request) {
+	team, ok := teamFromRoute(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := requireTeamOwner(w, r, team); !ok {
+		return
+	}
+
+	var teamReq struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&teamReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(teamReq.Name)
+	if name == "" {
+		http.Error(w, "Team name is required", http.StatusBadRequest)
+		return
+	}
+
+	renamed, err := store.RenameTeam(team.ID, name)
+	if err != nil {
+		if strings.Contains(err.Error(), "team name already exists") {
+			http.Error(w, "Team name already taken", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(teamWithNames(renamed))
+}
+
+// DeleteTeam deletes a team the current user owns once it has no shaders left
+func DeleteTeam(w http.ResponseWriter, r *http.Request) {
+	team, ok := teamFromRoute(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := requireTeamOwner(w, r, team); !ok {
+		return
+	}
+
+	if err := store.DeleteTeam(team.ID); err != nil {
+		if strings.Contains(err.Error(), "still owns shaders") {
+			http.Error(w, "Move or delete the team's shaders first", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Team deleted successfully"})
+}
+
+// SetTeamMember adds a user to a team by username, or changes their role
+func SetTeamMember(w http.ResponseWriter, r *http.Request) {
+	team, ok := teamFromRoute(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := requireTeamOwner(w, r, team); !ok {
+		return
+	}
+
+	var memberReq struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&memberReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !authz.ValidTeamRole(memberReq.Role) {
+		http.Error(w, "Unknown role: "+memberReq.Role, http.StatusBadRequest)
+		return
+	}
+
+	member := store.GetUserByUsername(memberReq.Username)
+	if member == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	updated, err := store.SetTeamMember(team.ID, member.ID, memberReq.Role)
+	if err != nil {
+		if strings.Contains(err.Error(), "at least one owner") {
+			http.Error(w, "A team must keep at least one owner", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(teamWithNames(updated))
+}
+
+// RemoveTeamMember takes a user out of a team. Members may also remove
+// themselves.
+func RemoveTeamMember(w http.ResponseWriter, r *http.Request) {
+	team, ok := teamFromRoute(w, r)
+	if !ok {
+		return
+	}
+	memberID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if user.ID != memberID {
+		if _, ok := requireTeamOwner(w, r, team); !ok {
+			return
+		}
+	}
+
+	if err := store.RemoveTeamMember(team.ID, memberID); err != nil {
+		switch {
+		case strings.Contains(err.Error(), "member not found"):
+			http.Error(w, "Member not found", http.StatusNotFound)
+		case strings.Contains(err.Error(), "at least one owner"):
+			http.Error(w, "A team must keep at least one owner", http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Member removed successfully"})
+}
+
+// SetShaderTeam moves a shader into one of the current user's teams, or with
+// team_id 0 out of its team to the current user. The user must be able to
+// manage the shader and, when moving it out of a team, own that team.
+func SetShaderTeam(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid shader ID", http.StatusBadRequest)
+		return
+	}
+
+	var teamReq struct {
+		TeamID int `json:"team_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&teamReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	shader := store.GetShaderByID(id)
+	if shader == nil {
+		http.Error(w, "Shader not found", http.StatusNotFound)
+		return
+	}
+	user := currentUser(r)
+	if !canManageShader(user, shader) {
+		http.Error(w, "Forbidden: Only the shader's owners can move it", http.StatusForbidden)
+		return
+	}
+	if teamReq.TeamID != 0 && authz.TeamRole(user, store.GetTeamByID(teamReq.TeamID)) == "" {
+		http.Error(w, "Forbidden: You can only move shaders into your own teams", http.StatusForbidden)
+		return
+	}
+
+	updated, err := store.SetShaderTeam(id, teamReq.TeamID, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      updated.ID,
+		"team_id": updated.TeamID,
+		"message": "Shader owner changed successfully",
+	})
+}
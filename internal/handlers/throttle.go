@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-server/internal/auth"
+	"go-server/internal/policy"
+)
+
+var (
+	// Failed logins per username
+	loginAccountThrottle *auth.Throttle
+	// Failed logins per client IP, across all usernames
+	loginIPThrottle *auth.Throttle
+	// Successful registrations per client IP
+	registerThrottle *auth.Throttle
+	// Password reset requests per client IP
+	passwordResetThrottle *auth.Throttle
+)
+
+func init() {
+	SetAttemptStore(auth.NewMemoryAttemptStore())
+}
+
+// SetAttemptStore sets where login, registration and password reset
+// throttling counters are kept. It must be called before the server starts
+// handling requests.
+func SetAttemptStore(store auth.AttemptStore) {
+	loginAccountThrottle = auth.NewThrottle("login-account", auth.ThrottleConfig{
+		Threshold:   5,
+		BaseLockout: 30 * time.Second,
+		MaxLockout:  15 * time.Minute,
+		Window:      time.Hour,
+	}, store)
+	loginIPThrottle = auth.NewThrottle("login-ip", auth.ThrottleConfig{
+		Threshold:   20,
+		BaseLockout: 30 * time.Second,
+		MaxLockout:  time.Hour,
+		Window:      time.Hour,
+	}, store)
+	registerThrottle = auth.NewThrottle("register-ip", auth.ThrottleConfig{
+		Threshold:   5,
+		BaseLockout: 10 * time.Minute,
+		MaxLockout:  24 * time.Hour,
+		Window:      24 * time.Hour,
+	}, store)
+	passwordResetThrottle = auth.NewThrottle("password-reset-ip", auth.ThrottleConfig{
+		Threshold:   5,
+		BaseLockout: 10 * time.Minute,
+		MaxLockout:  24 * time.Hour,
+		Window:      24 * time.Hour,
+	}, store)
+}
+
+// tooManyAttempts rejects a throttled request, telling the client when to retry
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many attempts, try again in "+strconv.Itoa(seconds)+" seconds", http.StatusTooManyRequests)
+}
+
+// accountThrottleKey normalises usernames the way they are looked up, so
+// that every spelling that reaches an account shares its counter
+func accountThrottleKey(username string) string {
+	return policy.CanonicalUsername(strings.TrimSpace(username))
+}
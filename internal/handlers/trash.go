@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go-server/internal/audit"
+	"go-server/internal/authz"
+	"go-server/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// GetTrash lists the deleted shaders the current user owns, most recently
+// deleted first
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	shaders := []models.Shader{}
+	for _, shader := range store.GetDeletedShaders() {
+		if authz.ShaderRole(user, &shader, shaderTeam(&shader)) != models.ShaderRoleOwner {
+			continue
+		}
+		if owner := store.GetUserByID(shader.UserID); owner != nil {
+			shader.Author = owner.Username
+		} else {
+			shader.Author = "Unknown"
+		}
+		shaders = append(shaders, shader)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shaders)
+}
+
+// RestoreShader takes a shader out of the trash. Only those who could have
+// deleted it may restore it.
+func RestoreShader(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid shader ID", http.StatusBadRequest)
+		return
+	}
+
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	deleted := store.GetDeletedShaderByID(id)
+	if deleted == nil {
+		http.Error(w, "Shader not found in trash", http.StatusNotFound)
+		return
+	}
+	if !canManageShader(user, deleted) {
+		http.Error(w, "Forbidden: You can only restore your own shaders", http.StatusForbidden)
+		return
+	}
+
+	restored, err := store.RestoreShader(id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Shader not found in trash", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, audit.ActionShaderRestore, audit.TargetShader, id, "", audit.SummarizeShader(restored))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restored)
+}
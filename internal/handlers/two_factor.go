@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go-server/internal/audit"
+	"go-server/internal/auth"
+	"go-server/internal/authz"
+	"go-server/internal/data"
+	"go-server/internal/models"
+	"go-server/internal/sweeper"
+)
+
+// totpIssuer names the site in authenticator apps
+const totpIssuer = "ShaderStack"
+
+var (
+	// Logins waiting for a second factor
+	pendingLogins = auth.NewPendingLogins(5*time.Minute, 5)
+)
+
+// StartPendingLoginSweeper periodically removes expired pending logins until
+// the returned stop function is called
+func StartPendingLoginSweeper(interval time.Duration) (stop func()) {
+	return sweeper.Start("pending login", interval, pendingLogins.DeleteExpired)
+}
+
+// verifySecondFactor checks a TOTP code, or failing that a recovery code,
+// for user, using it up if it is valid
+func verifySecondFactor(user *models.User, code, recoveryCode string) bool {
+	if code != "" {
+		step, ok := auth.VerifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+		if !ok {
+			return false
+		}
+		if err := store.UseTOTPStep(user.ID, step); err != nil {
+			if err != data.ErrCodeReused {
+				fmt.Printf("verifySecondFactor: could not record code for user %d: %v\n", user.ID, err)
+			}
+			return false
+		}
+		return true
+	}
+
+	if recoveryCode != "" {
+		used, err := store.UseRecoveryCode(user.ID, auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			fmt.Printf("verifySecondFactor: could not use recovery code for user %d: %v\n", user.ID, err)
+			return false
+		}
+		return used
+	}
+
+	return false
+}
+
+// checkSecondFactor verifies a second factor for user, counting wrong codes
+// against the same throttle as wrong passwords. If it fails, the error
+// response is written, with status for an invalid code.
+func checkSecondFactor(w http.ResponseWriter, user *models.User, code, recoveryCode string, status int) bool {
+	accountKey := accountThrottleKey(user.Username)
+	wait, err := loginAccountThrottle.Attempt(accountKey)
+	if err != nil {
+		fmt.Printf("checkSecondFactor: %v\n", err)
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return false
+	}
+
+	if !verifySecondFactor(user, code, recoveryCode) {
+		http.Error(w, "Invalid code", status)
+		return false
+	}
+
+	if err := loginAccountThrottle.Reset(accountKey); err != nil {
+		fmt.Printf("checkSecondFactor: %v\n", err)
+	}
+	return true
+}
+
+// newRecoveryCodes generates a fresh set of recovery codes, returning them
+// and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := auth.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, auth.HashToken(auth.NormalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+// LoginTwoFactor completes a login that needs a second factor, exchanging
+// the token from Login and a TOTP or recovery code for a session
+func LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var twoFactorReq struct {
+		Token        string `json:"two_factor_token"`
+		Code         string `json:"code,omitempty"`
+		RecoveryCode string `json:"recovery_code,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&twoFactorReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := pendingLogins.Get(twoFactorReq.Token)
+	if !ok {
+		http.Error(w, "Login expired, sign in again", http.StatusUnauthorized)
+		return
+	}
+	user := store.GetUserByID(userID)
+	if user == nil || !user.TOTPEnabled {
+		pendingLogins.Delete(twoFactorReq.Token)
+		http.Error(w, "Login expired, sign in again", http.StatusUnauthorized)
+		return
+	}
+	if user.Banned {
+		pendingLogins.Delete(twoFactorReq.Token)
+		http.Error(w, "Account is suspended", http.StatusForbidden)
+		return
+	}
+
+	if !checkSecondFactor(w, user, twoFactorReq.Code, twoFactorReq.RecoveryCode, http.StatusUnauthorized) {
+		pendingLogins.Fail(twoFactorReq.Token)
+		recordAudit(r, nil, audit.ActionLoginFailed, audit.TargetUser, user.ID, "", "invalid second factor")
+		return
+	}
+	pendingLogins.Delete(twoFactorReq.Token)
+
+	session, err := startSession(w, r, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	method := "method=totp"
+	if twoFactorReq.Code == "" {
+		method = "method=recovery_code"
+	}
+	recordAudit(r, user, audit.ActionLogin, audit.TargetUser, user.ID, "", method)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.AuthenticationInfo{
+		IsAuthenticated: true,
+		UserID:          user.ID,
+		Username:        user.Username,
+		CSRFToken:       csrfToken(session.Token),
+		Role:            authz.RoleOf(user),
+	})
+}
+
+// StartTwoFactorSetup generates a new TOTP secret for the current user. It
+// only takes effect once EnableTwoFactor has verified a code from it.
+func StartTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	if err := store.StartTOTPEnrollment(user.ID, secret); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": auth.TOTPURI(totpIssuer, user.Username, secret),
+	})
+}
+
+// EnableTwoFactor turns on two-factor authentication once the user proves
+// their authenticator works, and returns their recovery codes. The codes are
+// only ever shown in this response.
+func EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var enableReq struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&enableReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "Start two-factor setup first", http.StatusBadRequest)
+		return
+	}
+	step, ok := auth.VerifyTOTP(user.TOTPSecret, enableReq.Code, time.Now(), 0)
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+	if err := store.EnableTOTP(user.ID, step, hashes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, audit.ActionTwoFactorOn, audit.TargetUser, user.ID, "", "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recovery_codes": codes,
+		"message":        "Two-factor authentication enabled, store the recovery codes somewhere safe",
+	})
+}
+
+// DisableTwoFactor turns off two-factor authentication. The current password,
+// if the account has one, and a code are required.
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var disableReq struct {
+		CurrentPassword string `json:"current_password"`
+		Code            string `json:"code,omitempty"`
+		RecoveryCode    string `json:"recovery_code,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&disableReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+	if !checkCurrentPassword(w, user, disableReq.CurrentPassword, "Current password is incorrect") {
+		return
+	}
+	if !checkSecondFactor(w, user, disableReq.Code, disableReq.RecoveryCode, http.StatusForbidden) {
+		return
+	}
+
+	if err := store.DisableTOTP(user.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, audit.ActionTwoFactorOff, audit.TargetUser, user.ID, "", "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes, for
+// when they have used or lost them. A TOTP code is required.
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var regenerateReq struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&regenerateReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+	if !checkSecondFactor(w, user, regenerateReq.Code, "", http.StatusForbidden) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+	if err := store.SetRecoveryCodes(user.ID, hashes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recovery_codes": codes,
+		"message":        "Recovery codes replaced, the old ones no longer work",
+	})
+}
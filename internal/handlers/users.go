@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go-server/internal/audit"
+	"go-server/internal/authz"
+	"go-server/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// requirePermission resolves the current user and checks they have
+// permission, writing the error response if not
+func requirePermission(w http.ResponseWriter, r *http.Request, permission authz.Permission) (*models.User, bool) {
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	if !authz.Can(user, permission) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// moderationTarget looks up the user named in the route and checks the
+// current user outranks them
+func moderationTarget(w http.ResponseWriter, r *http.Request, actor *models.User) (*models.User, bool) {
+	targetID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	target := store.GetUserByID(targetID)
+	if target == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+	if !authz.Outranks(actor, target) {
+		http.Error(w, "Forbidden: You can only moderate users with a lower role than yours", http.StatusForbidden)
+		return nil, false
+	}
+	return target, true
+}
+
+// SetUserRole changes another user's role
+func SetUserRole(w http.ResponseWriter, r *http.Request) {
+	actor, ok := requirePermission(w, r, authz.AssignRoles)
+	if !ok {
+		return
+	}
+	target, ok := moderationTarget(w, r, actor)
+	if !ok {
+		return
+	}
+
+	var roleReq struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&roleReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !authz.ValidRole(roleReq.Role) {
+		http.Error(w, "Unknown role: "+roleReq.Role, http.StatusBadRequest)
+		return
+	}
+	// Nobody can hand out a role at or above their own
+	if !authz.Outranks(actor, &models.User{Role: roleReq.Role}) {
+		http.Error(w, "Forbidden: You can only assign roles lower than yours", http.StatusForbidden)
+		return
+	}
+
+	if err := store.SetRole(target.ID, roleReq.Role); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, actor, audit.ActionRoleChange, audit.TargetUser, target.ID, "role="+authz.RoleOf(target), "role="+roleReq.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": target.ID,
+		"role":    roleReq.Role,
+		"message": "Role changed successfully",
+	})
+}
+
+// SetUserBanned suspends or reinstates another user. Banning signs the user
+// out everywhere, and their API tokens stop working until they are reinstated.
+func SetUserBanned(w http.ResponseWriter, r *http.Request) {
+	actor, ok := requirePermission(w, r, authz.BanUsers)
+	if !ok {
+		return
+	}
+	target, ok := moderationTarget(w, r, actor)
+	if !ok {
+		return
+	}
+
+	var banReq struct {
+		Banned bool `json:"banned"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&banReq); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.SetBanned(target.ID, banReq.Banned); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, actor, audit.ActionBanChange, audit.TargetUser, target.ID,
+		fmt.Sprintf("banned=%t", target.Banned), fmt.Sprintf("banned=%t", banReq.Banned))
+
+	revoked := 0
+	if banReq.Banned {
+		var err error
+		if revoked, err = sessionStore.DeleteByUser(target.ID, ""); err != nil {
+			fmt.Printf("SetUserBanned: could not sign out user %d: %v\n", target.ID, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":          target.ID,
+		"banned":           banReq.Banned,
+		"revoked_sessions": revoked,
+		"message":          "User updated successfully",
+	})
+}
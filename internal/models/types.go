@@ -1,9 +1,37 @@
 package models
 
+import "time"
+
 type User struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Password string `json:"password,omitempty"`
+	ID            int                `json:"id"`
+	Username      string             `json:"username"`
+	Password      string             `json:"password,omitempty"` // Legacy plaintext, only read from old data files
+	PasswordHash  string             `json:"password_hash,omitempty"`
+	Email         string             `json:"email,omitempty"`
+	EmailVerified bool               `json:"email_verified,omitempty"`
+	Identities    []ExternalIdentity `json:"identities,omitempty"`
+	Role          string             `json:"role,omitempty"` // One of the Role constants, empty means RoleUser
+	Banned        bool               `json:"banned,omitempty"`
+
+	// Two-factor authentication. The secret is set when enrollment starts
+	// and TOTPEnabled once the first code has been verified.
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPEnabled   bool     `json:"totp_enabled,omitempty"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"` // Time step of the last accepted code, which cannot be reused
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // Hashes of unused recovery codes
+}
+
+// User roles, in ascending order of privilege
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// ExternalIdentity links a user to an account at an OpenID Connect provider
+type ExternalIdentity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
 }
 
 type Tag struct {
@@ -32,16 +60,152 @@ type Shader struct {
 	CommonScript  string         `json:"common_script,omitempty"`
 	ShaderScripts []ShaderScript `json:"shader_scripts"`
 	Tags          []Tag          `json:"tags,omitempty"`
+	Collaborators []Collaborator `json:"collaborators,omitempty"`
+	TeamID        int            `json:"team_id,omitempty"`    // Owning team, UserID is then only the author
+	DeletedAt     *time.Time     `json:"deleted_at,omitempty"` // Set while the shader is in the trash
+}
+
+// ShaderRevision is an immutable copy of a shader's code, recorded each time
+// the code is saved. Numbers count up from 1 for each shader. Listings leave
+// the code out.
+type ShaderRevision struct {
+	ShaderID      int            `json:"shader_id"`
+	Number        int            `json:"number"`
+	UserID        int            `json:"user_id"`          // Who saved it
+	Author        string         `json:"author,omitempty"` // Looked up from UserID when listed
+	Message       string         `json:"message,omitempty"`
+	RevertOf      int            `json:"revert_of,omitempty"` // Revision whose code it brought back
+	CreatedAt     time.Time      `json:"created_at"`
+	CommonScript  string         `json:"common_script,omitempty"`
+	ShaderScripts []ShaderScript `json:"shader_scripts,omitempty"`
+}
+
+// Team owns shaders on behalf of its members, so that the shaders outlive
+// any one member's account
+type Team struct {
+	ID        int          `json:"id"`
+	Name      string       `json:"name"`
+	Members   []TeamMember `json:"members"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// TeamMember gives a user a role in a team
+type TeamMember struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username,omitempty"` // Filled in when listing, not stored
+	Role     string `json:"role"`
+}
+
+// Team roles. Owners manage the team and its members and have owner rights
+// on its shaders, members may edit the team's shaders.
+const (
+	TeamRoleOwner  = "owner"
+	TeamRoleMember = "member"
+)
+
+// Collaborator gives a user other than the owner a role on one shader
+type Collaborator struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username,omitempty"` // Filled in when listing, not stored
+	Role     string `json:"role"`
 }
 
+// Shader roles. Owners may also delete the shader and manage its
+// collaborators, editors may save changes, and viewers are listed as
+// collaborators but get no more access than anyone else while shaders are public.
+// Collaborators are given editor or viewer, never owner.
+const (
+	ShaderRoleOwner  = "owner"
+	ShaderRoleEditor = "editor"
+	ShaderRoleViewer = "viewer"
+)
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"` // Optional, only used by Register
+
+	InviteCode string `json:"invite_code,omitempty"` // Only used by Register in invite-only mode
+}
+
+// Invite is a single-use registration code for invite-only mode. The code
+// itself is only shown once, when the invite is created.
+type Invite struct {
+	ID        int        `json:"id"`
+	CodeHash  string     `json:"code_hash,omitempty"`
+	CreatedBy int        `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	UsedBy    int        `json:"used_by,omitempty"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
 }
 
+// Purposes of single-use account tokens
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailVerification = "email_verification"
+)
+
+// AccountToken is a single-use, time-limited token mailed to a user for
+// password reset or email verification. Only a hash of the token is stored.
+type AccountToken struct {
+	TokenHash string    `json:"token_hash"`
+	UserID    int       `json:"user_id"`
+	Purpose   string    `json:"purpose"`
+	Email     string    `json:"email,omitempty"` // Address being verified
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Session is a logged in browser. Only a hash of the token is stored, the
+// raw Token is set only when the session is created.
 type Session struct {
-	Token  string `json:"token"`
-	UserID int    `json:"user_id"`
+	ID         string    `json:"id"`
+	Token      string    `json:"-"`
+	TokenHash  string    `json:"token_hash"`
+	UserID     int       `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+}
+
+// SessionInfo is the public view of a session returned by the sessions API
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	Current    bool      `json:"current"`
+}
+
+// APIToken is a personal access token for scripted API access. Only a hash
+// of the token is stored.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"token_hash,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// AuditEntry records one security-relevant event or content change. Before
+// and After are short human readable summaries of the target, not copies.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	ActorID    int       `json:"actor_id,omitempty"`
+	ActorName  string    `json:"actor_name,omitempty"` // Attempted username for failed logins
+	Action     string    `json:"action"`
+	TargetType string    `json:"target_type,omitempty"`
+	TargetID   int       `json:"target_id,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	Before     string    `json:"before,omitempty"`
+	After      string    `json:"after,omitempty"`
 }
 
 type SearchParams struct {
@@ -50,12 +214,24 @@ type SearchParams struct {
 	UserID int      `json:"user_id,omitempty"`
 	Limit  int      `json:"limit,omitempty"`
 	Offset int      `json:"offset,omitempty"`
+
+	// SharedWith limits results to shaders the user collaborates on
+	SharedWith int `json:"shared_with,omitempty"`
+	// TeamID limits results to shaders the team owns
+	TeamID int `json:"team_id,omitempty"`
 }
 
 type AuthenticationInfo struct {
 	IsAuthenticated bool   `json:"is_authenticated"`
 	Username        string `json:"username,omitempty"`
 	UserID          int    `json:"user_id,omitempty"`
+	CSRFToken       string `json:"csrf_token,omitempty"`
+	Role            string `json:"role,omitempty"`
+
+	// Set instead of a session when the password was correct but a second
+	// factor is required. The token is exchanged at /api/login/2fa.
+	TwoFactorRequired bool   `json:"two_factor_required,omitempty"`
+	TwoFactorToken    string `json:"two_factor_token,omitempty"`
 }
 
 type BrowsePageData struct {
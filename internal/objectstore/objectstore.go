@@ -0,0 +1,197 @@
+package objectstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config describes an S3-compatible bucket and the credentials to use it
+type Config struct {
+	Endpoint  string // Such as https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// Object is an entry in a bucket listing
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Client stores objects in one bucket. Requests are signed with AWS
+// Signature Version 4 and address the bucket by path, which MinIO and other
+// S3-compatible services accept as well as S3 itself.
+type Client struct {
+	config   Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// checksumHeader holds the SHA-256 of every object this client uploads, so
+// that downloads can be checked against it
+const checksumHeader = "X-Amz-Meta-Sha256"
+
+// New creates a client. If client is nil http.DefaultClient is used.
+func New(config Config, client *http.Client) (*Client, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid object storage endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("no bucket configured")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Client{config: config, endpoint: endpoint, client: client}, nil
+}
+
+// Put uploads data as key, replacing any object already there
+func (c *Client) Put(key string, data []byte) error {
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	resp, err := c.do("PUT", key, nil, data, map[string]string{checksumHeader: checksum})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads key, checking it against the checksum it was uploaded with.
+// Every object read is one Put wrote, so one without a checksum is refused
+// too.
+func (c *Client) Get(key string) ([]byte, error) {
+	resp, err := c.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	expected := resp.Header.Get(checksumHeader)
+	if expected == "" {
+		return nil, fmt.Errorf("object %s has no checksum", key)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != expected {
+		return nil, fmt.Errorf("object %s does not match its checksum", key)
+	}
+	return data, nil
+}
+
+// Delete removes key. Removing an object that does not exist succeeds.
+func (c *Client) Delete(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns every object whose key starts with prefix, in key order
+func (c *Client) List(prefix string) ([]Object, error) {
+	var listing struct {
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}
+	}
+
+	objects := []Object{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&listing)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket listing: %w", err)
+		}
+
+		for _, content := range listing.Contents {
+			objects = append(objects, Object{Key: content.Key, Size: content.Size, LastModified: content.LastModified})
+		}
+		if !listing.IsTruncated || listing.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = listing.NextContinuationToken
+		listing.Contents = nil
+	}
+}
+
+// do sends a signed request for key, or for the bucket itself if key is "",
+// and turns error responses into errors
+func (c *Client) do(method, key string, query url.Values, body []byte, headers map[string]string) (*http.Response, error) {
+	target := *c.endpoint
+	target.Path = c.endpoint.Path + "/" + c.config.Bucket + "/" + key
+	target.RawPath = escapePath(target.Path)
+	target.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	sign(req, body, c.config, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var failure struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	xml.Unmarshal(data, &failure)
+	if resp.StatusCode == http.StatusNotFound && method != "DELETE" {
+		return nil, fmt.Errorf("object not found: %s", key)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// Deleting something already gone is not an error
+		return resp, nil
+	}
+	if failure.Code == "" {
+		failure.Code = resp.Status
+	}
+	if key == "" {
+		key = "bucket " + c.config.Bucket
+	}
+	return nil, fmt.Errorf("%s %s failed: %s %s", method, key, failure.Code, failure.Message)
+}
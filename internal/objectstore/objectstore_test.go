@@ -0,0 +1,99 @@
+package objectstore_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"go-server/internal/objectstore"
+	"go-server/internal/objectstore/objectstoretest"
+)
+
+func newClient(t *testing.T) (*objectstore.Client, *objectstoretest.Server) {
+	server := objectstoretest.NewServer("replica")
+	t.Cleanup(server.Close)
+
+	client, err := objectstore.New(objectstore.Config{
+		Endpoint:  server.URL,
+		Bucket:    server.Bucket,
+		AccessKey: "access",
+		SecretKey: "secret",
+	}, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestPutGet(t *testing.T) {
+	client, _ := newClient(t)
+
+	if err := client.Put("logs/a b.log", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := client.Get("logs/a b.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("Get = %q, want hello", data)
+	}
+
+	if err := client.Delete("logs/a b.log"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get("logs/a b.log"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Get after Delete = %v, want not found", err)
+	}
+	if err := client.Delete("logs/a b.log"); err != nil {
+		t.Errorf("deleting a missing object = %v, want nil", err)
+	}
+}
+
+func TestGetChecksum(t *testing.T) {
+	client, server := newClient(t)
+
+	// The checksum of what was uploaded, stored with other contents
+	sum := sha256.Sum256([]byte("original"))
+	server.Store("damaged", []byte("changed"), hex.EncodeToString(sum[:]))
+	if _, err := client.Get("damaged"); err == nil || !strings.Contains(err.Error(), "does not match its checksum") {
+		t.Errorf("Get of a damaged object = %v, want checksum mismatch", err)
+	}
+
+	server.Store("foreign", []byte("no checksum"), "")
+	if _, err := client.Get("foreign"); err == nil || !strings.Contains(err.Error(), "has no checksum") {
+		t.Errorf("Get of an object without checksum = %v, want an error", err)
+	}
+}
+
+func TestListPaginates(t *testing.T) {
+	client, server := newClient(t)
+	server.PageSize = 2
+
+	for i := 0; i < 5; i++ {
+		if err := client.Put(fmt.Sprintf("logs/%d.log", i), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Put("snapshots/one.tar.gz", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := client.List("logs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	want := "logs/0.log logs/1.log logs/2.log logs/3.log logs/4.log"
+	if got := strings.Join(keys, " "); got != want {
+		t.Errorf("List = %s, want %s", got, want)
+	}
+	if requests := server.ListRequests(); requests != 3 {
+		t.Errorf("List took %d requests, want 3", requests)
+	}
+}
@@ -0,0 +1,179 @@
+// Package objectstoretest provides an in-memory S3-compatible server for
+// testing code that uses objectstore
+package objectstoretest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checksumHeader is the metadata header objectstore stores checksums in
+const checksumHeader = "X-Amz-Meta-Sha256"
+
+// Server holds the objects of one bucket in memory. It answers the path
+// style requests objectstore sends, and refuses unsigned ones.
+type Server struct {
+	*httptest.Server
+	Bucket string
+
+	// PageSize is the most keys one listing returns, 1000 by default
+	PageSize int
+
+	mu           sync.Mutex
+	objects      map[string]object
+	listRequests int
+}
+
+type object struct {
+	data     []byte
+	checksum string
+	modified time.Time
+}
+
+// NewServer starts a server for bucket. Close it when done.
+func NewServer(bucket string) *Server {
+	s := &Server{Bucket: bucket, PageSize: 1000, objects: make(map[string]object)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Store puts an object in the bucket directly, with checksum as its
+// metadata, so that tests can set up damaged or foreign objects
+func (s *Server) Store(key string, data []byte, checksum string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = object{data: data, checksum: checksum, modified: time.Now().UTC()}
+}
+
+// Object returns the contents of key and whether it exists
+func (s *Server) Object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, exists := s.objects[key]
+	return o.data, exists
+}
+
+// Keys returns the keys in the bucket in order
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ListRequests returns the number of listing pages served
+func (s *Server) ListRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listRequests
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path != s.Bucket && !strings.HasPrefix(path, s.Bucket+"/") {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, s.Bucket), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case key == "" && r.Method == "GET":
+		s.listLocked(w, r)
+	case r.Method == "PUT":
+		s.objects[key] = object{data: body, checksum: r.Header.Get(checksumHeader), modified: time.Now().UTC()}
+	case r.Method == "GET":
+		o, exists := s.objects[key]
+		if !exists {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if o.checksum != "" {
+			w.Header().Set(checksumHeader, o.checksum)
+		}
+		w.Write(o.data)
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// listLocked answers a ListObjectsV2 request. The continuation token is
+// the last key of the previous page.
+func (s *Server) listLocked(w http.ResponseWriter, r *http.Request) {
+	s.listRequests++
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	after := query.Get("continuation-token")
+
+	keys := []string{}
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Name: s.Bucket, Prefix: prefix}
+
+	if len(keys) > s.PageSize {
+		keys = keys[:s.PageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		o := s.objects[key]
+		result.Contents = append(result.Contents, content{Key: key, Size: int64(len(o.data)), LastModified: o.modified})
+	}
+	result.KeyCount = len(keys)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(result)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header + "<Error><Code>" + code + "</Code><Message>" + http.StatusText(status) + "</Message></Error>"))
+}
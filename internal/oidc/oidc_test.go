@@ -0,0 +1,395 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "shaderstack"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "https://shaders.example/auth/oidc/callback"
+	testCode         = "code-123"
+)
+
+// fakeIdP is an identity provider serving discovery, a key set and a token
+// endpoint that checks the PKCE verifier against the challenge it was given
+type fakeIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu                sync.Mutex
+	issuer            string // Issuer in the discovery document, the server URL by default
+	keys              map[string]crypto.Signer
+	published         []string // Kids in the key set
+	challenge         string
+	idToken           string
+	discoveryRequests int
+	keySetRequests    int
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	idp := &fakeIdP{t: t, keys: make(map[string]crypto.Signer)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/keys", idp.keySet)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	idp.issuer = idp.server.URL
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *fakeIdP) provider() *Provider {
+	return NewProvider(Config{
+		Issuer:       idp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+	}, idp.server.Client())
+}
+
+// addKey generates a key for kid and publishes it
+func (idp *fakeIdP) addKey(kid string, ec bool) crypto.Signer {
+	var key crypto.Signer
+	var err error
+	if ec {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keys[kid] = key
+	idp.published = append(idp.published, kid)
+	return key
+}
+
+// publish replaces the key set with the keys of kids
+func (idp *fakeIdP) publish(kids ...string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.published = kids
+}
+
+func (idp *fakeIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.discoveryRequests++
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.issuer,
+		"authorization_endpoint": idp.server.URL + "/authorize",
+		"token_endpoint":         idp.server.URL + "/token",
+		"jwks_uri":               idp.server.URL + "/keys",
+	})
+}
+
+func (idp *fakeIdP) keySet(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keySetRequests++
+
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	keys := []map[string]string{}
+	for _, kid := range idp.published {
+		switch key := idp.keys[kid].Public().(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig",
+				"n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "EC", "kid": kid, "use": "sig", "crv": "P-256",
+				"x": encode(key.X.FillBytes(make([]byte, 32))), "y": encode(key.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, password, _ := r.BasicAuth()
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case user != testClientID || password != testClientSecret:
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+	case r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != testCode ||
+		r.PostForm.Get("redirect_uri") != testRedirectURL:
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge:
+		http.Error(w, `{"error":"invalid_grant","error_description":"PKCE verification failed"}`, http.StatusBadRequest)
+	default:
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "id_token": idp.idToken})
+	}
+}
+
+// sign makes a token with the given header and claims, signed with the key
+// of kid
+func (idp *fakeIdP) sign(alg, kid string, claims map[string]interface{}) string {
+	idp.mu.Lock()
+	key := idp.keys[kid]
+	idp.mu.Unlock()
+	return signToken(idp.t, alg, kid, key, claims)
+}
+
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// claims returns valid claims for nonce, with changes applied
+func (idp *fakeIdP) claims(nonce string, changes map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                idp.server.URL,
+		"sub":                "user-42",
+		"aud":                testClientID,
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              nonce,
+		"preferred_username": "ada",
+		"email":              "ada@example.com",
+		"name":               "Ada",
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+func TestDiscovery(t *testing.T) {
+	idp := newFakeIdP(t)
+	provider := idp.provider()
+
+	_, redirect, err := provider.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := provider.AuthCodeURL(); err != nil {
+		t.Fatal(err)
+	}
+	if idp.discoveryRequests != 1 {
+		t.Errorf("discovery fetched %d times, want 1", idp.discoveryRequests)
+	}
+
+	target, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Path != "/authorize" {
+		t.Errorf("redirected to %s, want the authorization endpoint", target.Path)
+	}
+	query := target.Query()
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid profile email",
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := query.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	for _, name := range []string{"state", "nonce", "code_challenge"} {
+		if query.Get(name) == "" {
+			t.Errorf("%s is missing", name)
+		}
+	}
+
+	// A document for another issuer is refused
+	idp = newFakeIdP(t)
+	idp.issuer = "https://elsewhere.example"
+	if _, _, err := idp.provider().AuthCodeURL(); err == nil || !strings.Contains(err.Error(), "does not match configured issuer") {
+		t.Errorf("AuthCodeURL with a foreign issuer = %v, want an error", err)
+	}
+}
+
+// login starts a login and has the IdP answer the token request with the
+// token made for the nonce of the login
+func login(t *testing.T, idp *fakeIdP, provider *Provider, token func(nonce string) string) (*Identity, error) {
+	state, redirect, err := provider.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := target.Query()
+
+	idp.mu.Lock()
+	idp.challenge = query.Get("code_challenge")
+	idp.mu.Unlock()
+	idToken := token(query.Get("nonce"))
+	idp.mu.Lock()
+	idp.idToken = idToken
+	idp.mu.Unlock()
+
+	return provider.Exchange(state, testCode)
+}
+
+func TestExchange(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.addKey("rsa", false)
+	provider := idp.provider()
+
+	identity, err := login(t, idp, provider, func(nonce string) string {
+		return idp.sign("RS256", "rsa", idp.claims(nonce, nil))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{Issuer: idp.server.URL, Subject: "user-42", PreferredUsername: "ada", Email: "ada@example.com", Name: "Ada"}
+	if *identity != want {
+		t.Errorf("identity = %+v, want %+v", *identity, want)
+	}
+
+	// The IdP refuses a verifier that does not match the challenge
+	state, _, err := provider.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Exchange(state, testCode); err == nil || !strings.Contains(err.Error(), "PKCE") {
+		t.Errorf("Exchange with another login's challenge = %v, want the IdP to refuse it", err)
+	}
+
+	// A state can only be used once
+	if _, err := provider.Exchange(state, testCode); err == nil || !strings.Contains(err.Error(), "unknown or expired") {
+		t.Errorf("Exchange reusing a state = %v, want an error", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.addKey("old", false)
+	provider := idp.provider()
+
+	token := idp.sign("RS256", "old", idp.claims("n", nil))
+	if _, err := provider.verifyIDToken(token, "n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.verifyIDToken(token, "n"); err != nil {
+		t.Fatal(err)
+	}
+	if idp.keySetRequests != 1 {
+		t.Errorf("key set fetched %d times, want 1", idp.keySetRequests)
+	}
+
+	// The IdP rotates to a new key, which is fetched when first seen
+	idp.addKey("new", true)
+	idp.publish("new")
+	token = idp.sign("ES256", "new", idp.claims("n", nil))
+	if _, err := provider.verifyIDToken(token, "n"); err != nil {
+		t.Fatalf("token signed with the rotated key: %v", err)
+	}
+	if idp.keySetRequests != 2 {
+		t.Errorf("key set fetched %d times, want 2", idp.keySetRequests)
+	}
+
+	// The retired key is no longer trusted
+	token = idp.sign("RS256", "old", idp.claims("n", nil))
+	if _, err := provider.verifyIDToken(token, "n"); err == nil || !strings.Contains(err.Error(), "no signing key") {
+		t.Errorf("token signed with the retired key = %v, want an error", err)
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.addKey("rsa", false)
+	idp.addKey("ec", true)
+	provider := idp.provider()
+
+	stranger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"wrong issuer", idp.sign("RS256", "rsa", idp.claims("n", map[string]interface{}{"iss": "https://elsewhere.example"})), "issuer"},
+		{"wrong audience", idp.sign("RS256", "rsa", idp.claims("n", map[string]interface{}{"aud": []string{"other", "another"}})), "not issued for this client"},
+		{"wrong nonce", idp.sign("RS256", "rsa", idp.claims("other", nil)), "nonce does not match"},
+		{"expired", idp.sign("RS256", "rsa", idp.claims("n", map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), "expired"},
+		{"issued in the future", idp.sign("RS256", "rsa", idp.claims("n", map[string]interface{}{"iat": now.Add(time.Hour).Unix()})), "in the future"},
+		{"no subject", idp.sign("RS256", "rsa", idp.claims("n", map[string]interface{}{"sub": nil})), "no subject"},
+		{"ES256 with an RSA key", idp.sign("ES256", "rsa", idp.claims("n", nil)), "does not match key type"},
+		{"RS256 with an EC key", idp.sign("RS256", "ec", idp.claims("n", nil)), "does not match key type"},
+		{"unsupported algorithm", idp.sign("HS256", "rsa", idp.claims("n", nil)), "unsupported id_token algorithm"},
+		{"signed by another key", signToken(t, "RS256", "rsa", stranger, idp.claims("n", nil)), "invalid id_token signature"},
+		{"unknown key", signToken(t, "RS256", "missing", stranger, idp.claims("n", nil)), "no signing key"},
+		{"malformed", "not-a-token", "malformed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := provider.verifyIDToken(test.token, "n")
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("verifyIDToken = %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+
+	// The audience may be a list that includes this client
+	token := idp.sign("ES256", "ec", idp.claims("n", map[string]interface{}{"aud": []string{"other", testClientID}}))
+	if _, err := provider.verifyIDToken(token, "n"); err != nil {
+		t.Errorf("token for several audiences: %v", err)
+	}
+}
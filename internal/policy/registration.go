@@ -0,0 +1,123 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// RegistrationPolicy decides which usernames and passwords are acceptable
+// for new and changed accounts
+type RegistrationPolicy struct {
+	MinUsernameLength int
+	MaxUsernameLength int
+	// ReservedNames cannot be registered, compared by canonical form
+	ReservedNames []string
+	// MinPasswordLength is counted in characters, not bytes
+	MinPasswordLength int
+	// MinPasswordClasses is how many of lower case, upper case, digits and
+	// symbols a password must mix
+	MinPasswordClasses int
+	// InviteOnly requires a single-use invite code to register
+	InviteOnly bool
+}
+
+// DefaultRegistrationPolicy returns the policy used when nothing is configured
+func DefaultRegistrationPolicy() RegistrationPolicy {
+	return RegistrationPolicy{
+		MinUsernameLength:  3,
+		MaxUsernameLength:  32,
+		ReservedNames:      []string{"admin", "api", "static"},
+		MinPasswordLength:  8,
+		MinPasswordClasses: 2,
+	}
+}
+
+// commonPasswords are rejected outright regardless of their length
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "12345678": true,
+	"123456789": true, "1234567890": true, "qwerty123": true, "qwertyuiop": true,
+	"iloveyou": true, "letmein1": true, "welcome1": true, "shaderstack": true,
+}
+
+var folder = cases.Fold()
+
+// CanonicalUsername returns the form usernames are compared in: Unicode
+// NFKC normalised and case folded, so that "Daniel", "daniel" and
+// compatibility variants such as full-width letters all collide
+func CanonicalUsername(username string) string {
+	return norm.NFKC.String(folder.String(norm.NFKC.String(username)))
+}
+
+// ValidateUsername checks username against the policy and returns the NFKC
+// normalised form that should be stored
+func (p RegistrationPolicy) ValidateUsername(username string) (string, error) {
+	username = norm.NFKC.String(strings.TrimSpace(username))
+
+	length := utf8.RuneCountInString(username)
+	if length < p.MinUsernameLength || length > p.MaxUsernameLength {
+		return "", fmt.Errorf("username must be between %d and %d characters", p.MinUsernameLength, p.MaxUsernameLength)
+	}
+
+	for i, c := range username {
+		switch {
+		case unicode.IsLetter(c) || unicode.IsDigit(c):
+		case (c == '_' || c == '-' || c == '.') && i > 0:
+		default:
+			return "", fmt.Errorf("username may only contain letters, digits, '_', '-' and '.', and must start with a letter or digit")
+		}
+	}
+
+	canonical := CanonicalUsername(username)
+	for _, reserved := range p.ReservedNames {
+		if canonical == CanonicalUsername(reserved) {
+			return "", fmt.Errorf("username %q is reserved", username)
+		}
+	}
+
+	return username, nil
+}
+
+// ValidatePassword checks that password is strong enough for username
+func (p RegistrationPolicy) ValidatePassword(password, username string) error {
+	if utf8.RuneCountInString(password) < p.MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinPasswordLength)
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return fmt.Errorf("password is too common")
+	}
+	if username != "" && strings.Contains(CanonicalUsername(password), CanonicalUsername(username)) {
+		return fmt.Errorf("password must not contain the username")
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{hasLower, hasUpper, hasDigit, hasSymbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < p.MinPasswordClasses {
+		return fmt.Errorf("password must mix at least %d of lower case, upper case, digits and symbols", p.MinPasswordClasses)
+	}
+
+	return nil
+}
@@ -0,0 +1,322 @@
+package replication
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-server/internal/objectstore"
+)
+
+// Replicator copies snapshots and the shader log to a bucket, so that the
+// data survives losing the machine it is on.
+//
+// Every snapshot starts a generation named after it. Shader log lines
+// recorded from then on are uploaded as numbered segments of that
+// generation, under <prefix>logs/<generation>/. A generation begins before
+// its snapshot is read, and each line holds the complete state of the
+// shaders it touched, so replaying the segments of a snapshot's generation
+// on top of it brings it up to the moment the next snapshot was taken.
+// Later generations are not replayed: users, tags and teams are only copied
+// with each snapshot, and their shaders may refer to ones the earlier
+// snapshot does not have. Restoring the newest snapshot is what brings the
+// data up to date.
+//
+// Lines wait in memory while the bucket cannot be reached. Once more than
+// maxQueued bytes are waiting they are dropped, and nothing more is recorded
+// until the next snapshot, which holds their changes. The segments uploaded
+// before then still replay without a gap.
+type Replicator struct {
+	client    *objectstore.Client
+	prefix    string
+	keep      int // Snapshots kept in the bucket, 0 keeps every one
+	maxQueued int // Bytes of lines that may wait to be uploaded
+
+	mu         sync.Mutex
+	generation string       // Generation lines are recorded in
+	sequence   int          // Number of the next segment of generation
+	pending    bytes.Buffer // Lines not yet cut into a segment
+	queue      []segment    // Segments waiting to be uploaded, oldest first
+	queued     int          // Bytes in pending and queue
+	stalled    bool         // Lines were dropped, the generation needs a new snapshot
+
+	// Held while uploading, so that segments arrive in order
+	uploading sync.Mutex
+}
+
+type segment struct {
+	key  string
+	data []byte
+}
+
+const (
+	snapshotsDir  = "snapshots/"
+	logsDir       = "logs/"
+	archiveSuffix = ".tar.gz"
+)
+
+// New creates a Replicator that keeps its objects under prefix in the
+// bucket of client, with up to maxQueued bytes of lines waiting for it
+func New(client *objectstore.Client, prefix string, keep, maxQueued int) *Replicator {
+	return &Replicator{client: client, prefix: prefix, keep: keep, maxQueued: maxQueued}
+}
+
+// Record queues a shader log line for upload. It is called with the
+// repository locked, so it only copies the line.
+func (r *Replicator) Record(line []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Lines recorded before the first snapshot are in it, as are those
+	// recorded after an overflow in the next one
+	if r.generation == "" || r.stalled {
+		return
+	}
+	r.pending.Write(line)
+	r.queued += len(line)
+
+	if r.queued > r.maxQueued {
+		fmt.Printf("Warning: Over %d bytes of shader log are waiting to be replicated, shader changes are not replicated until the next snapshot\n", r.maxQueued)
+		r.pending.Reset()
+		r.queue = nil
+		r.queued = 0
+		r.stalled = true
+	}
+}
+
+// Begin starts the generation of the snapshot called name. Lines recorded
+// before it belong to the previous generation.
+func (r *Replicator) Begin(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cutLockFree()
+	r.generation = strings.TrimSuffix(name, archiveSuffix)
+	r.sequence = 0
+	r.stalled = false
+}
+
+// Upload copies a snapshot archive to the bucket, along with the segments
+// of earlier generations, and removes what is no longer kept
+func (r *Replicator) Upload(name string, archive []byte) error {
+	r.uploading.Lock()
+	defer r.uploading.Unlock()
+
+	if err := r.flushLockFree(); err != nil {
+		return err
+	}
+	if err := r.client.Put(r.prefix+snapshotsDir+name, archive); err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+// Flush uploads the lines recorded so far. Segments that fail to upload are
+// retried by the next Flush.
+func (r *Replicator) Flush() error {
+	r.uploading.Lock()
+	defer r.uploading.Unlock()
+
+	r.mu.Lock()
+	r.cutLockFree()
+	r.mu.Unlock()
+	return r.flushLockFree()
+}
+
+// Schedule flushes every interval until the returned function is called,
+// which flushes one last time
+func (r *Replicator) Schedule(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Flush(); err != nil {
+					fmt.Printf("Warning: Could not replicate shader log: %v\n", err)
+				}
+			case <-done:
+				ticker.Stop()
+				if err := r.Flush(); err != nil {
+					fmt.Printf("Warning: Could not replicate shader log: %v\n", err)
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Lock-free version for internal use when mu is already held. Moves the
+// pending lines into a segment of the current generation.
+func (r *Replicator) cutLockFree() {
+	if r.pending.Len() == 0 || r.generation == "" {
+		return
+	}
+	data := make([]byte, r.pending.Len())
+	copy(data, r.pending.Bytes())
+	r.pending.Reset()
+
+	key := fmt.Sprintf("%s%s%s/%08d.log", r.prefix, logsDir, r.generation, r.sequence)
+	r.queue = append(r.queue, segment{key: key, data: data})
+	r.sequence++
+}
+
+// Uploads the queued segments in order. The uploading mutex must be held.
+func (r *Replicator) flushLockFree() error {
+	for {
+		r.mu.Lock()
+		if len(r.queue) == 0 {
+			r.mu.Unlock()
+			return nil
+		}
+		next := r.queue[0]
+		r.mu.Unlock()
+
+		if err := r.client.Put(next.key, next.data); err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		// The queue is emptied if it overflows during the upload
+		if len(r.queue) > 0 && r.queue[0].key == next.key {
+			r.queue = r.queue[1:]
+			r.queued -= len(next.data)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// prune removes the oldest snapshots beyond the number kept, and the
+// segments of generations older than any snapshot left
+func (r *Replicator) prune() error {
+	if r.keep <= 0 {
+		return nil
+	}
+	names, err := r.snapshots()
+	if err != nil {
+		return err
+	}
+	if len(names) <= r.keep {
+		return nil
+	}
+
+	for _, name := range names[r.keep:] {
+		if err := r.client.Delete(r.prefix + snapshotsDir + name); err != nil {
+			return err
+		}
+	}
+
+	oldest := strings.TrimSuffix(names[r.keep-1], archiveSuffix)
+	objects, err := r.client.List(r.prefix + logsDir)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		generation, _, ok := r.parseSegment(object.Key)
+		if ok && generation < oldest {
+			if err := r.client.Delete(object.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// snapshots returns the names of the snapshots in the bucket, newest first
+func (r *Replicator) snapshots() ([]string, error) {
+	objects, err := r.client.List(r.prefix + snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, r.prefix+snapshotsDir)
+		if strings.HasSuffix(name, archiveSuffix) && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	// Names hold the time they were taken in a fixed width format, so they
+	// sort by age
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// parseSegment returns the generation and number of the segment at key
+func (r *Replicator) parseSegment(key string) (generation string, sequence int, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(key, r.prefix+logsDir), "/")
+	if len(parts) != 2 || !strings.HasSuffix(parts[1], ".log") {
+		return "", 0, false
+	}
+	sequence, err := strconv.Atoi(strings.TrimSuffix(parts[1], ".log"))
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], sequence, true
+}
+
+// Restore downloads the snapshot called name, or the newest one if name is
+// "", and the shader log of its generation to replay on top of it. It
+// returns the name of the snapshot restored.
+//
+// Only shaders are brought forward by the log. Users, tags and teams are
+// restored as they were when the snapshot was taken, changes made to them
+// since are lost.
+func (r *Replicator) Restore(name string) (string, []byte, []byte, error) {
+	if name == "" {
+		names, err := r.snapshots()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if len(names) == 0 {
+			return "", nil, nil, fmt.Errorf("no snapshots in bucket")
+		}
+		name = names[0]
+	}
+	archive, err := r.client.Get(r.prefix + snapshotsDir + name)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	generation := strings.TrimSuffix(name, archiveSuffix)
+	objects, err := r.client.List(r.prefix + logsDir + generation + "/")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	type segmentKey struct {
+		sequence int
+		key      string
+	}
+	segments := []segmentKey{}
+	for _, object := range objects {
+		g, sequence, ok := r.parseSegment(object.Key)
+		if ok && g == generation {
+			segments = append(segments, segmentKey{sequence, object.Key})
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].sequence < segments[j].sequence })
+
+	var log bytes.Buffer
+	for i, s := range segments {
+		// Segments are uploaded in order, so a gap means one was lost
+		if s.sequence != i {
+			return "", nil, nil, fmt.Errorf("segment %d of %s is missing", i, generation)
+		}
+		data, err := r.client.Get(s.key)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		log.Write(data)
+	}
+	return name, archive, log.Bytes(), nil
+}
@@ -0,0 +1,188 @@
+package replication_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"go-server/internal/objectstore"
+	"go-server/internal/objectstore/objectstoretest"
+	"go-server/internal/replication"
+)
+
+const prefix = "shaderstack/"
+
+var names = []string{
+	"snapshot-20260101T000000.000Z.tar.gz",
+	"snapshot-20260102T000000.000Z.tar.gz",
+	"snapshot-20260103T000000.000Z.tar.gz",
+}
+
+func newReplicator(t *testing.T, keep, maxQueued int) (*replication.Replicator, *objectstoretest.Server) {
+	server := objectstoretest.NewServer("replica")
+	t.Cleanup(server.Close)
+
+	client, err := objectstore.New(objectstore.Config{
+		Endpoint:  server.URL,
+		Bucket:    server.Bucket,
+		AccessKey: "access",
+		SecretKey: "secret",
+	}, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replication.New(client, prefix, keep, maxQueued), server
+}
+
+// takeSnapshots uploads each snapshot in names, recording one log line
+// after each
+func takeSnapshots(t *testing.T, replicator *replication.Replicator) {
+	for i, name := range names {
+		replicator.Begin(name)
+		if err := replicator.Upload(name, []byte("archive "+name)); err != nil {
+			t.Fatal(err)
+		}
+		replicator.Record([]byte("line " + string(rune('a'+i)) + "\n"))
+	}
+	if err := replicator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func generation(name string) string {
+	return strings.TrimSuffix(name, ".tar.gz")
+}
+
+func TestFlushSegments(t *testing.T) {
+	replicator, server := newReplicator(t, 0, 1<<20)
+
+	// Lines from before the first snapshot are in it
+	replicator.Record([]byte("early\n"))
+	replicator.Begin(names[0])
+	replicator.Record([]byte("one\n"))
+	replicator.Record([]byte("two\n"))
+	if err := replicator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	replicator.Record([]byte("three\n"))
+	if err := replicator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := map[string]string{
+		prefix + "logs/" + generation(names[0]) + "/00000000.log": "one\ntwo\n",
+		prefix + "logs/" + generation(names[0]) + "/00000001.log": "three\n",
+	}
+	keys := server.Keys()
+	if len(keys) != len(segments) {
+		t.Fatalf("bucket holds %v, want %d segments", keys, len(segments))
+	}
+	for key, want := range segments {
+		if data, _ := server.Object(key); string(data) != want {
+			t.Errorf("%s = %q, want %q", key, data, want)
+		}
+	}
+}
+
+func TestPruneRetention(t *testing.T) {
+	replicator, server := newReplicator(t, 2, 1<<20)
+	takeSnapshots(t, replicator)
+
+	want := []string{
+		prefix + "logs/" + generation(names[1]) + "/00000000.log",
+		prefix + "logs/" + generation(names[2]) + "/00000000.log",
+		prefix + "snapshots/" + names[1],
+		prefix + "snapshots/" + names[2],
+	}
+	if got := server.Keys(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("bucket holds %v, want %v", got, want)
+	}
+}
+
+func TestRestoreOwnGeneration(t *testing.T) {
+	replicator, _ := newReplicator(t, 0, 1<<20)
+	takeSnapshots(t, replicator)
+
+	tests := []struct {
+		name     string
+		restored string
+		log      string
+	}{
+		{"", names[2], "line c\n"},
+		{names[0], names[0], "line a\n"},
+		{names[1], names[1], "line b\n"},
+	}
+	for _, test := range tests {
+		name, archive, log, err := replicator.Restore(test.name)
+		if err != nil {
+			t.Fatalf("Restore(%q): %v", test.name, err)
+		}
+		if name != test.restored || string(archive) != "archive "+test.restored {
+			t.Errorf("Restore(%q) restored %s", test.name, name)
+		}
+		if string(log) != test.log {
+			t.Errorf("Restore(%q) log = %q, want %q", test.name, log, test.log)
+		}
+	}
+}
+
+func TestRestoreGap(t *testing.T) {
+	replicator, server := newReplicator(t, 0, 1<<20)
+	takeSnapshots(t, replicator)
+
+	// A segment after one that never arrived
+	data := []byte("line d\n")
+	sum := sha256.Sum256(data)
+	server.Store(prefix+"logs/"+generation(names[1])+"/00000002.log", data, hex.EncodeToString(sum[:]))
+
+	_, _, _, err := replicator.Restore(names[1])
+	if err == nil || !strings.Contains(err.Error(), "segment 1 of "+generation(names[1])+" is missing") {
+		t.Errorf("Restore with a missing segment = %v, want an error", err)
+	}
+	if _, _, _, err := replicator.Restore(names[0]); err != nil {
+		t.Errorf("Restore of another generation = %v, want nil", err)
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	replicator, server := newReplicator(t, 0, 16)
+
+	replicator.Begin(names[0])
+	replicator.Record([]byte("kept\n"))
+	if err := replicator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// More than fits waits for the bucket, so it is dropped along with
+	// everything recorded until the next snapshot
+	replicator.Record([]byte("waiting 1\n"))
+	replicator.Record([]byte("waiting 2\n"))
+	replicator.Record([]byte("dropped\n"))
+	if err := replicator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	replicator.Begin(names[1])
+	if err := replicator.Upload(names[1], []byte("archive "+names[1])); err != nil {
+		t.Fatal(err)
+	}
+	replicator.Record([]byte("next\n"))
+	if err := replicator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		prefix + "logs/" + generation(names[0]) + "/00000000.log",
+		prefix + "logs/" + generation(names[1]) + "/00000000.log",
+		prefix + "snapshots/" + names[1],
+	}
+	if keys := server.Keys(); strings.Join(keys, " ") != strings.Join(want, " ") {
+		t.Fatalf("bucket holds %v, want %v", keys, want)
+	}
+	if data, _ := server.Object(want[0]); string(data) != "kept\n" {
+		t.Errorf("%s = %q, want the line flushed before the overflow", want[0], data)
+	}
+	if data, _ := server.Object(want[1]); string(data) != "next\n" {
+		t.Errorf("%s = %q, want the line recorded after the next snapshot", want[1], data)
+	}
+}
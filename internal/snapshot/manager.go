@@ -0,0 +1,172 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go-server/internal/atomicfile"
+)
+
+const (
+	namePrefix     = "snapshot-"
+	nameSuffix     = ".tar.gz"
+	nameTimeFormat = "20060102T150405.000Z"
+)
+
+// Source produces the files a snapshot holds, consistent with each other
+type Source interface {
+	Snapshot() (map[string][]byte, error)
+}
+
+// Replica receives a copy of every archive a Manager creates. Begin is
+// called with the archive's name before the source is read, Upload once the
+// archive is written.
+type Replica interface {
+	Begin(name string)
+	Upload(name string, archive []byte) error
+}
+
+// Info describes an archive kept by a Manager
+type Info struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Manager keeps archives of a Source in a directory, deleting the oldest
+// once there are more than it is set to keep
+type Manager struct {
+	mu      sync.Mutex
+	dir     string
+	keep    int // 0 keeps every archive
+	source  Source
+	replica Replica // Set via SetReplica, may be nil
+}
+
+// NewManager creates a Manager for archives of source in dir
+func NewManager(dir string, keep int, source Source) *Manager {
+	return &Manager{dir: dir, keep: keep, source: source}
+}
+
+// SetReplica has every archive created from now on copied to replica
+func (m *Manager) SetReplica(replica Replica) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replica = replica
+}
+
+// Create takes a snapshot now and removes any that are no longer kept
+func (m *Manager) Create() (*Info, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	createdAt := time.Now().UTC()
+	name := namePrefix + createdAt.Format(nameTimeFormat) + nameSuffix
+	if m.replica != nil {
+		m.replica.Begin(name)
+	}
+
+	files, err := m.source.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, files, createdAt); err != nil {
+		return nil, err
+	}
+
+	// Archives hold password hashes, so only the server may read them
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := atomicfile.WriteFile(filepath.Join(m.dir, name), buf.Bytes(), 0600, 0); err != nil {
+		return nil, err
+	}
+	if m.replica != nil {
+		if err := m.replica.Upload(name, buf.Bytes()); err != nil {
+			fmt.Printf("Warning: Could not replicate snapshot %s: %v\n", name, err)
+		}
+	}
+
+	if err := m.prune(); err != nil {
+		fmt.Printf("Warning: Could not remove old snapshots: %v\n", err)
+	}
+	return &Info{Name: name, Size: int64(buf.Len()), CreatedAt: createdAt}, nil
+}
+
+// List returns the archives in the directory, newest first
+func (m *Manager) List() ([]Info, error) {
+	entries, err := ioutil.ReadDir(m.dir)
+	if os.IsNotExist(err) {
+		return []Info{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	archives := []Info{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, namePrefix) || !strings.HasSuffix(name, nameSuffix) {
+			continue
+		}
+		createdAt, err := time.Parse(nameTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, namePrefix), nameSuffix))
+		if err != nil {
+			continue
+		}
+		archives = append(archives, Info{Name: name, Size: entry.Size(), CreatedAt: createdAt})
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].CreatedAt.After(archives[j].CreatedAt)
+	})
+	return archives, nil
+}
+
+// prune removes the oldest archives beyond the number kept
+func (m *Manager) prune() error {
+	if m.keep <= 0 {
+		return nil
+	}
+	archives, err := m.List()
+	if err != nil {
+		return err
+	}
+	for i := m.keep; i < len(archives); i++ {
+		if err := os.Remove(filepath.Join(m.dir, archives[i].Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Schedule takes a snapshot every interval until the returned function is
+// called
+func (m *Manager) Schedule(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if info, err := m.Create(); err != nil {
+					fmt.Printf("Warning: Scheduled snapshot failed: %v\n", err)
+				} else {
+					fmt.Printf("Created snapshot %s\n", info.Name)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
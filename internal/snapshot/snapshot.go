@@ -0,0 +1,139 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// FormatVersion is written to the manifest of every archive. Archives with
+// a version this build does not know are refused.
+const FormatVersion = 1
+
+const manifestName = "manifest.json"
+
+// Manifest describes an archive. It is the first entry, followed by the
+// files it lists.
+type Manifest struct {
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"created_at"`
+	Files     map[string]string `json:"files"` // Name -> hex SHA-256
+}
+
+// Write stores files in a gzipped tar archive with a manifest
+func Write(w io.Writer, files map[string][]byte, createdAt time.Time) error {
+	manifest := Manifest{
+		Version:   FormatVersion,
+		CreatedAt: createdAt.UTC(),
+		Files:     make(map[string]string),
+	}
+	names := make([]string, 0, len(files))
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		manifest.Files[name] = hex.EncodeToString(sum[:])
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		header := &tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: manifest.CreatedAt,
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := archive.Write(data)
+		return err
+	}
+
+	if err := add(manifestName, manifestData); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := add(name, files[name]); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Read unpacks an archive made by Write, checking its version and that it
+// holds exactly the files its manifest lists, undamaged
+func Read(r io.Reader) (*Manifest, map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a snapshot archive: %w", err)
+	}
+	defer gz.Close()
+	archive := tar.NewReader(gz)
+
+	var manifest *Manifest
+	files := make(map[string][]byte)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("damaged snapshot archive: %w", err)
+		}
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, nil, fmt.Errorf("damaged snapshot archive: %w", err)
+		}
+
+		if manifest == nil {
+			if header.Name != manifestName {
+				return nil, nil, fmt.Errorf("snapshot archive does not start with a manifest")
+			}
+			manifest = &Manifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, nil, fmt.Errorf("unreadable snapshot manifest: %w", err)
+			}
+			if manifest.Version != FormatVersion {
+				return nil, nil, fmt.Errorf("unsupported snapshot version %d", manifest.Version)
+			}
+			continue
+		}
+
+		expected, listed := manifest.Files[header.Name]
+		if !listed {
+			return nil, nil, fmt.Errorf("snapshot holds %s, which its manifest does not list", header.Name)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != expected {
+			return nil, nil, fmt.Errorf("snapshot file %s does not match its checksum", header.Name)
+		}
+		files[header.Name] = data
+	}
+
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("snapshot archive is empty")
+	}
+	for name := range manifest.Files {
+		if _, exists := files[name]; !exists {
+			return nil, nil, fmt.Errorf("snapshot is missing %s", name)
+		}
+	}
+	return manifest, files, nil
+}
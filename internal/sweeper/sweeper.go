@@ -0,0 +1,32 @@
+package sweeper
+
+import (
+	"fmt"
+	"time"
+)
+
+// Start calls sweep every interval until the returned stop function is
+// called, logging what it removed
+func Start(name string, interval time.Duration, sweep func() (int, error)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				removed, err := sweep()
+				if err != nil {
+					fmt.Printf("Warning: %s sweep failed: %v\n", name, err)
+				} else if removed > 0 {
+					fmt.Printf("%s sweep removed %d expired entries\n", name, removed)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -14,6 +14,7 @@ export const DEFAULT_FILTERS = {
   query: '',
   tags: [],
   user_id: null,
+  shared: false,
   limit: 20,
   offset: 0,
 }
@@ -32,6 +32,12 @@ export function NewShaderPage() {
 export function MyShadersPage() {
   try { resetWorkspace(); } catch {}
   const user_id = get(user).user_id;
-  filters.update(currentFilters => ({ ...currentFilters, user_id }));
+  filters.update(currentFilters => ({ ...currentFilters, user_id, shared: false }));
+  pageState.set({ page: 'browse' });
+}
+
+export function SharedShadersPage() {
+  try { resetWorkspace(); } catch {}
+  filters.update(currentFilters => ({ ...currentFilters, user_id: null, shared: true }));
   pageState.set({ page: 'browse' });
 }
\ No newline at end of file
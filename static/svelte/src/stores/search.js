@@ -4,6 +4,7 @@ export const filters = writable({
     query: '',
     tags: [],
     user_id: null,
+    shared: false,
     limit: 20,
     offset: 0,
 });
@@ -13,6 +14,7 @@ export function clearFilters() {
         query: '',
         tags: [],
         user_id: null,
+        shared: false,
         limit: 20,
         offset: 0,
     });
@@ -1,27 +1,34 @@
 
 import { NO_USER, OFFLINE_USER } from "../constants";
 import {writable, derived} from 'svelte/store';
-import { apiGet, apiPost } from '../utils/api.js';
+import { apiGet, apiPost, setCsrfToken } from '../utils/api.js';
 
 export const user = writable(NO_USER);
 export const isOffline = derived(user, $user => $user.user_id === OFFLINE_USER.user_id);
+// Moderators and admins may edit and delete any shader
+export const canEditAnyShader = derived(user, $user => $user.role === 'moderator' || $user.role === 'admin');
 
 export function workOffline()
 {
     user.set(OFFLINE_USER);
 }
 
+function setAuthInfo(info) {
+    setCsrfToken(info.csrf_token);
+    user.set(info);
+}
+
 export async function login(username, password) {
-    user.set(await apiPost('/api/login', { username, password }));
+    setAuthInfo(await apiPost('/api/login', { username, password }));
 }
 
 export async function register(username, password) {
-    user.set(await apiPost('/api/register', { username, password }));
+    setAuthInfo(await apiPost('/api/register', { username, password }));
 }
 
 export async function getAuthInfo() {
     try {
-        user.set(await apiGet('/api/auth'));
+        setAuthInfo(await apiGet('/api/auth'));
     } catch (error) {
         user.set(OFFLINE_USER);
     }
@@ -29,5 +36,7 @@ export async function getAuthInfo() {
 
 export async function logout() {
     user.set(NO_USER);
-    return apiPost('/api/logout', {});
+    const result = await apiPost('/api/logout', {});
+    setCsrfToken('');
+    return result;
 }
\ No newline at end of file
@@ -1,3 +1,14 @@
+// CSRF token for the current session, sent with every state-changing request
+let csrfToken = '';
+
+export function setCsrfToken(token) {
+  csrfToken = token || '';
+}
+
+function csrfHeaders() {
+  return csrfToken ? { 'X-CSRF-Token': csrfToken } : {};
+}
+
 export async function apiGet(path) {
   const res = await fetch(path, { credentials: 'include' });
   if (!res.ok) throw new Error(`GET ${path} failed: ${res.status}`);
@@ -7,7 +18,7 @@ export async function apiGet(path) {
 export async function apiPost(path, body) {
   const res = await fetch(path, {
     method: 'POST',
-    headers: { 'Content-Type': 'application/json' },
+    headers: { 'Content-Type': 'application/json', ...csrfHeaders() },
     credentials: 'include',
     body: JSON.stringify(body)
   });
@@ -19,7 +30,7 @@ export async function apiPost(path, body) {
 export async function apiPut(path, body) {
   const res = await fetch(path, {
     method: 'PUT',
-    headers: { 'Content-Type': 'application/json' },
+    headers: { 'Content-Type': 'application/json', ...csrfHeaders() },
     credentials: 'include',
     body: JSON.stringify(body)
   });
@@ -30,6 +41,7 @@ export async function apiPut(path, body) {
 export async function apiDelete(path) {
   const res = await fetch(path, {
     method: 'DELETE',
+    headers: csrfHeaders(),
     credentials: 'include'
   });
   if (!res.ok) throw new Error(`DELETE ${path} failed: ${res.status}`);